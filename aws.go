@@ -1,7 +1,14 @@
 package gofaas
 
 import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/apigateway"
@@ -9,33 +16,60 @@ import (
 	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-xray-sdk-go/strategy/ctxmissing"
 	"github.com/aws/aws-xray-sdk-go/xray"
 )
 
 // AWS Clients that can be mocked for testing
+// The default clients are constructed lazily on first use so endpoints can be configured at runtime
 var (
-	APIGateway = NewAPIGateway()
-	DynamoDB = NewDynamoDB()
-	KMS      = NewKMS()
-	Lambda   = NewLambda()
-	S3       = NewS3()
-	SNS      = NewSNS()
-
-	sess = session.Must(session.NewSession())
+	APIGateway     APIGatewayAPI     = &lazyAPIGateway{}
+	DynamoDB       DynamoDBAPI       = &lazyDynamoDB{}
+	KMS            KMSAPI            = &lazyKMS{}
+	Lambda         LambdaAPI         = &lazyLambda{}
+	S3             S3API             = &lazyS3{}
+	SecretsManager SecretsManagerAPI = &lazySecretsManager{}
+	SES            SESAPI            = &lazySES{}
+	SNS            SNSAPI            = &lazySNS{}
+	SQS            SQSAPI            = &lazySQS{}
+	SSM            SSMAPI            = &lazySSM{}
+
+	// SessionHandlers is a hook to customize the request handlers of every client created from the session
+	// Tests use it to record or replay AWS API calls
+	SessionHandlers func(*request.Handlers)
+
+	sess     *session.Session
+	sessOnce sync.Once
 )
 
 func init() {
+	// log rather than panic when a client is used outside of an invocation, e.g. to resolve secrets at cold start
 	xray.Configure(xray.Config{
-		LogLevel: "info",
+		ContextMissingStrategy: ctxmissing.NewDefaultLogErrorStrategy(),
+		LogLevel:               "info",
 	})
 }
 
+// APIGatewayAPI is a subset of apigatewayiface.APIGatewayAPI
+type APIGatewayAPI interface {
+	GetStageWithContext(ctx aws.Context, input *apigateway.GetStageInput, opts ...request.Option) (*apigateway.Stage, error)
+	UpdateStageWithContext(ctx aws.Context, input *apigateway.UpdateStageInput, opts ...request.Option) (*apigateway.Stage, error)
+}
+
 // DynamoDBAPI is a subset of dynamodbiface.DynamoDBAPI
 type DynamoDBAPI interface {
 	DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error)
 	GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error)
 	PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error)
+	ScanPagesWithContext(ctx aws.Context, input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error
+	UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error)
 }
 
 // KMSAPI is a subset of kmsiface.KMSAPI
@@ -44,44 +78,408 @@ type KMSAPI interface {
 	EncryptWithContext(ctx aws.Context, input *kms.EncryptInput, opts ...request.Option) (*kms.EncryptOutput, error)
 }
 
+// LambdaAPI is a subset of lambdaiface.LambdaAPI
+type LambdaAPI interface {
+	InvokeWithContext(ctx aws.Context, input *lambda.InvokeInput, opts ...request.Option) (*lambda.InvokeOutput, error)
+}
+
+// S3API is a subset of s3iface.S3API
+// It includes the operations s3manager.Uploader uses, see NewUploader
+type S3API interface {
+	AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error)
+	CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error)
+	CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error)
+	DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error)
+	GetObjectRequest(input *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput)
+	GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error)
+	ListObjectsPagesWithContext(ctx aws.Context, input *s3.ListObjectsInput, fn func(*s3.ListObjectsOutput, bool) bool, opts ...request.Option) error
+	PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput)
+	PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error)
+	UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error)
+}
+
+// SecretsManagerAPI is a subset of secretsmanageriface.SecretsManagerAPI
+type SecretsManagerAPI interface {
+	GetSecretValueWithContext(ctx aws.Context, input *secretsmanager.GetSecretValueInput, opts ...request.Option) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// SESAPI is a subset of sesiface.SESAPI
+type SESAPI interface {
+	SendEmailWithContext(ctx aws.Context, input *ses.SendEmailInput, opts ...request.Option) (*ses.SendEmailOutput, error)
+}
+
+// SNSAPI is a subset of snsiface.SNSAPI
+type SNSAPI interface {
+	PublishWithContext(ctx aws.Context, input *sns.PublishInput, opts ...request.Option) (*sns.PublishOutput, error)
+}
+
+// SQSAPI is a subset of sqsiface.SQSAPI
+type SQSAPI interface {
+	DeleteMessageWithContext(ctx aws.Context, input *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error)
+	ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error)
+	SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error)
+}
+
+// SSMAPI is a subset of ssmiface.SSMAPI
+type SSMAPI interface {
+	GetParameterWithContext(ctx aws.Context, input *ssm.GetParameterInput, opts ...request.Option) (*ssm.GetParameterOutput, error)
+}
+
+// Session returns the shared AWS session, creating it on first use
+func Session() *session.Session {
+	sessOnce.Do(func() {
+		sess = session.Must(session.NewSession())
+	})
+	return sess
+}
+
+// ServiceConfig returns client config for a service with overrides from the environment
+// GOFAAS_<SERVICE>_ENDPOINT or GOFAAS_ENDPOINT point a client at a local stand-in like DynamoDB Local or LocalStack
+// GOFAAS_S3_FORCE_PATH_STYLE uses path-style S3 addressing as MinIO and LocalStack require
+func ServiceConfig(service string) *aws.Config {
+	c := aws.NewConfig()
+
+	ep := os.Getenv(fmt.Sprintf("GOFAAS_%s_ENDPOINT", strings.ToUpper(service)))
+	if ep == "" {
+		ep = os.Getenv("GOFAAS_ENDPOINT")
+	}
+	if ep != "" {
+		c = c.WithEndpoint(ep)
+	}
+
+	if service == s3.ServiceName {
+		if b, err := strconv.ParseBool(os.Getenv("GOFAAS_S3_FORCE_PATH_STYLE")); err == nil {
+			c = c.WithS3ForcePathStyle(b)
+		}
+	}
+
+	return c
+}
+
 // NewAPIGateway is an xray instrumented APIGateway client
 func NewAPIGateway() *apigateway.APIGateway {
-	c := apigateway.New(sess)
-	xray.AWS(c.Client)
+	c := apigateway.New(Session(), ServiceConfig(apigateway.ServiceName))
+	instrument(c.Client)
 	return c
 }
 
 // NewDynamoDB is an xray instrumented DynamoDB client
-func NewDynamoDB() DynamoDBAPI {
-	c := dynamodb.New(sess)
-	xray.AWS(c.Client)
+func NewDynamoDB() *dynamodb.DynamoDB {
+	c := dynamodb.New(Session(), ServiceConfig(dynamodb.ServiceName))
+	instrument(c.Client)
 	return c
 }
 
 // NewKMS is an xray instrumented KMS client
-func NewKMS() KMSAPI {
-	c := kms.New(sess)
-	xray.AWS(c.Client)
+func NewKMS() *kms.KMS {
+	c := kms.New(Session(), ServiceConfig(kms.ServiceName))
+	instrument(c.Client)
 	return c
 }
 
 // NewLambda is an xray instrumented Lambda client
 func NewLambda() *lambda.Lambda {
-	c := lambda.New(sess)
-	xray.AWS(c.Client)
+	c := lambda.New(Session(), ServiceConfig(lambda.ServiceName))
+	instrument(c.Client)
 	return c
 }
 
 // NewS3 is an xray instrumented S3 client
 func NewS3() *s3.S3 {
-	c := s3.New(sess)
-	xray.AWS(c.Client)
+	c := s3.New(Session(), ServiceConfig(s3.ServiceName))
+	instrument(c.Client)
+	return c
+}
+
+// NewUploader is an s3manager.Uploader for the S3 client
+func NewUploader() *s3manager.Uploader {
+	return s3manager.NewUploaderWithClient(uploaderS3{api: S3})
+}
+
+// NewSecretsManager is an xray instrumented SecretsManager client
+func NewSecretsManager() *secretsmanager.SecretsManager {
+	c := secretsmanager.New(Session(), ServiceConfig(secretsmanager.ServiceName))
+	instrument(c.Client)
+	return c
+}
+
+// NewSES is an xray instrumented SES client
+func NewSES() *ses.SES {
+	c := ses.New(Session(), ServiceConfig(ses.ServiceName))
+	instrument(c.Client)
 	return c
 }
 
 // NewSNS is an xray instrumented SNS client
 func NewSNS() *sns.SNS {
-	c := sns.New(sess)
-	xray.AWS(c.Client)
+	c := sns.New(Session(), ServiceConfig(sns.ServiceName))
+	instrument(c.Client)
 	return c
 }
+
+// NewSQS is an xray instrumented SQS client
+func NewSQS() *sqs.SQS {
+	c := sqs.New(Session(), ServiceConfig(sqs.ServiceName))
+	instrument(c.Client)
+	return c
+}
+
+// NewSSM is an xray instrumented SSM client
+func NewSSM() *ssm.SSM {
+	c := ssm.New(Session(), ServiceConfig(ssm.ServiceName))
+	instrument(c.Client)
+	return c
+}
+
+// instrument adds xray tracing and the SessionHandlers hook to a client
+func instrument(c *client.Client) {
+	xray.AWS(c)
+	if SessionHandlers != nil {
+		SessionHandlers(&c.Handlers)
+	}
+}
+
+// lazyAPIGateway constructs an APIGateway client on first use
+type lazyAPIGateway struct {
+	c    *apigateway.APIGateway
+	once sync.Once
+}
+
+func (l *lazyAPIGateway) client() *apigateway.APIGateway {
+	l.once.Do(func() { l.c = NewAPIGateway() })
+	return l.c
+}
+
+func (l *lazyAPIGateway) GetStageWithContext(ctx aws.Context, input *apigateway.GetStageInput, opts ...request.Option) (*apigateway.Stage, error) {
+	return l.client().GetStageWithContext(ctx, input, opts...)
+}
+
+func (l *lazyAPIGateway) UpdateStageWithContext(ctx aws.Context, input *apigateway.UpdateStageInput, opts ...request.Option) (*apigateway.Stage, error) {
+	return l.client().UpdateStageWithContext(ctx, input, opts...)
+}
+
+// lazyDynamoDB constructs a DynamoDB client on first use
+type lazyDynamoDB struct {
+	c    *dynamodb.DynamoDB
+	once sync.Once
+}
+
+func (l *lazyDynamoDB) client() *dynamodb.DynamoDB {
+	l.once.Do(func() { l.c = NewDynamoDB() })
+	return l.c
+}
+
+func (l *lazyDynamoDB) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	return l.client().DeleteItemWithContext(ctx, input, opts...)
+}
+
+func (l *lazyDynamoDB) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return l.client().GetItemWithContext(ctx, input, opts...)
+}
+
+func (l *lazyDynamoDB) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return l.client().PutItemWithContext(ctx, input, opts...)
+}
+
+func (l *lazyDynamoDB) ScanPagesWithContext(ctx aws.Context, input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	return l.client().ScanPagesWithContext(ctx, input, fn, opts...)
+}
+
+func (l *lazyDynamoDB) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return l.client().UpdateItemWithContext(ctx, input, opts...)
+}
+
+// lazyKMS constructs a KMS client on first use
+type lazyKMS struct {
+	c    *kms.KMS
+	once sync.Once
+}
+
+func (l *lazyKMS) client() *kms.KMS {
+	l.once.Do(func() { l.c = NewKMS() })
+	return l.c
+}
+
+func (l *lazyKMS) DecryptWithContext(ctx aws.Context, input *kms.DecryptInput, opts ...request.Option) (*kms.DecryptOutput, error) {
+	return l.client().DecryptWithContext(ctx, input, opts...)
+}
+
+func (l *lazyKMS) EncryptWithContext(ctx aws.Context, input *kms.EncryptInput, opts ...request.Option) (*kms.EncryptOutput, error) {
+	return l.client().EncryptWithContext(ctx, input, opts...)
+}
+
+// lazyLambda constructs a Lambda client on first use
+type lazyLambda struct {
+	c    *lambda.Lambda
+	once sync.Once
+}
+
+func (l *lazyLambda) client() *lambda.Lambda {
+	l.once.Do(func() { l.c = NewLambda() })
+	return l.c
+}
+
+func (l *lazyLambda) InvokeWithContext(ctx aws.Context, input *lambda.InvokeInput, opts ...request.Option) (*lambda.InvokeOutput, error) {
+	return l.client().InvokeWithContext(ctx, input, opts...)
+}
+
+// lazyS3 constructs an S3 client on first use
+type lazyS3 struct {
+	c    *s3.S3
+	once sync.Once
+}
+
+func (l *lazyS3) client() *s3.S3 {
+	l.once.Do(func() { l.c = NewS3() })
+	return l.c
+}
+
+func (l *lazyS3) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	return l.client().AbortMultipartUploadWithContext(ctx, input, opts...)
+}
+
+func (l *lazyS3) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	return l.client().CompleteMultipartUploadWithContext(ctx, input, opts...)
+}
+
+func (l *lazyS3) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	return l.client().CreateMultipartUploadWithContext(ctx, input, opts...)
+}
+
+func (l *lazyS3) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	return l.client().DeleteObjectsWithContext(ctx, input, opts...)
+}
+
+func (l *lazyS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return l.client().GetObjectWithContext(ctx, input, opts...)
+}
+
+func (l *lazyS3) GetObjectRequest(input *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
+	return l.client().GetObjectRequest(input)
+}
+
+func (l *lazyS3) ListObjectsPagesWithContext(ctx aws.Context, input *s3.ListObjectsInput, fn func(*s3.ListObjectsOutput, bool) bool, opts ...request.Option) error {
+	return l.client().ListObjectsPagesWithContext(ctx, input, fn, opts...)
+}
+
+func (l *lazyS3) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	return l.client().PutObjectRequest(input)
+}
+
+func (l *lazyS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	return l.client().PutObjectWithContext(ctx, input, opts...)
+}
+
+func (l *lazyS3) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	return l.client().UploadPartWithContext(ctx, input, opts...)
+}
+
+// lazySecretsManager constructs a SecretsManager client on first use
+type lazySecretsManager struct {
+	c    *secretsmanager.SecretsManager
+	once sync.Once
+}
+
+func (l *lazySecretsManager) client() *secretsmanager.SecretsManager {
+	l.once.Do(func() { l.c = NewSecretsManager() })
+	return l.c
+}
+
+func (l *lazySecretsManager) GetSecretValueWithContext(ctx aws.Context, input *secretsmanager.GetSecretValueInput, opts ...request.Option) (*secretsmanager.GetSecretValueOutput, error) {
+	return l.client().GetSecretValueWithContext(ctx, input, opts...)
+}
+
+// lazySES constructs an SES client on first use
+type lazySES struct {
+	c    *ses.SES
+	once sync.Once
+}
+
+func (l *lazySES) client() *ses.SES {
+	l.once.Do(func() { l.c = NewSES() })
+	return l.c
+}
+
+func (l *lazySES) SendEmailWithContext(ctx aws.Context, input *ses.SendEmailInput, opts ...request.Option) (*ses.SendEmailOutput, error) {
+	return l.client().SendEmailWithContext(ctx, input, opts...)
+}
+
+// lazySNS constructs an SNS client on first use
+type lazySNS struct {
+	c    *sns.SNS
+	once sync.Once
+}
+
+func (l *lazySNS) client() *sns.SNS {
+	l.once.Do(func() { l.c = NewSNS() })
+	return l.c
+}
+
+func (l *lazySNS) PublishWithContext(ctx aws.Context, input *sns.PublishInput, opts ...request.Option) (*sns.PublishOutput, error) {
+	return l.client().PublishWithContext(ctx, input, opts...)
+}
+
+// lazySQS constructs an SQS client on first use
+type lazySQS struct {
+	c    *sqs.SQS
+	once sync.Once
+}
+
+func (l *lazySQS) client() *sqs.SQS {
+	l.once.Do(func() { l.c = NewSQS() })
+	return l.c
+}
+
+func (l *lazySQS) DeleteMessageWithContext(ctx aws.Context, input *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	return l.client().DeleteMessageWithContext(ctx, input, opts...)
+}
+
+func (l *lazySQS) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	return l.client().ReceiveMessageWithContext(ctx, input, opts...)
+}
+
+func (l *lazySQS) SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	return l.client().SendMessageWithContext(ctx, input, opts...)
+}
+
+// lazySSM constructs an SSM client on first use
+type lazySSM struct {
+	c    *ssm.SSM
+	once sync.Once
+}
+
+func (l *lazySSM) client() *ssm.SSM {
+	l.once.Do(func() { l.c = NewSSM() })
+	return l.c
+}
+
+func (l *lazySSM) GetParameterWithContext(ctx aws.Context, input *ssm.GetParameterInput, opts ...request.Option) (*ssm.GetParameterOutput, error) {
+	return l.client().GetParameterWithContext(ctx, input, opts...)
+}
+
+// uploaderS3 satisfies s3iface.S3API for s3manager.Uploader with an S3API
+// Only the operations the uploader uses are implemented, any other call panics
+type uploaderS3 struct {
+	s3iface.S3API
+	api S3API
+}
+
+func (u uploaderS3) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	return u.api.AbortMultipartUploadWithContext(ctx, input, opts...)
+}
+
+func (u uploaderS3) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	return u.api.CompleteMultipartUploadWithContext(ctx, input, opts...)
+}
+
+func (u uploaderS3) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	return u.api.CreateMultipartUploadWithContext(ctx, input, opts...)
+}
+
+func (u uploaderS3) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	return u.api.PutObjectRequest(input)
+}
+
+func (u uploaderS3) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	return u.api.UploadPartWithContext(ctx, input, opts...)
+}
@@ -1,31 +1,284 @@
 package gofaas
 
 import (
+	"bytes"
 	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
 	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/aws/aws-sdk-go/service/apigateway"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/nzoschke/gofaas/dynamodbtest"
 )
 
+// MockAPIGateway is a mock APIGatewayAPI implementation that saves stage updates
+// If Stages is set it holds stages keyed by "RestApiId/StageName", and updates apply their patch operations.
+type MockAPIGateway struct {
+	Inputs []*apigateway.UpdateStageInput
+	Stages map[string]*apigateway.Stage
+}
+
+func (m *MockAPIGateway) GetStageWithContext(ctx aws.Context, input *apigateway.GetStageInput, opts ...request.Option) (*apigateway.Stage, error) {
+	st, ok := m.Stages[aws.StringValue(input.RestApiId)+"/"+aws.StringValue(input.StageName)]
+	if !ok {
+		return nil, awserr.NewRequestFailure(awserr.New(apigateway.ErrCodeNotFoundException, "Invalid stage identifier specified", nil), 404, "mock")
+	}
+	return st, nil
+}
+
+func (m *MockAPIGateway) UpdateStageWithContext(ctx aws.Context, input *apigateway.UpdateStageInput, opts ...request.Option) (*apigateway.Stage, error) {
+	m.Inputs = append(m.Inputs, input)
+
+	k := aws.StringValue(input.RestApiId) + "/" + aws.StringValue(input.StageName)
+	st, ok := m.Stages[k]
+	if !ok {
+		return &apigateway.Stage{StageName: input.StageName}, nil
+	}
+
+	settings := stageSettings(st)
+	for _, op := range input.PatchOperations {
+		p := aws.StringValue(op.Path)
+		switch aws.StringValue(op.Op) {
+		case "replace":
+			settings[p] = aws.StringValue(op.Value)
+		case "remove":
+			for q := range settings {
+				if q == p || strings.HasPrefix(q, p+"/") {
+					delete(settings, q)
+				}
+			}
+		default:
+			return nil, awserr.NewRequestFailure(awserr.New(apigateway.ErrCodeBadRequestException, "Invalid patch operation", nil), 400, "mock")
+		}
+	}
+
+	m.Stages[k] = mockStage(input.StageName, settings)
+	return m.Stages[k], nil
+}
+
+// mockStage returns a stage with settings keyed by patch path, like stageSettings returns
+func mockStage(name *string, settings map[string]string) *apigateway.Stage {
+	st := &apigateway.Stage{StageName: name}
+	b := func(v string) *bool { return aws.Bool(v == "true") }
+	f := func(v string) *float64 { n, _ := strconv.ParseFloat(v, 64); return aws.Float64(n) }
+	i := func(v string) *int64 { n, _ := strconv.ParseInt(v, 10, 64); return aws.Int64(n) }
+
+	for p, v := range settings {
+		parts := strings.Split(p, "/")[1:]
+		switch {
+		case parts[0] == "accessLogSettings":
+			if st.AccessLogSettings == nil {
+				st.AccessLogSettings = &apigateway.AccessLogSettings{}
+			}
+			if parts[1] == "destinationArn" {
+				st.AccessLogSettings.DestinationArn = aws.String(v)
+			} else {
+				st.AccessLogSettings.Format = aws.String(v)
+			}
+		case parts[0] == "cacheClusterEnabled":
+			st.CacheClusterEnabled = b(v)
+		case parts[0] == "cacheClusterSize":
+			st.CacheClusterSize = aws.String(v)
+		case parts[0] == "canarySettings":
+			if st.CanarySettings == nil {
+				st.CanarySettings = &apigateway.CanarySettings{}
+			}
+			c := st.CanarySettings
+			switch parts[1] {
+			case "deploymentId":
+				c.DeploymentId = aws.String(v)
+			case "percentTraffic":
+				c.PercentTraffic = f(v)
+			case "stageVariableOverrides":
+				if c.StageVariableOverrides == nil {
+					c.StageVariableOverrides = map[string]*string{}
+				}
+				c.StageVariableOverrides[parts[2]] = aws.String(v)
+			case "useStageCache":
+				c.UseStageCache = b(v)
+			}
+		case parts[0] == "tracingEnabled":
+			st.TracingEnabled = b(v)
+		default:
+			if st.MethodSettings == nil {
+				st.MethodSettings = map[string]*apigateway.MethodSetting{}
+			}
+			k := parts[0] + "/" + parts[1]
+			if st.MethodSettings[k] == nil {
+				st.MethodSettings[k] = &apigateway.MethodSetting{}
+			}
+			ms := st.MethodSettings[k]
+			switch parts[2] + "/" + parts[3] {
+			case "caching/dataEncrypted":
+				ms.CacheDataEncrypted = b(v)
+			case "caching/enabled":
+				ms.CachingEnabled = b(v)
+			case "caching/ttlInSeconds":
+				ms.CacheTtlInSeconds = i(v)
+			case "throttling/burstLimit":
+				ms.ThrottlingBurstLimit = i(v)
+			case "throttling/rateLimit":
+				ms.ThrottlingRateLimit = f(v)
+			}
+		}
+	}
+
+	return st
+}
+
 // MockDynamoDB is a mock DynamoDBAPI implementation
+// If Items is set it is an in-memory table keyed by the "id" attribute instead of returning the canned outputs
+// The in-memory table evaluates condition and update expressions with dynamodbtest
 type MockDynamoDB struct {
 	DeleteItemOutput *dynamodb.DeleteItemOutput
 	GetItemOutput    *dynamodb.GetItemOutput
 	PutItemOutput    *dynamodb.PutItemOutput
+	UpdateItemOutput *dynamodb.UpdateItemOutput
+
+	Items map[string]map[string]*dynamodb.AttributeValue
+	mu    sync.Mutex
 }
 
 func (m *MockDynamoDB) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
-	return m.DeleteItemOutput, nil
+	if m.Items == nil {
+		return m.DeleteItemOutput, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := aws.StringValue(input.Key["id"].S)
+	ok, err := dynamodbtest.Condition(m.Items[id], input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, dynamodbtest.ErrConditionalCheckFailed
+	}
+
+	delete(m.Items, id)
+	return &dynamodb.DeleteItemOutput{}, nil
 }
 
 func (m *MockDynamoDB) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
-	return m.GetItemOutput, nil
+	if m.Items == nil {
+		return m.GetItemOutput, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, err := dynamodbtest.Project(m.Items[aws.StringValue(input.Key["id"].S)], input.ProjectionExpression, input.ExpressionAttributeNames)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.GetItemOutput{Item: dynamodbtest.Copy(item)}, nil
 }
 
 func (m *MockDynamoDB) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
-	return m.PutItemOutput, nil
+	if m.Items == nil {
+		return m.PutItemOutput, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := aws.StringValue(input.Item["id"].S)
+	ok, err := dynamodbtest.Condition(m.Items[id], input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, dynamodbtest.ErrConditionalCheckFailed
+	}
+
+	m.Items[id] = dynamodbtest.Copy(input.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (m *MockDynamoDB) ScanPagesWithContext(ctx aws.Context, input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	m.mu.Lock()
+	ids := []string{}
+	for id := range m.Items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	out := &dynamodb.ScanOutput{}
+	for _, id := range ids {
+		ok, err := dynamodbtest.Condition(m.Items[id], input.FilterExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+		if err != nil {
+			m.mu.Unlock()
+			return err
+		}
+		if ok {
+			out.Items = append(out.Items, dynamodbtest.Copy(m.Items[id]))
+		}
+	}
+	m.mu.Unlock()
+
+	fn(out, true)
+	return nil
+}
+
+func (m *MockDynamoDB) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	if m.Items == nil {
+		return m.UpdateItemOutput, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := aws.StringValue(input.Key["id"].S)
+	old := m.Items[id]
+
+	ok, err := dynamodbtest.Condition(old, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, dynamodbtest.ErrConditionalCheckFailed
+	}
+
+	item := dynamodbtest.Copy(old)
+	if item == nil {
+		item = dynamodbtest.Copy(input.Key)
+	}
+
+	updated, err := dynamodbtest.Update(item, input.UpdateExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	m.Items[id] = item
+
+	out := &dynamodb.UpdateItemOutput{}
+	switch aws.StringValue(input.ReturnValues) {
+	case dynamodb.ReturnValueAllNew:
+		out.Attributes = dynamodbtest.Copy(item)
+	case dynamodb.ReturnValueAllOld:
+		out.Attributes = dynamodbtest.Copy(old)
+	case dynamodb.ReturnValueUpdatedNew:
+		out.Attributes = dynamodbtest.Copy(dynamodbtest.Attributes(item, updated))
+	case dynamodb.ReturnValueUpdatedOld:
+		out.Attributes = dynamodbtest.Copy(dynamodbtest.Attributes(old, updated))
+	}
+	return out, nil
 }
 
 // MockKMS is a mock KMSAPI implementation
@@ -43,3 +296,284 @@ func (m *MockKMS) EncryptWithContext(ctx aws.Context, input *kms.EncryptInput, o
 		CiphertextBlob: []byte(base64.StdEncoding.EncodeToString(input.Plaintext)),
 	}, nil
 }
+
+// MockLambda is a mock LambdaAPI implementation
+type MockLambda struct {
+	Inputs []*lambda.InvokeInput
+}
+
+func (m *MockLambda) InvokeWithContext(ctx aws.Context, input *lambda.InvokeInput, opts ...request.Option) (*lambda.InvokeOutput, error) {
+	m.Inputs = append(m.Inputs, input)
+	return &lambda.InvokeOutput{
+		StatusCode: aws.Int64(202),
+	}, nil
+}
+
+// MockS3 is a mock S3API implementation backed by a map of keys to object bodies
+// Modified optionally sets the last modified time of objects
+// Puts saves the input of every object put, or uploaded in parts, without the body
+type MockS3 struct {
+	Modified map[string]time.Time
+	Objects  map[string][]byte
+	PageSize int
+	Puts     []*s3.PutObjectInput
+
+	mu      sync.Mutex
+	uploads map[string]*mockUpload
+}
+
+type mockUpload struct {
+	input *s3.CreateMultipartUploadInput
+	parts map[int64][]byte
+}
+
+func (m *MockS3) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.uploads, *input.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (m *MockS3) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.uploads[*input.UploadId]
+	delete(m.uploads, *input.UploadId)
+
+	b := []byte{}
+	for _, p := range input.MultipartUpload.Parts {
+		b = append(b, u.parts[*p.PartNumber]...)
+	}
+
+	m.put(&s3.PutObjectInput{
+		Bucket:          u.input.Bucket,
+		ContentEncoding: u.input.ContentEncoding,
+		ContentType:     u.input.ContentType,
+		Key:             u.input.Key,
+		Metadata:        u.input.Metadata,
+	}, b)
+	return &s3.CompleteMultipartUploadOutput{Key: input.Key}, nil
+}
+
+func (m *MockS3) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.uploads == nil {
+		m.uploads = map[string]*mockUpload{}
+	}
+	id := fmt.Sprintf("upload-%d", len(m.uploads)+1)
+	m.uploads[id] = &mockUpload{input: input, parts: map[int64][]byte{}}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (m *MockS3) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := &s3.DeleteObjectsOutput{}
+	for _, o := range input.Delete.Objects {
+		delete(m.Objects, *o.Key)
+		out.Deleted = append(out.Deleted, &s3.DeletedObject{Key: o.Key})
+	}
+	return out, nil
+}
+
+func (m *MockS3) GetObjectRequest(input *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
+	c := s3.New(unit.Session)
+	return c.GetObjectRequest(input)
+}
+
+func (m *MockS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.Objects[*input.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(b)),
+		ContentLength: aws.Int64(int64(len(b))),
+	}, nil
+}
+
+func (m *MockS3) ListObjectsPagesWithContext(ctx aws.Context, input *s3.ListObjectsInput, fn func(*s3.ListObjectsOutput, bool) bool, opts ...request.Option) error {
+	keys := []string{}
+	for k := range m.Objects {
+		if strings.HasPrefix(k, aws.StringValue(input.Prefix)) && k > aws.StringValue(input.Marker) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	size := m.PageSize
+	if size == 0 {
+		size = 1000
+	}
+
+	for i := 0; i == 0 || i < len(keys); i += size {
+		j := i + size
+		if j > len(keys) {
+			j = len(keys)
+		}
+
+		out := &s3.ListObjectsOutput{}
+		for _, k := range keys[i:j] {
+			out.Contents = append(out.Contents, &s3.Object{
+				Key:          aws.String(k),
+				LastModified: aws.Time(m.Modified[k]),
+				Size:         aws.Int64(int64(len(m.Objects[k]))),
+			})
+		}
+		if !fn(out, j == len(keys)) {
+			break
+		}
+	}
+	return nil
+}
+
+// PutObjectRequest returns a request that calls PutObjectWithContext when sent
+func (m *MockS3) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	out := &s3.PutObjectOutput{}
+	r := request.New(aws.Config{}, metadata.ClientInfo{ServiceName: s3.ServiceName}, request.Handlers{}, nil, &request.Operation{Name: "PutObject"}, input, out)
+	r.Handlers.Send.PushBack(func(r *request.Request) {
+		if _, err := m.PutObjectWithContext(r.Context(), input); err != nil {
+			r.Error = err
+		}
+	})
+	return r, out
+}
+
+func (m *MockS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	b, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.put(input, b)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *MockS3) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	b, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.uploads[*input.UploadId].parts[*input.PartNumber] = b
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("etag-%d", *input.PartNumber))}, nil
+}
+
+func (m *MockS3) put(input *s3.PutObjectInput, b []byte) {
+	if m.Objects == nil {
+		m.Objects = map[string][]byte{}
+	}
+	m.Objects[*input.Key] = b
+
+	in := *input
+	in.Body = nil
+	m.Puts = append(m.Puts, &in)
+}
+
+// MockSES is a mock SESAPI implementation that saves sent emails
+type MockSES struct {
+	Inputs []*ses.SendEmailInput
+}
+
+func (m *MockSES) SendEmailWithContext(ctx aws.Context, input *ses.SendEmailInput, opts ...request.Option) (*ses.SendEmailOutput, error) {
+	m.Inputs = append(m.Inputs, input)
+	return &ses.SendEmailOutput{
+		MessageId: aws.String("mock"),
+	}, nil
+}
+
+// MockSNS is a mock SNSAPI implementation that saves published messages
+type MockSNS struct {
+	Inputs []*sns.PublishInput
+}
+
+func (m *MockSNS) PublishWithContext(ctx aws.Context, input *sns.PublishInput, opts ...request.Option) (*sns.PublishOutput, error) {
+	m.Inputs = append(m.Inputs, input)
+	return &sns.PublishOutput{
+		MessageId: aws.String("mock"),
+	}, nil
+}
+
+// MockSQS is a mock SQSAPI implementation backed by in-memory queues keyed by URL
+// Received messages stay in flight until deleted, as if their visibility timeout never expires
+type MockSQS struct {
+	Queues map[string][]*sqs.Message
+
+	inflight map[string]string
+	n        int
+	mu       sync.Mutex
+}
+
+func (m *MockSQS) DeleteMessageWithContext(ctx aws.Context, input *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.inflight, *input.ReceiptHandle)
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (m *MockSQS) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q := m.Queues[*input.QueueUrl]
+	n := int(aws.Int64Value(input.MaxNumberOfMessages))
+	if n == 0 {
+		n = 1
+	}
+	if n > len(q) {
+		n = len(q)
+	}
+
+	if m.inflight == nil {
+		m.inflight = map[string]string{}
+	}
+
+	out := &sqs.ReceiveMessageOutput{Messages: q[:n]}
+	for _, msg := range out.Messages {
+		m.inflight[*msg.ReceiptHandle] = *input.QueueUrl
+	}
+	m.Queues[*input.QueueUrl] = q[n:]
+	return out, nil
+}
+
+func (m *MockSQS) SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.n++
+	id := fmt.Sprintf("message-%d", m.n)
+
+	if m.Queues == nil {
+		m.Queues = map[string][]*sqs.Message{}
+	}
+	m.Queues[*input.QueueUrl] = append(m.Queues[*input.QueueUrl], &sqs.Message{
+		Attributes:        map[string]*string{"ApproximateReceiveCount": aws.String("0")},
+		Body:              input.MessageBody,
+		MessageAttributes: input.MessageAttributes,
+		MessageId:         aws.String(id),
+		ReceiptHandle:     aws.String("receipt-" + id),
+	})
+	return &sqs.SendMessageOutput{MessageId: aws.String(id)}, nil
+}
+
+// InFlight returns the number of received messages that were not deleted
+func (m *MockSQS) InFlight() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.inflight)
+}
@@ -0,0 +1,230 @@
+package gofaas
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+var (
+	// jobCancelInterval is the longest a context from WithJobCancel waits between checks for a cancel request
+	// With a deadline it checks after half the remaining time, so a short invocation checks once or twice.
+	jobCancelInterval = 10 * time.Second
+
+	// jobCancelIntervalMin is the shortest wait between checks, so workers don't throttle the jobs table
+	// Closer to the deadline the worker stops checking, and its conditional end update sees the request.
+	jobCancelIntervalMin = 2 * time.Second
+
+	// jobCancelGrace is how long a running job can stay cancel-requested before WorkCancel cancels it itself
+	// It is the longest a Lambda invocation runs, so a live worker has seen the request by then.
+	jobCancelGrace = 15 * time.Minute
+)
+
+type jobCancelKey struct{}
+
+// WorkCancel requests cancellation of a job of the caller
+// A queued job is cancelled right away. A running job is marked cancel-requested and its worker cancels it.
+// A job still cancel-requested after jobCancelGrace lost its worker, so a repeated request cancels it.
+func WorkCancel(ctx context.Context, e events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	claims := &jwt.StandardClaims{}
+	r, _, err := JWTClaims(e, claims)
+	if err != nil {
+		return r, nil
+	}
+
+	id := e.PathParameters["id"]
+	if _, err := jobGetFor(ctx, id, claims.Subject); err != nil {
+		if err, ok := err.(ResponseError); ok {
+			return err.Response()
+		}
+		return responseEmpty, errors.WithStack(err)
+	}
+
+	names := map[string]string{"#status": "status"}
+	j, err := jobUpdate(ctx, id,
+		"SET #status = :cancelled, cancel_requested = :true, time_end = :now",
+		"#status = :queued",
+		names,
+		map[string]interface{}{":cancelled": JobCancelled, ":now": time.Now(), ":queued": JobQueued, ":true": true},
+	)
+	if err == nil {
+		quotaRelease(ctx, id)
+	}
+	if jobConflict(err) {
+		j, err = jobUpdate(ctx, id,
+			"SET cancel_requested = :true, time_cancel = if_not_exists(time_cancel, :now)",
+			"#status = :running",
+			names,
+			map[string]interface{}{":now": time.Now(), ":running": JobRunning, ":true": true},
+		)
+		if err == nil && j.TimeCancel != nil && time.Since(*j.TimeCancel) > jobCancelGrace {
+			log.Printf("Worker job %s cancel requested at %s was not seen by a worker\n", id, j.TimeCancel)
+			if err := jobCancel(ctx, j); err != nil {
+				return responseEmpty, errors.WithStack(err)
+			}
+			j, err = jobGet(ctx, id)
+		}
+	}
+	if err != nil {
+		if jobConflict(err) {
+			return ResponseError{fmt.Sprintf("job %s is not queued or running", id), 409}.Response()
+		}
+		return responseEmpty, errors.WithStack(err)
+	}
+
+	return jobResponse(j, 202)
+}
+
+// WithJobCancel returns a copy of ctx that is cancelled once cancellation of the job is requested
+// Work checks for cancellation cooperatively through ctx.Err(), and JobCancelRequested tells it apart from a timeout
+func WithJobCancel(ctx context.Context, id string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	requested := new(int32)
+	ctx = context.WithValue(ctx, jobCancelKey{}, requested)
+
+	go func() {
+		for {
+			wait, ok := jobCancelWait(ctx)
+			if !ok {
+				return
+			}
+
+			t := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+
+			cancelled, err := jobCancelCheck(ctx, id)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Worker job %s cancel check error %+v\n", id, err)
+				}
+				continue
+			}
+
+			if cancelled {
+				log.Printf("Worker job %s cancel requested\n", id)
+				atomic.StoreInt32(requested, 1)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// jobCancelWait returns how long to wait for the next cancel check, or false if there is no time left for one
+func jobCancelWait(ctx context.Context) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return jobCancelInterval, true
+	}
+
+	wait := time.Until(deadline) / 2
+	if wait > jobCancelInterval {
+		wait = jobCancelInterval
+	}
+	return wait, wait >= jobCancelIntervalMin
+}
+
+// jobCancelCheck reads only the status and cancel request of a job, not its input or shard statuses
+func jobCancelCheck(ctx context.Context, id string) (bool, error) {
+	out, err := DynamoDB.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		ExpressionAttributeNames: map[string]*string{"#status": aws.String("status")},
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: aws.String(id),
+			},
+		},
+		ProjectionExpression: aws.String("cancel_requested, #status"),
+		TableName:            aws.String(Config.Jobs.TableName),
+	})
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	j := Job{}
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &j); err != nil {
+		return false, errors.WithStack(err)
+	}
+	return j.CancelRequested || j.Status == JobCancelled, nil
+}
+
+// JobCancelRequested returns if a context from WithJobCancel was cancelled because cancellation of its job was requested
+func JobCancelRequested(ctx context.Context) bool {
+	requested, ok := ctx.Value(jobCancelKey{}).(*int32)
+	return ok && atomic.LoadInt32(requested) == 1
+}
+
+// jobCancel marks a job cancelled and deletes its partial output
+func jobCancel(ctx context.Context, j *Job) error {
+	_, err := jobUpdate(ctx, j.ID,
+		"SET #status = :cancelled, time_end = :now",
+		"#status IN (:queued, :running)",
+		map[string]string{"#status": "status"},
+		map[string]interface{}{":cancelled": JobCancelled, ":now": time.Now(), ":queued": JobQueued, ":running": JobRunning},
+	)
+	if err != nil && !jobConflict(err) {
+		return errors.WithStack(err)
+	}
+
+	log.Printf("Worker job %s cancelled\n", j.ID)
+	quotaRelease(ctx, j.ID)
+	jobCleanup(ctx, j)
+	return nil
+}
+
+// jobChanged handles a worker status update that conflicted with a concurrent change to its job
+// A job that was cancelled or had its cancellation requested is cancelled, otherwise another delivery ended it.
+func jobChanged(ctx context.Context, id string) error {
+	j, err := jobGet(ctx, id)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if j.CancelRequested || j.Status == JobCancelled {
+		return jobCancel(ctx, j)
+	}
+
+	log.Printf("Worker job %s already %s\n", j.ID, j.Status)
+	return nil
+}
+
+// jobCleanup deletes the partial output of a job: its report, report parts, shard outputs and checkpoint
+func jobCleanup(ctx context.Context, j *Job) {
+	keys := []string{}
+	err := S3.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
+		Bucket: aws.String(Config.Worker.Bucket),
+		Prefix: aws.String(reportPrefix(j.TimeCreated, j.ID)),
+	}, func(out *s3.ListObjectsOutput, last bool) bool {
+		for _, o := range out.Contents {
+			keys = append(keys, aws.StringValue(o.Key))
+		}
+		return true
+	})
+	if err == nil {
+		err = reportDelete(ctx, keys)
+	}
+	if err != nil {
+		log.Printf("Worker job %s cleanup error %+v\n", j.ID, err)
+	}
+
+	if err := checkpoints().Delete(ctx, workCheckpoint(j.ID)); err != nil {
+		log.Printf("Worker job %s checkpoint cleanup error %+v\n", j.ID, err)
+	}
+}
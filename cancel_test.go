@@ -0,0 +1,412 @@
+package gofaas
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	jwt "github.com/dgrijalva/jwt-go"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkCancel(t *testing.T) {
+	Config.Continue.FunctionName = "gofaas-WorkerFunction"
+	Config.Jobs.TableName = "gofaas-JobsTable"
+	Config.Work.WorkerFunctionName = "gofaas-WorkerFunction"
+	Config.Worker.Bucket = "gofaas-bucket"
+	defer func() { Config.Continue.FunctionName = "" }()
+
+	defer deadlineNearAlways()()
+
+	ids := []string{"26f0dc9f-4483-4b65-8724-3d1598ff6d14", "7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d"}
+	UUIDGen = func() uuid.UUID {
+		id := ids[0]
+		ids = ids[1:]
+		return uuid.Must(uuid.FromString(id))
+	}
+
+	ml := &MockLambda{}
+	ms3 := &MockS3{}
+
+	DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+	Lambda = ml
+	S3 = ms3
+
+	ctx := context.Background()
+
+	// a queued job is cancelled right away and the worker skips it
+	r, err := WorkCreate(ctx, events.APIGatewayProxyRequest{Body: `[1, 2, 3]`})
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+
+	r, err = workCancel(ctx, "26f0dc9f-4483-4b65-8724-3d1598ff6d14")
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+	assert.Contains(t, r.Body, `"status": "cancelled"`)
+
+	assert.Len(t, workContinueRun(t, ml), 0)
+	assert.Len(t, ml.Inputs, 1)
+	assert.Len(t, ms3.Objects, 0)
+
+	r, err = workCancel(ctx, "26f0dc9f-4483-4b65-8724-3d1598ff6d14")
+	assert.NoError(t, err)
+	assert.Equal(t, 409, r.StatusCode)
+
+	// a running job is marked cancel-requested, then its worker cancels it and deletes the partial output
+	ml.Inputs = nil
+	r, err = WorkCreate(ctx, events.APIGatewayProxyRequest{Body: `[1, 2, 3]`})
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+
+	e := WorkerEvent{}
+	assert.NoError(t, json.Unmarshal(ml.Inputs[0].Payload, &e))
+	wctx, cancel := context.WithTimeout(ctx, time.Minute)
+	assert.NoError(t, Worker(wctx, e))
+	cancel()
+
+	// a report part and the checkpoint
+	assert.Len(t, ms3.Objects, 2)
+
+	r, err = workCancel(ctx, "7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d")
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+	assert.Contains(t, r.Body, `"cancel_requested": true`)
+	assert.Contains(t, r.Body, `"status": "running"`)
+
+	n := len(ml.Inputs)
+	assert.Len(t, workContinueRun(t, ml), 0)
+	assert.Equal(t, n, len(ml.Inputs))
+
+	j := workQueueJob(t, "7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d")
+	assert.Equal(t, JobCancelled, j.Status)
+	assert.NotNil(t, j.TimeEnd)
+	assert.Len(t, ms3.Objects, 0)
+
+	r, err = workCancel(ctx, "missing")
+	assert.NoError(t, err)
+	assert.Equal(t, 404, r.StatusCode)
+}
+
+func TestWorkCancelFanOut(t *testing.T) {
+	Config.Continue.FunctionName = "gofaas-WorkerFunction"
+	Config.FanOut.Concurrency = 1
+	Config.Jobs.TableName = "gofaas-JobsTable"
+	Config.Work.WorkerFunctionName = "gofaas-WorkerFunction"
+	Config.Worker.Bucket = "gofaas-bucket"
+	defer func() {
+		Config.Continue.FunctionName = ""
+		Config.FanOut.Concurrency = 0
+	}()
+
+	UUIDGen = func() uuid.UUID {
+		return uuid.Must(uuid.FromString("26f0dc9f-4483-4b65-8724-3d1598ff6d14"))
+	}
+
+	ml := &MockLambda{}
+	ms3 := &MockS3{}
+
+	DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+	Lambda = ml
+	S3 = ms3
+
+	ctx := context.Background()
+
+	r, err := WorkCreate(ctx, events.APIGatewayProxyRequest{
+		Body:                  `[1, 2, 3]`,
+		QueryStringParameters: map[string]string{"chunk_size": "1"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+
+	// the coordinator sends shard 1, which finishes and sends shard 2
+	for i := 0; i < 2; i++ {
+		e := WorkerEvent{}
+		assert.NoError(t, json.Unmarshal(ml.Inputs[i].Payload, &e))
+		assert.NoError(t, Worker(ctx, e))
+	}
+	assert.Len(t, ml.Inputs, 3)
+	assert.Len(t, ms3.Objects, 1)
+
+	r, err = workCancel(ctx, "26f0dc9f-4483-4b65-8724-3d1598ff6d14")
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+
+	// shard 2 cancels the job instead of working and sending shard 3
+	assert.Len(t, fanOutRun(t, ml), 0)
+	assert.Len(t, ml.Inputs, 3)
+
+	j := workQueueJob(t, "26f0dc9f-4483-4b65-8724-3d1598ff6d14")
+	assert.Equal(t, JobCancelled, j.Status)
+	assert.Len(t, ms3.Objects, 0)
+}
+
+func TestWorkCancelRace(t *testing.T) {
+	Config.Jobs.TableName = "gofaas-JobsTable"
+	Config.Work.WorkerFunctionName = "gofaas-WorkerFunction"
+	Config.Worker.Bucket = "gofaas-bucket"
+
+	ids := []string{"26f0dc9f-4483-4b65-8724-3d1598ff6d14", "7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d"}
+	UUIDGen = func() uuid.UUID {
+		id := ids[0]
+		ids = ids[1:]
+		return uuid.Must(uuid.FromString(id))
+	}
+
+	ml := &MockLambda{}
+	ms3 := &MockS3{}
+	mdb := &cancelRaceDynamoDB{DynamoDBAPI: &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}}
+
+	DynamoDB = mdb
+	Lambda = ml
+	S3 = ms3
+
+	ctx := context.Background()
+
+	// a queued job cancelled after its worker read it isn't started again
+	r, err := WorkCreate(ctx, events.APIGatewayProxyRequest{Body: `[1, 2, 3]`})
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+
+	e := WorkerEvent{}
+	assert.NoError(t, json.Unmarshal(ml.Inputs[0].Payload, &e))
+
+	mdb.race(t, 1, e.JobID)
+	assert.NoError(t, Worker(ctx, e))
+
+	j := workQueueJob(t, e.JobID)
+	assert.Equal(t, JobCancelled, j.Status)
+	assert.Nil(t, j.TimeStart)
+	assert.Len(t, ms3.Objects, 0)
+
+	// a running job with its cancellation requested before it ends is cancelled, not succeeded
+	r, err = WorkCreate(ctx, events.APIGatewayProxyRequest{Body: `[1, 2, 3]`})
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+
+	assert.NoError(t, json.Unmarshal(ml.Inputs[1].Payload, &e))
+
+	mdb.race(t, 2, e.JobID)
+	assert.NoError(t, Worker(ctx, e))
+
+	j = workQueueJob(t, e.JobID)
+	assert.Equal(t, JobCancelled, j.Status)
+	assert.True(t, j.CancelRequested)
+	assert.Empty(t, j.ReportURL)
+	assert.Len(t, ms3.Objects, 0)
+}
+
+func TestWorkCancelSubject(t *testing.T) {
+	Config.Auth.HashKey = Secret(base64.StdEncoding.EncodeToString([]byte("secret")))
+	Config.Jobs.TableName = "gofaas-JobsTable"
+	Config.Work.WorkerFunctionName = "gofaas-WorkerFunction"
+	defer func() { Config.Auth.HashKey = "" }()
+
+	UUIDGen = func() uuid.UUID {
+		return uuid.Must(uuid.FromString("26f0dc9f-4483-4b65-8724-3d1598ff6d14"))
+	}
+
+	DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+	Lambda = &MockLambda{}
+
+	ctx := context.Background()
+	request := func(subject string) events.APIGatewayProxyRequest {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{Subject: subject}).SignedString([]byte("secret"))
+		assert.NoError(t, err)
+		return events.APIGatewayProxyRequest{
+			Headers:        map[string]string{"Authorization": "Bearer " + token},
+			PathParameters: map[string]string{"id": "26f0dc9f-4483-4b65-8724-3d1598ff6d14"},
+		}
+	}
+
+	r, err := WorkCreate(ctx, request("user-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+
+	// another caller can't read, retry or cancel the job, or find out it exists
+	for _, h := range []func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error){WorkCancel, WorkRead, WorkRetry} {
+		r, err = h(ctx, request("user-2"))
+		assert.NoError(t, err)
+		assert.Equal(t, 404, r.StatusCode)
+		assert.Contains(t, r.Body, "not found")
+	}
+
+	r, err = WorkCancel(ctx, request("user-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+	assert.Contains(t, r.Body, `"status": "cancelled"`)
+}
+
+func TestWithJobCancel(t *testing.T) {
+	Config.Jobs.TableName = "gofaas-JobsTable"
+
+	jobCancelInterval = time.Millisecond
+	defer func() { jobCancelInterval = 10 * time.Second }()
+
+	md := &cancelPollDynamoDB{DynamoDBAPI: &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}}
+	DynamoDB = md
+
+	j := &Job{ID: "job-1", Status: JobRunning}
+	assert.NoError(t, jobPut(context.Background(), j))
+
+	ctx, cancel := WithJobCancel(context.Background(), "job-1")
+	defer cancel()
+
+	r, err := workCancel(context.Background(), "job-1")
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+
+	select {
+	case <-ctx.Done():
+		assert.Equal(t, context.Canceled, ctx.Err())
+		assert.True(t, JobCancelRequested(ctx))
+	case <-time.After(time.Second):
+		assert.Fail(t, "context not cancelled")
+	}
+
+	// the check reads only what it needs, not the job input
+	if in := md.input(); assert.NotNil(t, in) {
+		assert.Equal(t, "cancel_requested, #status", aws.StringValue(in.ProjectionExpression))
+	}
+
+	// a context cancelled for another reason is not a cancelled job
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel = WithJobCancel(parent, "job-2")
+	defer cancel()
+	cancelParent()
+
+	<-ctx.Done()
+	assert.False(t, JobCancelRequested(ctx))
+	assert.False(t, JobCancelRequested(context.Background()))
+}
+
+func TestJobCancelWait(t *testing.T) {
+	wait, ok := jobCancelWait(context.Background())
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Second, wait)
+
+	// a 5 second worker checks once, halfway
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	wait, ok = jobCancelWait(ctx)
+	assert.True(t, ok)
+	assert.InDelta(t, float64(2500*time.Millisecond), float64(wait), float64(100*time.Millisecond))
+
+	ctx, cancel = context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, ok = jobCancelWait(ctx)
+	assert.False(t, ok)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 15*time.Minute)
+	defer cancel()
+	wait, ok = jobCancelWait(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Second, wait)
+}
+
+func TestWorkCancelStale(t *testing.T) {
+	Config.DeadLetter.QueueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/gofaas-WorkDeadLetterQueue"
+	Config.Jobs.TableName = "gofaas-JobsTable"
+	Config.Worker.Bucket = "gofaas-bucket"
+
+	DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+	S3 = &MockS3{}
+	SQS = &MockSQS{}
+
+	ctx := context.Background()
+
+	// a worker that crashed never sees the request, so a request after the grace period cancels the job
+	assert.NoError(t, jobPut(ctx, &Job{ID: "job-1", Status: JobRunning}))
+
+	r, err := workCancel(ctx, "job-1")
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+	assert.Contains(t, r.Body, `"status": "running"`)
+
+	r, err = workCancel(ctx, "job-1")
+	assert.NoError(t, err)
+	assert.Contains(t, r.Body, `"status": "running"`)
+
+	stale := time.Now().Add(-jobCancelGrace - time.Minute)
+	assert.NoError(t, jobPut(ctx, &Job{ID: "job-1", CancelRequested: true, Status: JobRunning, TimeCancel: &stale}))
+
+	r, err = workCancel(ctx, "job-1")
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+	assert.Contains(t, r.Body, `"status": "cancelled"`)
+
+	// a dead-lettered job with a cancel request is cancelled instead of failed
+	assert.NoError(t, jobPut(ctx, &Job{ID: "job-2", CancelRequested: true, Status: JobRunning}))
+	err = deadLetter(ctx, &sqs.Message{
+		Attributes:    map[string]*string{"ApproximateReceiveCount": aws.String("3")},
+		Body:          aws.String(`{"job_id": "job-2"}`),
+		MessageId:     aws.String("message-1"),
+		ReceiptHandle: aws.String("receipt-message-1"),
+	})
+	assert.NoError(t, err)
+
+	j, err := jobGet(ctx, "job-2")
+	assert.NoError(t, err)
+	assert.Equal(t, JobCancelled, j.Status)
+	assert.Empty(t, j.Error)
+}
+
+func workCancel(ctx context.Context, id string) (events.APIGatewayProxyResponse, error) {
+	return WorkCancel(ctx, events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"id": id},
+	})
+}
+
+// cancelPollDynamoDB records the last GetItem input, like the cancel check of a worker
+type cancelPollDynamoDB struct {
+	DynamoDBAPI
+
+	last *dynamodb.GetItemInput
+	mu   sync.Mutex
+}
+
+func (d *cancelPollDynamoDB) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	d.mu.Lock()
+	d.last = input
+	d.mu.Unlock()
+	return d.DynamoDBAPI.GetItemWithContext(ctx, input, opts...)
+}
+
+func (d *cancelPollDynamoDB) input() *dynamodb.GetItemInput {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.last
+}
+
+// cancelRaceDynamoDB cancels a job right before the Nth job update, like a WorkCancel racing its worker
+type cancelRaceDynamoDB struct {
+	DynamoDBAPI
+
+	call   int
+	cancel func()
+}
+
+func (d *cancelRaceDynamoDB) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	d.call--
+	if d.call == 0 {
+		d.cancel()
+	}
+	return d.DynamoDBAPI.UpdateItemWithContext(ctx, input, opts...)
+}
+
+func (d *cancelRaceDynamoDB) race(t *testing.T, call int, id string) {
+	d.call = call
+	d.cancel = func() {
+		r, err := workCancel(context.Background(), id)
+		assert.NoError(t, err)
+		assert.Equal(t, 202, r.StatusCode)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
@@ -12,8 +13,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/apigateway"
+	"github.com/pkg/errors"
 )
 
 // CFEvent is a CloudFormation Custom Resource Event that Lambda is invoked with
@@ -30,132 +30,309 @@ type CFEvent struct {
 }
 
 // CFResponse is a CloudFormation Custom Resource Response that is PUT to S3
+// Data are the output attributes a template can !GetAtt, and NoEcho masks them in the console and API.
 type CFResponse struct {
-	Data struct {
-		Value string `json:"Value"`
-	}
-	LogicalResourceID  string `json:"LogicalResourceId"`
-	PhysicalResourceID string `json:"PhysicalResourceId"`
-	Reason             string `json:"Reason"`
-	RequestID          string `json:"RequestId"`
-	StackID            string `json:"StackId"`
-	Status             string `json:"Status"`
+	Data               map[string]interface{} `json:"Data,omitempty"`
+	LogicalResourceID  string                 `json:"LogicalResourceId"`
+	NoEcho             bool                   `json:"NoEcho,omitempty"`
+	PhysicalResourceID string                 `json:"PhysicalResourceId"`
+	Reason             string                 `json:"Reason"`
+	RequestID          string                 `json:"RequestId"`
+	StackID            string                 `json:"StackId"`
+	Status             string                 `json:"Status"`
 }
 
+// cfResponseMax is the most bytes CloudFormation takes in a response
+const cfResponseMax = 4096
+
+var (
+	// cfClient PUTs responses, with a timeout so a slow S3 doesn't use up the invocation
+	cfClient = &http.Client{Timeout: 10 * time.Second}
+
+	// cfBackoff is the wait before each retry of a failed PUT
+	cfBackoff = []time.Duration{500 * time.Millisecond, 1 * time.Second, 2 * time.Second, 4 * time.Second}
+
+	// cfDeadlineMargin is the time left before the deadline at which a resource still running is given up on
+	cfDeadlineMargin = 5 * time.Second
+)
+
 // CFRespond creates, updates or deletes a CloudFormation custom resource
 // then PUTs the status to the given ResponseURL
+// A resource that panics, or that is still running shortly before the deadline, is reported FAILED,
+// since without a response the stack would hang for an hour. A PUT that fails is notified, not returned.
 func CFRespond(ctx context.Context, e CFEvent) error {
 	fmt.Printf("EVENT: %+v\n", e)
 
-	r := CFResponse{
-		LogicalResourceID: e.LogicalResourceID,
-		RequestID:         e.RequestID,
-		StackID:           e.StackID,
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan CFResponse, 1)
+	go func() {
+		done <- cfRun(rctx, e)
+	}()
+
+	var timeout <-chan time.Time
+	if deadline, ok := ctx.Deadline(); ok {
+		margin := cfDeadlineMargin
+		if left := time.Until(deadline); left < 2*margin {
+			margin = left / 2
+		}
+		timeout = time.After(time.Until(deadline) - margin)
 	}
 
-	id, err := CFResource(ctx, e)
+	var r CFResponse
+	select {
+	case r = <-done:
+	case <-timeout:
+		cancel()
+		err := errors.Errorf("%s %s timed out", e.RequestType, e.ResourceType)
+		notify(ctx, err)
+		r = cfFailed(e, err)
+	}
+
+	body, err := json.Marshal(r)
+	if err == nil && len(body) > cfResponseMax {
+		err = fmt.Errorf("response with Data is %d bytes, over the limit of %d", len(body), cfResponseMax)
+	}
 	if err != nil {
-		r.Reason = err.Error()
-		r.Status = "FAILED"
+		r = cfFailed(e, err)
+		if body, err = json.Marshal(r); err != nil {
+			notify(ctx, errors.WithStack(err))
+			return nil
+		}
+	}
+
+	if r.NoEcho {
+		log.Printf("CF RESPONSE: %s %s with NoEcho Data\n", r.Status, r.PhysicalResourceID)
 	} else {
-		r.PhysicalResourceID = id
-		r.Status = "SUCCESS"
+		log.Printf("CF RESPONSE:\n%s", body)
 	}
 
-	body, err := json.Marshal(r)
+	// the error isn't returned, since a Lambda retry of the async invoke would run the resource func again
+	if err := cfPut(ctx, e.ResponseURL, body); err != nil {
+		notify(ctx, errors.Wrapf(err, "%s %s %s response", e.RequestType, e.ResourceType, e.LogicalResourceID))
+	}
+	return nil
+}
+
+// cfRun runs the resource func for an event and returns the response
+// A panic is recovered, notified and reported as FAILED with the reason.
+func cfRun(ctx context.Context, e CFEvent) (r CFResponse) {
+	defer func() {
+		if v := recover(); v != nil {
+			err := newPanicError(v)
+			notify(ctx, err)
+			r = cfFailed(e, err)
+		}
+	}()
+
+	id, out, err := CFResource(ctx, e)
 	if err != nil {
-		return err
+		r := cfFailed(e, err)
+		if id != "" {
+			// a resource that failed part way is deleted by its id on rollback
+			r.PhysicalResourceID = id
+		}
+		return r
+	}
+
+	return CFResponse{
+		Data:               out.Data,
+		LogicalResourceID:  e.LogicalResourceID,
+		NoEcho:             out.NoEcho,
+		PhysicalResourceID: id,
+		RequestID:          e.RequestID,
+		StackID:            e.StackID,
+		Status:             "SUCCESS",
+	}
+}
+
+// cfFailed returns a FAILED response with the error as the reason
+// CloudFormation rejects a response without a PhysicalResourceId, so a failed create uses the LogicalResourceId.
+func cfFailed(e CFEvent, err error) CFResponse {
+	id := e.PhysicalResourceID
+	if id == "" {
+		id = e.LogicalResourceID
+	}
+
+	return CFResponse{
+		LogicalResourceID:  e.LogicalResourceID,
+		PhysicalResourceID: id,
+		Reason:             err.Error(),
+		RequestID:          e.RequestID,
+		StackID:            e.StackID,
+		Status:             "FAILED",
+	}
+}
+
+// cfPut PUTs a response to the pre-signed S3 URL, retrying with backoff
+// A network error or a 5xx or 429 status is retried, and any other status that isn't 2xx is an error.
+func cfPut(ctx context.Context, url string, body []byte) error {
+	var err error
+	for i := 0; i <= len(cfBackoff); i++ {
+		if i > 0 {
+			log.Printf("CF PUT attempt %d error %s\n", i, err)
+			select {
+			case <-time.After(cfBackoff[i-1]):
+			case <-ctx.Done():
+				return errors.Wrap(err, "CF PUT gave up at the deadline")
+			}
+		}
+
+		var retry bool
+		retry, err = cfPutOnce(ctx, url, body)
+		if err == nil || !retry {
+			return err
+		}
 	}
-	log.Printf("CF RESPONSE:\n%s", body)
+	return errors.Wrapf(err, "CF PUT failed %d times", len(cfBackoff)+1)
+}
 
-	req, err := http.NewRequest(http.MethodPut, e.ResponseURL, bytes.NewBuffer(body))
+// cfPutOnce PUTs a response and returns if an error is worth retrying
+// The URL is left out of errors since it is pre-signed.
+func cfPutOnce(ctx context.Context, url string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
 	if err != nil {
-		return err
+		return false, errors.New("invalid ResponseURL")
 	}
+	// the URL is signed without a content type
 	req.Header.Del("Content-Type")
 
-	cln := &http.Client{}
-	res, err := cln.Do(req)
+	res, err := cfClient.Do(req.WithContext(ctx))
 	if err != nil {
-		return err
+		return true, errors.Errorf("CF PUT error: %s", strings.Replace(err.Error(), url, "<ResponseURL>", -1))
 	}
+	defer res.Body.Close()
 
-	body, err = ioutil.ReadAll(res.Body)
-	if err != nil {
-		return err
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	log.Printf("CF STATUS: %d %s\n %s", res.StatusCode, res.Status, b)
+
+	if res.StatusCode/100 != 2 {
+		retry := res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+		return retry, errors.Errorf("CF PUT returned %s: %s", res.Status, strings.TrimSpace(string(b)))
 	}
-	res.Body.Close()
+	return false, nil
+}
 
-	log.Printf("CF STATUS: %d %s\n %s", res.StatusCode, res.Status, body)
-	return nil
+// CFResourceProperties are the typed ResourceProperties of a kind of custom resource
+// The properties are decoded from the event with encoding/json. CloudFormation sends every
+// scalar as a string, so numbers and bools need the ",string" option in their json tags.
+type CFResourceProperties interface {
+	// Validate returns an error if a property is missing or invalid
+	Validate() error
+
+	// Create creates the resource and returns its new PhysicalResourceID
+	Create(ctx context.Context, e CFEvent) (string, error)
+
+	// Update updates the resource from the old properties and returns its PhysicalResourceID
+	// Returning a new ID replaces the resource, and CloudFormation then deletes the old one.
+	Update(ctx context.Context, e CFEvent, old CFResourceProperties) (string, error)
+
+	// Delete deletes the resource
+	Delete(ctx context.Context, e CFEvent) error
 }
 
-// CFResource dispatches a CloudFormation Custom Resource event to a create, update or delete function
-func CFResource(ctx context.Context, e CFEvent) (string, error) {
-	var props map[string]string
-	if err := json.Unmarshal(e.ResourceProperties, &props); err != nil {
-		return "", err
-	}
+// CFResourceOutputs is implemented by properties with output attributes, to return after a create or update
+type CFResourceOutputs interface {
+	Outputs(ctx context.Context, e CFEvent, id string) (CFOutputs, error)
+}
 
-	if props["RestApiId"] == "" {
-		return "", fmt.Errorf("RestApiId is required")
-	}
+// CFOutputs are the output attributes of a custom resource a template can !GetAtt
+// NoEcho is for sensitive values, and is also set by a NoEcho property on any resource.
+type CFOutputs struct {
+	Data   map[string]interface{}
+	NoEcho bool
+}
 
-	if props["Stage"] == "" {
-		return "", fmt.Errorf("Stage is required")
+// CFResources is the registry of custom resource types CFResource handles, keyed by ResourceType
+// Each func returns a pointer to new empty properties to decode the event into.
+var CFResources = map[string]func() CFResourceProperties{
+	"Custom::ApiGatewayStage": func() CFResourceProperties { return &APIGatewayStage{} },
+	"Custom::SeedData":        func() CFResourceProperties { return &SeedData{} },
+}
+
+// CFResource dispatches a CloudFormation Custom Resource event to the create, update or delete func of its type
+// It returns the PhysicalResourceID, and the outputs of resources that have them.
+// A Delete of a resource with an unknown type or invalid properties succeeds, since it was never created,
+// so a failed create can roll back.
+func CFResource(ctx context.Context, e CFEvent) (string, CFOutputs, error) {
+	out := CFOutputs{}
+
+	props, err := cfProperties(e.ResourceType, e.ResourceProperties)
+	if err != nil {
+		if e.RequestType == "Delete" {
+			log.Printf("CF %s %s delete skipped: %s\n", e.ResourceType, e.PhysicalResourceID, err)
+			return e.PhysicalResourceID, out, nil
+		}
+		return "", out, err
 	}
 
-	if props["TracingEnabled"] == "" {
-		return "", fmt.Errorf("TracingEnabled is required")
+	common := struct {
+		NoEcho bool `json:"NoEcho,string"`
+	}{}
+	if err := json.Unmarshal(e.ResourceProperties, &common); err != nil && e.RequestType != "Delete" {
+		return "", out, fmt.Errorf("invalid NoEcho property: %s", err)
 	}
+	noEcho := common.NoEcho
 
+	var id string
 	switch e.RequestType {
 	case "Create":
-		return CFResourceCreate(ctx, e, props)
+		id, err = props.Create(ctx, e)
 	case "Update":
-		return CFResourceUpdate(ctx, e, props)
+		old, errOld := cfProperties(e.ResourceType, e.OldResourceProperties)
+		if errOld != nil {
+			return "", out, errors.Wrap(errOld, "OldResourceProperties")
+		}
+		id, err = props.Update(ctx, e, old)
 	case "Delete":
-		return CFResourceDelete(ctx, e, props)
+		return e.PhysicalResourceID, out, props.Delete(ctx, e)
+	default:
+		return "", out, fmt.Errorf("Unknown RequestType %s", e.RequestType)
+	}
+	if err != nil {
+		return id, out, err
 	}
 
-	return "", fmt.Errorf("Unknown RequestType %s", e.RequestType)
-}
+	if o, ok := props.(CFResourceOutputs); ok {
+		out, err = o.Outputs(ctx, e, id)
+		if err != nil {
+			return id, out, err
+		}
+	}
 
-// CFResourceCreate creates a custom resource and returns a new PhysicalResourceID
-// This delegates to ResourceUpdate since there are no resources to create
-func CFResourceCreate(ctx context.Context, e CFEvent, props map[string]string) (string, error) {
-	e.PhysicalResourceID = resourceID(e)
-	return CFResourceUpdate(ctx, e, props)
+	out.NoEcho = out.NoEcho || noEcho
+	return id, out, nil
 }
 
-// CFResourceUpdate updates a custom resource and returns its existing PhysicalResourceID
-// This toggles settings on the Stage specified by Stage and RestApiId parameters
-func CFResourceUpdate(ctx context.Context, e CFEvent, props map[string]string) (string, error) {
-	_, err := APIGateway.UpdateStageWithContext(ctx, &apigateway.UpdateStageInput{
-		PatchOperations: []*apigateway.PatchOperation{
-			&apigateway.PatchOperation{
-				Op:    aws.String("replace"),
-				Path:  aws.String("/tracingEnabled"),
-				Value: aws.String(props["TracingEnabled"]),
-			},
-		},
-		RestApiId: aws.String(props["RestApiId"]),
-		StageName: aws.String(props["Stage"]),
-	})
-	return e.PhysicalResourceID, err
-}
+// cfProperties decodes and validates the properties of a custom resource type
+func cfProperties(typ string, raw json.RawMessage) (CFResourceProperties, error) {
+	newProps, ok := CFResources[typ]
+	if !ok {
+		return nil, fmt.Errorf("Unknown ResourceType %s", typ)
+	}
 
-// CFResourceDelete deletes a custom resource and returns its old PhysicalResourceID
-// This delegates to ResourceUpdate since there are no resources to delete
-func CFResourceDelete(ctx context.Context, e CFEvent, props map[string]string) (string, error) {
-	props["TracingEnabled"] = "false"
-	return CFResourceUpdate(ctx, e, props)
+	props := newProps()
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, props); err != nil {
+			return nil, fmt.Errorf("invalid %s properties: %s", typ, err)
+		}
+	}
+
+	if err := props.Validate(); err != nil {
+		return nil, err
+	}
+	return props, nil
 }
 
 // resourceID generates id of the form "StackName-LogicalResourceID-RandomID".
+// The StackName is from a StackId ARN like "arn:aws:cloudformation:...:stack/StackName/GUID", or is the StackId itself.
 func resourceID(e CFEvent) string {
 	rns := "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	snm := strings.Split(e.StackID, "/")[1]
+	snm := e.StackID
+	if parts := strings.Split(e.StackID, "/"); len(parts) > 1 {
+		snm = parts[1]
+	}
 	lid := e.LogicalResourceID
 	gen := rand.New(rand.NewSource(time.Now().UnixNano()))
 	rnd := make([]byte, 12)
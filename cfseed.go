@@ -0,0 +1,124 @@
+package gofaas
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/pkg/errors"
+)
+
+// SeedData is a Custom::SeedData that puts items in a DynamoDB table, like default users
+// The stack owns the items, so an update overwrites them and a delete deletes them.
+type SeedData struct {
+	Items     []map[string]interface{} `json:"Items"`
+	Key       string                   `json:"Key"`
+	TableName string                   `json:"TableName"`
+}
+
+// Validate requires the table and a unique string key on every item
+func (s *SeedData) Validate() error {
+	if s.TableName == "" {
+		return fmt.Errorf("TableName is required")
+	}
+	if s.Key == "" {
+		s.Key = "id"
+	}
+
+	seen := map[string]bool{}
+	for i, item := range s.Items {
+		k, ok := item[s.Key].(string)
+		if !ok || k == "" {
+			return fmt.Errorf("Items[%d] %s is required", i, s.Key)
+		}
+		if seen[k] {
+			return fmt.Errorf("Items[%d] %s %q is a duplicate", i, s.Key, k)
+		}
+		seen[k] = true
+	}
+	return nil
+}
+
+// Create puts the items
+func (s *SeedData) Create(ctx context.Context, e CFEvent) (string, error) {
+	return resourceID(e), s.put(ctx)
+}
+
+// Update puts the items and deletes the ones that were removed
+// A new table or key replaces the resource, so CloudFormation deletes the old items.
+func (s *SeedData) Update(ctx context.Context, e CFEvent, old CFResourceProperties) (string, error) {
+	o := old.(*SeedData)
+	if o.TableName != s.TableName || o.Key != s.Key {
+		return resourceID(e), s.put(ctx)
+	}
+
+	if err := s.put(ctx); err != nil {
+		return e.PhysicalResourceID, err
+	}
+
+	keys := map[string]bool{}
+	for _, item := range s.Items {
+		keys[item[s.Key].(string)] = true
+	}
+	for _, item := range o.Items {
+		if k := item[s.Key].(string); !keys[k] {
+			if err := s.delete(ctx, k); err != nil {
+				return e.PhysicalResourceID, err
+			}
+		}
+	}
+	return e.PhysicalResourceID, nil
+}
+
+// Delete deletes the items
+func (s *SeedData) Delete(ctx context.Context, e CFEvent) error {
+	for _, item := range s.Items {
+		if err := s.delete(ctx, item[s.Key].(string)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Outputs returns the table and the number of items
+func (s *SeedData) Outputs(ctx context.Context, e CFEvent, id string) (CFOutputs, error) {
+	return CFOutputs{
+		Data: map[string]interface{}{
+			"Count":     strconv.Itoa(len(s.Items)),
+			"TableName": s.TableName,
+		},
+	}, nil
+}
+
+func (s *SeedData) put(ctx context.Context) error {
+	for _, item := range s.Items {
+		av, err := dynamodbattribute.MarshalMap(item)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		_, err = DynamoDB.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			Item:      av,
+			TableName: aws.String(s.TableName),
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (s *SeedData) delete(ctx context.Context, k string) error {
+	_, err := DynamoDB.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			s.Key: &dynamodb.AttributeValue{
+				S: aws.String(k),
+			},
+		},
+		TableName: aws.String(s.TableName),
+	})
+	return errors.WithStack(err)
+}
@@ -0,0 +1,502 @@
+package gofaas
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/apigateway"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/pkg/errors"
+)
+
+// APIGatewayStage is a Custom::ApiGatewayStage that manages the stage settings SAM doesn't support
+// Only the settings in the properties are managed. Create saves what they were before, an update
+// patches the difference between the old and new properties, and delete restores them.
+type APIGatewayStage struct {
+	AccessLogSetting    *APIGatewayStageAccessLog `json:"AccessLogSetting"`
+	CacheClusterEnabled *bool                     `json:"CacheClusterEnabled,string"`
+	CacheClusterSize    string                    `json:"CacheClusterSize"`
+	CanarySetting       *APIGatewayStageCanary    `json:"CanarySetting"`
+	MethodSettings      []APIGatewayStageMethod   `json:"MethodSettings"`
+	RestAPIID           string                    `json:"RestApiId"`
+	Stage               string                    `json:"Stage"`
+	TracingEnabled      *bool                     `json:"TracingEnabled,string"`
+}
+
+// APIGatewayStageAccessLog is where and in what format a stage logs requests
+type APIGatewayStageAccessLog struct {
+	DestinationArn string `json:"DestinationArn"`
+	Format         string `json:"Format"`
+}
+
+// APIGatewayStageCanary sends a percent of the traffic of a stage to a canary deployment
+type APIGatewayStageCanary struct {
+	DeploymentID           string            `json:"DeploymentId"`
+	PercentTraffic         *float64          `json:"PercentTraffic,string"`
+	StageVariableOverrides map[string]string `json:"StageVariableOverrides"`
+	UseStageCache          *bool             `json:"UseStageCache,string"`
+}
+
+// APIGatewayStageMethod is the caching and throttling of a method
+// ResourcePath "/*" and HttpMethod "*" set them for every method of the stage.
+type APIGatewayStageMethod struct {
+	CacheDataEncrypted   *bool    `json:"CacheDataEncrypted,string"`
+	CacheTTLInSeconds    *int64   `json:"CacheTtlInSeconds,string"`
+	CachingEnabled       *bool    `json:"CachingEnabled,string"`
+	HTTPMethod           string   `json:"HttpMethod"`
+	ResourcePath         string   `json:"ResourcePath"`
+	ThrottlingBurstLimit *int64   `json:"ThrottlingBurstLimit,string"`
+	ThrottlingRateLimit  *float64 `json:"ThrottlingRateLimit,string"`
+}
+
+// stageSnapshot is the settings of a stage from before a Custom::ApiGatewayStage changed them, by patch path
+// Paths has every path that was saved, so a saved path missing from Settings wasn't set at all.
+type stageSnapshot struct {
+	ID       string            `json:"id"`
+	Paths    []string          `json:"paths"`
+	Settings map[string]string `json:"settings"`
+}
+
+// stageDefaults are the values API Gateway uses for settings that aren't set
+var stageDefaults = map[string]string{
+	"/cacheClusterEnabled":          "false",
+	"/canarySettings/useStageCache": "false",
+	"/tracingEnabled":               "false",
+	"caching/dataEncrypted":         "false",
+	"caching/enabled":               "false",
+	"caching/ttlInSeconds":          "300",
+}
+
+var stageCacheSizes = []string{"0.5", "1.6", "6.1", "13.5", "28.4", "58.2", "118", "237"}
+
+// Validate requires the API and stage, and checks the settings
+func (s *APIGatewayStage) Validate() error {
+	if s.RestAPIID == "" {
+		return fmt.Errorf("RestApiId is required")
+	}
+	if s.Stage == "" {
+		return fmt.Errorf("Stage is required")
+	}
+
+	if s.AccessLogSetting != nil && s.AccessLogSetting.DestinationArn == "" {
+		return fmt.Errorf("AccessLogSetting.DestinationArn is required")
+	}
+
+	if s.CacheClusterSize != "" && !stageHas(stageCacheSizes, s.CacheClusterSize) {
+		return fmt.Errorf("CacheClusterSize %q is not one of %s", s.CacheClusterSize, strings.Join(stageCacheSizes, ", "))
+	}
+
+	if c := s.CanarySetting; c != nil && c.PercentTraffic != nil && (*c.PercentTraffic < 0 || *c.PercentTraffic > 100) {
+		return fmt.Errorf("CanarySetting.PercentTraffic %v is not between 0 and 100", *c.PercentTraffic)
+	}
+
+	seen := map[string]bool{}
+	for i, m := range s.MethodSettings {
+		if !strings.HasPrefix(m.ResourcePath, "/") {
+			return fmt.Errorf("MethodSettings[%d].ResourcePath %q does not start with /", i, m.ResourcePath)
+		}
+		if m.HTTPMethod == "" {
+			return fmt.Errorf("MethodSettings[%d].HttpMethod is required", i)
+		}
+
+		k := stageMethodKey(m.ResourcePath, m.HTTPMethod)
+		if seen[k] {
+			return fmt.Errorf("MethodSettings[%d] %s %s is a duplicate", i, m.HTTPMethod, m.ResourcePath)
+		}
+		seen[k] = true
+	}
+
+	return nil
+}
+
+// Create saves the settings of the stage then applies the properties
+func (s *APIGatewayStage) Create(ctx context.Context, e CFEvent) (string, error) {
+	id := resourceID(e)
+
+	snap := stageSnapshot{ID: id, Settings: map[string]string{}}
+	settings := s.settings()
+	if err := s.snapshot(ctx, &snap, settings); err != nil {
+		return "", err
+	}
+
+	return id, s.patch(ctx, stagePatch(snap.Settings, settings, snap))
+}
+
+// Update patches the settings that changed and restores the ones that were removed
+// A different API or stage replaces the resource, so CloudFormation then restores the old stage with a delete.
+func (s *APIGatewayStage) Update(ctx context.Context, e CFEvent, old CFResourceProperties) (string, error) {
+	o := old.(*APIGatewayStage)
+	if o.RestAPIID != s.RestAPIID || o.Stage != s.Stage {
+		return s.Create(ctx, e)
+	}
+
+	snap, found, err := stageSnapshotGet(ctx, e.PhysicalResourceID)
+	if err != nil {
+		return e.PhysicalResourceID, err
+	}
+	if !found {
+		// the resource was created without a snapshot, so the old settings weren't set before
+		snap.Paths = stageSorted(o.settings())
+	}
+
+	settings := s.settings()
+	if err := s.snapshot(ctx, &snap, settings); err != nil {
+		return e.PhysicalResourceID, err
+	}
+
+	return e.PhysicalResourceID, s.patch(ctx, stagePatch(o.settings(), settings, snap))
+}
+
+// Delete restores the settings from before the resource was created
+// A resource without a snapshot restores the API Gateway defaults.
+func (s *APIGatewayStage) Delete(ctx context.Context, e CFEvent) error {
+	snap, _, err := stageSnapshotGet(ctx, e.PhysicalResourceID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.patch(ctx, stagePatch(s.settings(), map[string]string{}, snap)); err != nil {
+		return err
+	}
+
+	return stageSnapshotDelete(ctx, e.PhysicalResourceID)
+}
+
+// settings returns the properties as patch paths and values
+func (s *APIGatewayStage) settings() map[string]string {
+	m := map[string]string{}
+
+	if a := s.AccessLogSetting; a != nil {
+		m["/accessLogSettings/destinationArn"] = a.DestinationArn
+		if a.Format != "" {
+			m["/accessLogSettings/format"] = a.Format
+		}
+	}
+
+	stageBool(m, "/cacheClusterEnabled", s.CacheClusterEnabled)
+	if s.CacheClusterSize != "" {
+		m["/cacheClusterSize"] = s.CacheClusterSize
+	}
+
+	if c := s.CanarySetting; c != nil {
+		if c.DeploymentID != "" {
+			m["/canarySettings/deploymentId"] = c.DeploymentID
+		}
+		stageFloat(m, "/canarySettings/percentTraffic", c.PercentTraffic)
+		for k, v := range c.StageVariableOverrides {
+			m["/canarySettings/stageVariableOverrides/"+k] = v
+		}
+		stageBool(m, "/canarySettings/useStageCache", c.UseStageCache)
+	}
+
+	for _, ms := range s.MethodSettings {
+		p := "/" + stageMethodKey(ms.ResourcePath, ms.HTTPMethod)
+		stageBool(m, p+"/caching/dataEncrypted", ms.CacheDataEncrypted)
+		stageBool(m, p+"/caching/enabled", ms.CachingEnabled)
+		stageInt(m, p+"/caching/ttlInSeconds", ms.CacheTTLInSeconds)
+		stageInt(m, p+"/throttling/burstLimit", ms.ThrottlingBurstLimit)
+		stageFloat(m, p+"/throttling/rateLimit", ms.ThrottlingRateLimit)
+	}
+
+	stageBool(m, "/tracingEnabled", s.TracingEnabled)
+	return m
+}
+
+// snapshot saves the current stage settings of paths that aren't in the snapshot yet
+func (s *APIGatewayStage) snapshot(ctx context.Context, snap *stageSnapshot, settings map[string]string) error {
+	missing := []string{}
+	for _, p := range stageSorted(settings) {
+		if !stageHas(snap.Paths, p) {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	st, err := APIGateway.GetStageWithContext(ctx, &apigateway.GetStageInput{
+		RestApiId: aws.String(s.RestAPIID),
+		StageName: aws.String(s.Stage),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	current := stageSettings(st)
+	for _, p := range missing {
+		snap.Paths = append(snap.Paths, p)
+		if v, ok := current[p]; ok {
+			snap.Settings[p] = v
+		}
+	}
+
+	return stageSnapshotPut(ctx, *snap)
+}
+
+func (s *APIGatewayStage) patch(ctx context.Context, ops []*apigateway.PatchOperation) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	_, err := APIGateway.UpdateStageWithContext(ctx, &apigateway.UpdateStageInput{
+		PatchOperations: ops,
+		RestApiId:       aws.String(s.RestAPIID),
+		StageName:       aws.String(s.Stage),
+	})
+	return errors.WithStack(err)
+}
+
+// stagePatch returns the operations that change the settings from old to new
+// A setting new leaves out is restored from the snapshot, or removed if it wasn't set before.
+func stagePatch(old, new map[string]string, snap stageSnapshot) []*apigateway.PatchOperation {
+	ops := []*apigateway.PatchOperation{}
+	removed := map[string]bool{}
+
+	for _, p := range stageSorted(old) {
+		if _, ok := new[p]; ok {
+			continue
+		}
+		if op := stageRestore(p, new, snap, removed); op != nil {
+			ops = append(ops, op)
+		}
+	}
+
+	for _, p := range stageSorted(new) {
+		if v, ok := old[p]; ok && v == new[p] {
+			continue
+		}
+		ops = append(ops, stageOp("replace", p, new[p]))
+	}
+
+	return ops
+}
+
+// stageRestore returns the operation that restores a setting from the snapshot
+// A setting that wasn't set before is removed with its group, like all of /accessLogSettings, unless
+// other settings of the group are still managed or were set before. Then it is reset to the default if there is one.
+func stageRestore(p string, new map[string]string, snap stageSnapshot, removed map[string]bool) *apigateway.PatchOperation {
+	if v, ok := snap.Settings[p]; ok {
+		return stageOp("replace", p, v)
+	}
+
+	g := stageGroup(p)
+	if g != "" && !stagePrefixed(new, g) && !stagePrefixed(snap.Settings, g) {
+		if removed[g] {
+			return nil
+		}
+		removed[g] = true
+		return stageOp("remove", g, "")
+	}
+
+	d, ok := stageDefaults[p]
+	if parts := strings.Split(p, "/"); !ok && len(parts) > 3 {
+		d, ok = stageDefaults[strings.Join(parts[3:], "/")]
+	}
+	if !ok {
+		log.Printf("CF stage setting %s can not be restored\n", p)
+		return nil
+	}
+	return stageOp("replace", p, d)
+}
+
+// stageSettings returns the settings of a stage as patch paths and values
+func stageSettings(st *apigateway.Stage) map[string]string {
+	m := map[string]string{}
+
+	if a := st.AccessLogSettings; a != nil {
+		stageString(m, "/accessLogSettings/destinationArn", a.DestinationArn)
+		stageString(m, "/accessLogSettings/format", a.Format)
+	}
+
+	stageBool(m, "/cacheClusterEnabled", st.CacheClusterEnabled)
+	stageString(m, "/cacheClusterSize", st.CacheClusterSize)
+
+	if c := st.CanarySettings; c != nil {
+		stageString(m, "/canarySettings/deploymentId", c.DeploymentId)
+		stageFloat(m, "/canarySettings/percentTraffic", c.PercentTraffic)
+		for k, v := range c.StageVariableOverrides {
+			stageString(m, "/canarySettings/stageVariableOverrides/"+k, v)
+		}
+		stageBool(m, "/canarySettings/useStageCache", c.UseStageCache)
+	}
+
+	for k, ms := range st.MethodSettings {
+		p := "/" + k
+		stageBool(m, p+"/caching/dataEncrypted", ms.CacheDataEncrypted)
+		stageBool(m, p+"/caching/enabled", ms.CachingEnabled)
+		stageInt(m, p+"/caching/ttlInSeconds", ms.CacheTtlInSeconds)
+		stageInt(m, p+"/throttling/burstLimit", ms.ThrottlingBurstLimit)
+		stageFloat(m, p+"/throttling/rateLimit", ms.ThrottlingRateLimit)
+	}
+
+	stageBool(m, "/tracingEnabled", st.TracingEnabled)
+	return m
+}
+
+// stageMethodKey returns the key of method settings, like "~1users~1{id}/GET", or "*/*" for every method
+func stageMethodKey(path, method string) string {
+	if path == "/*" {
+		return "*/" + method
+	}
+	return strings.Replace(path, "/", "~1", -1) + "/" + method
+}
+
+// stageGroup returns the path a setting is removed with, or "" if it can't be removed
+func stageGroup(p string) string {
+	parts := strings.Split(p, "/")
+	switch {
+	case len(parts) < 3:
+		return ""
+	case parts[1] == "accessLogSettings" || parts[1] == "canarySettings":
+		return "/" + parts[1]
+	case len(parts) >= 4:
+		return "/" + parts[1] + "/" + parts[2]
+	}
+	return ""
+}
+
+func stageOp(op, path, value string) *apigateway.PatchOperation {
+	o := &apigateway.PatchOperation{
+		Op:   aws.String(op),
+		Path: aws.String(path),
+	}
+	if op != "remove" {
+		o.Value = aws.String(value)
+	}
+	return o
+}
+
+func stagePrefixed(m map[string]string, prefix string) bool {
+	for p := range m {
+		if strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func stageSorted(m map[string]string) []string {
+	ps := []string{}
+	for p := range m {
+		ps = append(ps, p)
+	}
+	sort.Strings(ps)
+	return ps
+}
+
+func stageBool(m map[string]string, p string, v *bool) {
+	if v != nil {
+		m[p] = strconv.FormatBool(*v)
+	}
+}
+
+func stageFloat(m map[string]string, p string, v *float64) {
+	if v != nil {
+		m[p] = strconv.FormatFloat(*v, 'f', -1, 64)
+	}
+}
+
+func stageInt(m map[string]string, p string, v *int64) {
+	if v != nil {
+		m[p] = strconv.FormatInt(*v, 10)
+	}
+}
+
+func stageString(m map[string]string, p string, v *string) {
+	if v != nil && *v != "" {
+		m[p] = *v
+	}
+}
+
+// stageSnapshotGet returns the snapshot of a resource and if it was found, or an empty one
+func stageSnapshotGet(ctx context.Context, id string) (stageSnapshot, bool, error) {
+	snap := stageSnapshot{ID: id, Settings: map[string]string{}}
+	if Config.Resource.TableName == "" {
+		return snap, false, nil
+	}
+
+	out, err := DynamoDB.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: aws.String(id),
+			},
+		},
+		TableName: aws.String(Config.Resource.TableName),
+	})
+	if err != nil {
+		return snap, false, errors.WithStack(err)
+	}
+	if len(out.Item) == 0 {
+		return snap, false, nil
+	}
+
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &snap); err != nil {
+		return snap, false, errors.WithStack(err)
+	}
+	if snap.Settings == nil {
+		snap.Settings = map[string]string{}
+	}
+	return snap, true, nil
+}
+
+// stageSnapshotPut saves a snapshot, if there is a table
+func stageSnapshotPut(ctx context.Context, snap stageSnapshot) error {
+	if Config.Resource.TableName == "" {
+		log.Printf("CF stage %s snapshot not saved without a table\n", snap.ID)
+		return nil
+	}
+
+	item, err := dynamodbattribute.MarshalMap(snap)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = DynamoDB.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(Config.Resource.TableName),
+	})
+	return errors.WithStack(err)
+}
+
+func stageSnapshotDelete(ctx context.Context, id string) error {
+	if Config.Resource.TableName == "" {
+		return nil
+	}
+
+	_, err := DynamoDB.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: aws.String(id),
+			},
+		},
+		TableName: aws.String(Config.Resource.TableName),
+	})
+	return errors.WithStack(err)
+}
+
+func stageHas(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Outputs returns the stage name and its invoke URL
+func (s *APIGatewayStage) Outputs(ctx context.Context, e CFEvent, id string) (CFOutputs, error) {
+	return CFOutputs{
+		Data: map[string]interface{}{
+			"InvokeURL": fmt.Sprintf("https://%s.execute-api.%s.amazonaws.com/%s", s.RestAPIID, os.Getenv("AWS_REGION"), s.Stage),
+			"StageName": s.Stage,
+		},
+	}, nil
+}
@@ -0,0 +1,284 @@
+package gofaas
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// CleanupDetailType is the detail type of the event a cleanup re-invokes itself with to continue from a checkpoint
+const CleanupDetailType = "Cleanup Checkpoint"
+
+// CleanupCheckpoint is the state of a cleanup run that continues across invocations
+type CleanupCheckpoint struct {
+	Kept    map[string][]CleanupObject `json:"kept,omitempty"`
+	Marker  string                     `json:"marker,omitempty"`
+	Pass    int                        `json:"pass"`
+	Summary CleanupSummary             `json:"summary"`
+	Time    time.Time                  `json:"time"`
+}
+
+// CleanupObject is an object kept as one of the newest under its prefix
+type CleanupObject struct {
+	Key          string    `json:"key"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// CleanupSummary counts the objects a cleanup run scanned and deleted
+type CleanupSummary struct {
+	BytesFreed  int64 `json:"bytes_freed"`
+	Deleted     int   `json:"deleted"`
+	DryRun      bool  `json:"dry_run"`
+	Invocations int   `json:"invocations"`
+	Scanned     int   `json:"scanned"`
+}
+
+// cleanupCheckpoint returns the checkpoint of a continued cleanup, or a new one for a scheduled event
+func cleanupCheckpoint(e events.CloudWatchEvent) (*CleanupCheckpoint, error) {
+	cp := &CleanupCheckpoint{}
+
+	if e.DetailType == CleanupDetailType {
+		if err := json.Unmarshal(e.Detail, cp); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return cp, nil
+	}
+
+	cp.Pass = 2
+	if Config.Retention.KeepNewest > 0 {
+		cp.Pass = 1
+	}
+	cp.Summary.DryRun = Config.Retention.DryRun
+	cp.Time = e.Time
+	if cp.Time.IsZero() {
+		cp.Time = time.Now()
+	}
+
+	return cp, nil
+}
+
+// cleanup runs the passes over the bucket from the checkpoint, continuing in a new invocation if it runs low on time
+// With KeepNewest set a first pass finds the newest objects under each prefix, and a second pass deletes
+func cleanup(ctx context.Context, cp *CleanupCheckpoint) error {
+	ctx = withDeadlineBudget(ctx)
+	cp.Summary.Invocations++
+
+	for {
+		done, err := cleanupPass(ctx, cp)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !done {
+			return cleanupContinue(ctx, cp)
+		}
+		if cp.Pass == 2 {
+			break
+		}
+
+		cp.Marker = ""
+		cp.Pass = 2
+		if DeadlineNear(ctx) {
+			return cleanupContinue(ctx, cp)
+		}
+	}
+
+	b, err := json.Marshal(cp.Summary)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	log.Printf("WorkerPeriodic cleanup summary %s\n", b)
+
+	return nil
+}
+
+// cleanupPass lists the bucket from the checkpoint marker, returning false if it stopped early as time ran low
+func cleanupPass(ctx context.Context, cp *CleanupCheckpoint) (bool, error) {
+	input := &s3.ListObjectsInput{
+		Bucket: aws.String(Config.Worker.Bucket),
+	}
+	if cp.Marker != "" {
+		input.Marker = aws.String(cp.Marker)
+	}
+
+	var errDelete error
+	done := true
+
+	err := S3.ListObjectsPagesWithContext(ctx, input, func(out *s3.ListObjectsOutput, last bool) bool {
+		if cp.Pass == 1 {
+			cleanupKeep(cp, out.Contents)
+		} else {
+			errDelete = cleanupDelete(ctx, cp, out.Contents)
+			if errDelete != nil {
+				return false
+			}
+		}
+
+		if len(out.Contents) > 0 {
+			cp.Marker = aws.StringValue(out.Contents[len(out.Contents)-1].Key)
+		}
+
+		if !last && DeadlineNear(ctx) {
+			done = false
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return done, errors.WithStack(errDelete)
+}
+
+// cleanupContinue re-invokes the function with the checkpoint, up to the cap on continuations
+func cleanupContinue(ctx context.Context, cp *CleanupCheckpoint) error {
+	c := Continuation{Count: cp.Summary.Invocations - 1, Token: cp.Time.Format(time.RFC3339)}
+
+	err := Continue(ctx, c, func(c Continuation) error {
+		if Config.Continue.FunctionName == "" {
+			return errors.New("cleanup ran out of time and has no function name to continue with")
+		}
+
+		detail, err := json.Marshal(cp)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		b, err := json.Marshal(events.CloudWatchEvent{
+			Detail:     detail,
+			DetailType: CleanupDetailType,
+			Source:     "gofaas",
+			Time:       time.Now(),
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		log.Printf("WorkerPeriodic cleanup continuing pass %d after %q\n", cp.Pass, cp.Marker)
+
+		_, err = Lambda.InvokeWithContext(ctx, &lambda.InvokeInput{
+			FunctionName:   aws.String(Config.Continue.FunctionName),
+			InvocationType: aws.String("Event"), // async
+			Payload:        b,
+		})
+		return errors.WithStack(err)
+	})
+
+	// the cap is notified, and the next scheduled cleanup starts over
+	if errors.Cause(err) == ErrContinuationCap {
+		log.Printf("WorkerPeriodic cleanup stopped pass %d after %q: %s\n", cp.Pass, cp.Marker, err)
+		return nil
+	}
+	return errors.WithStack(err)
+}
+
+// cleanupKeep tracks the newest objects under each prefix
+func cleanupKeep(cp *CleanupCheckpoint, objs []*s3.Object) {
+	if cp.Kept == nil {
+		cp.Kept = map[string][]CleanupObject{}
+	}
+
+	for _, o := range objs {
+		p, ok := cleanupPrefix(aws.StringValue(o.Key))
+		if !ok {
+			continue
+		}
+
+		kept := append(cp.Kept[p], CleanupObject{
+			Key:          aws.StringValue(o.Key),
+			LastModified: aws.TimeValue(o.LastModified),
+		})
+		sort.Slice(kept, func(i, j int) bool {
+			return kept[i].LastModified.After(kept[j].LastModified)
+		})
+		if len(kept) > Config.Retention.KeepNewest {
+			kept = kept[:Config.Retention.KeepNewest]
+		}
+		cp.Kept[p] = kept
+	}
+}
+
+// cleanupDelete deletes the objects in a page that the retention policy doesn't keep, or only logs them in a dry run
+func cleanupDelete(ctx context.Context, cp *CleanupCheckpoint, objs []*s3.Object) error {
+	del := []*s3.ObjectIdentifier{}
+	for _, o := range objs {
+		cp.Summary.Scanned++
+
+		if !cleanupExpired(cp, o) {
+			continue
+		}
+
+		cp.Summary.Deleted++
+		cp.Summary.BytesFreed += aws.Int64Value(o.Size)
+
+		if cp.Summary.DryRun {
+			log.Printf("WorkerPeriodic cleanup dry run would delete %s\n", aws.StringValue(o.Key))
+			continue
+		}
+		del = append(del, &s3.ObjectIdentifier{Key: o.Key})
+	}
+
+	if len(del) == 0 {
+		return nil
+	}
+
+	_, err := S3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(Config.Worker.Bucket),
+		Delete: &s3.Delete{
+			Objects: del,
+			Quiet:   aws.Bool(true),
+		},
+	})
+	return errors.WithStack(err)
+}
+
+// cleanupExpired returns if the retention policy deletes an object
+func cleanupExpired(cp *CleanupCheckpoint, o *s3.Object) bool {
+	k := aws.StringValue(o.Key)
+
+	p, ok := cleanupPrefix(k)
+	if !ok {
+		return false
+	}
+
+	if Config.Retention.MaxAge > 0 && cp.Time.Sub(aws.TimeValue(o.LastModified)) < Config.Retention.MaxAge {
+		return false
+	}
+
+	for _, ko := range cp.Kept[p] {
+		if ko.Key == k {
+			return false
+		}
+	}
+
+	return true
+}
+
+// cleanupPrefix returns the longest included prefix of a key, or false if the key is not included or is excluded
+func cleanupPrefix(key string) (string, bool) {
+	for _, p := range Config.Retention.Exclude {
+		if strings.HasPrefix(key, p) {
+			return "", false
+		}
+	}
+
+	if len(Config.Retention.Include) == 0 {
+		return "", true
+	}
+
+	prefix, ok := "", false
+	for _, p := range Config.Retention.Include {
+		if strings.HasPrefix(key, p) && (!ok || len(p) > len(prefix)) {
+			prefix, ok = p, true
+		}
+	}
+	return prefix, ok
+}
@@ -0,0 +1,145 @@
+package gofaas
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanup(t *testing.T) {
+	now := time.Date(2018, 2, 21, 15, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	objects := map[string]time.Duration{
+		"logs/a.log":     10 * day,
+		"reports/a.json": 10 * day,
+		"reports/b.json": 5 * day,
+		"reports/c.json": 1 * time.Minute,
+		"tmp/a":          10 * day,
+		"tmp/b":          2 * day,
+	}
+
+	cases := []struct {
+		name      string
+		retention RetentionConfig
+
+		remaining []string
+		summary   CleanupSummary
+	}{
+		{
+			name:      "All",
+			remaining: []string{},
+			summary:   CleanupSummary{BytesFreed: 12, Deleted: 6, Invocations: 1, Scanned: 6},
+		},
+		{
+			name:      "MaxAge",
+			retention: RetentionConfig{MaxAge: 3 * day},
+			remaining: []string{"reports/c.json", "tmp/b"},
+			summary:   CleanupSummary{BytesFreed: 8, Deleted: 4, Invocations: 1, Scanned: 6},
+		},
+		{
+			name:      "IncludeExclude",
+			retention: RetentionConfig{Exclude: []string{"reports/c"}, Include: []string{"reports/", "tmp/"}},
+			remaining: []string{"logs/a.log", "reports/c.json"},
+			summary:   CleanupSummary{BytesFreed: 8, Deleted: 4, Invocations: 1, Scanned: 6},
+		},
+		{
+			name:      "KeepNewest",
+			retention: RetentionConfig{Include: []string{"reports/", "tmp/"}, KeepNewest: 2},
+			remaining: []string{"logs/a.log", "reports/b.json", "reports/c.json", "tmp/a", "tmp/b"},
+			summary:   CleanupSummary{BytesFreed: 2, Deleted: 1, Invocations: 1, Scanned: 6},
+		},
+		{
+			name:      "DryRun",
+			retention: RetentionConfig{DryRun: true, MaxAge: 3 * day},
+			remaining: []string{"logs/a.log", "reports/a.json", "reports/b.json", "reports/c.json", "tmp/a", "tmp/b"},
+			summary:   CleanupSummary{BytesFreed: 8, Deleted: 4, DryRun: true, Invocations: 1, Scanned: 6},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			Config.Retention = c.retention
+			defer func() { Config.Retention = RetentionConfig{} }()
+
+			ms3 := &MockS3{Modified: map[string]time.Time{}, Objects: map[string][]byte{}, PageSize: 2}
+			for k, age := range objects {
+				ms3.Modified[k] = now.Add(-age)
+				ms3.Objects[k] = []byte("{}")
+			}
+			S3 = ms3
+
+			cp, err := cleanupCheckpoint(events.CloudWatchEvent{Time: now})
+			assert.NoError(t, err)
+			assert.NoError(t, cleanup(context.Background(), cp))
+
+			assert.Equal(t, c.summary, cp.Summary)
+			assert.Equal(t, c.remaining, mockKeys(ms3))
+		})
+	}
+}
+
+func TestCleanupCheckpoint(t *testing.T) {
+	Config.Continue.FunctionName = "gofaas-WorkerPeriodicFunction"
+	Config.Retention = RetentionConfig{KeepNewest: 1}
+	defer func() {
+		Config.Continue.FunctionName = ""
+		Config.Retention = RetentionConfig{}
+	}()
+
+	now := time.Now()
+	ms3 := &MockS3{Modified: map[string]time.Time{}, Objects: map[string][]byte{}, PageSize: 2}
+	for i, k := range []string{"a", "b", "c", "d", "e"} {
+		ms3.Modified[k] = now.Add(time.Duration(i) * time.Minute)
+		ms3.Objects[k] = []byte("{}")
+	}
+
+	ml := &MockLambda{}
+	Lambda = ml
+	S3 = ms3
+
+	// an invocation that is always low on time processes one page then continues in a new invocation
+	defer deadlineNearAlways()()
+
+	invocations := 0
+	e := events.CloudWatchEvent{}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		var err error
+		if invocations == 0 {
+			err = scheduleCleanup(ctx, now.Add(time.Hour))
+		} else {
+			err = WorkerPeriodic(ctx, e)
+		}
+		cancel()
+		assert.NoError(t, err)
+
+		invocations++
+		if len(ml.Inputs) < invocations || invocations > 10 {
+			break
+		}
+
+		e = events.CloudWatchEvent{}
+		assert.NoError(t, json.Unmarshal(ml.Inputs[invocations-1].Payload, &e))
+		assert.Equal(t, CleanupDetailType, e.DetailType)
+		assert.Equal(t, "gofaas-WorkerPeriodicFunction", *ml.Inputs[invocations-1].FunctionName)
+	}
+
+	// 3 pages to keep the newest, then 3 pages to delete
+	assert.Equal(t, 6, invocations)
+	assert.Equal(t, []string{"e"}, mockKeys(ms3))
+}
+
+func mockKeys(m *MockS3) []string {
+	keys := []string{}
+	for k := range m.Objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
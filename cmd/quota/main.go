@@ -0,0 +1,60 @@
+// Command quota shows or overrides the work limits of a subject
+//
+//	go run ./cmd/quota -table $QUOTA_TABLE_NAME -subject $SUBJECT
+//	go run ./cmd/quota -table $QUOTA_TABLE_NAME -subject $SUBJECT -concurrent 10 -daily 500
+//	go run ./cmd/quota -table $QUOTA_TABLE_NAME -subject $SUBJECT -reset
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/nzoschke/gofaas"
+)
+
+func main() {
+	table := flag.String("table", os.Getenv("QUOTA_TABLE_NAME"), "quota table name")
+	subject := flag.String("subject", "", "subject to show or override the limits of")
+	concurrent := flag.Int("concurrent", 0, "concurrent jobs limit, 0 for the default")
+	daily := flag.Int("daily", 0, "jobs per day limit, 0 for the default")
+	reset := flag.Bool("reset", false, "remove the override, back to the default limits")
+	flag.Parse()
+
+	if *table == "" || *subject == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	gofaas.Config.Quota.TableName = *table
+
+	// a segment for the instrumented clients to trace calls in
+	ctx, seg := xray.BeginSegment(context.Background(), "quota")
+
+	// only the limits that were passed are changed, so setting one keeps the override of the other
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	o, err := gofaas.QuotaGet(ctx, *subject)
+	if err == nil && (*reset || set["concurrent"] || set["daily"]) {
+		if *reset {
+			o = gofaas.QuotaOverride{}
+		}
+		if set["concurrent"] {
+			o.Concurrent = *concurrent
+		}
+		if set["daily"] {
+			o.Daily = *daily
+		}
+		err = gofaas.QuotaSet(ctx, *subject, o)
+	}
+	seg.Close(err)
+
+	if err != nil {
+		log.Fatalf("quota error %+v\n", err)
+	}
+	fmt.Printf("subject %q concurrent %d daily %d (0 is the default)\n", *subject, o.Concurrent, o.Daily)
+}
@@ -0,0 +1,45 @@
+// Command redrive moves work messages from the dead-letter queue back to the work queue
+//
+//	go run ./cmd/redrive -from $DEAD_LETTER_QUEUE_URL -to $WORK_QUEUE_URL -table $JOBS_TABLE_NAME -quota $QUOTA_TABLE_NAME
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/nzoschke/gofaas"
+)
+
+func main() {
+	from := flag.String("from", os.Getenv("DEAD_LETTER_QUEUE_URL"), "dead-letter queue URL")
+	to := flag.String("to", os.Getenv("WORK_QUEUE_URL"), "work queue URL")
+	table := flag.String("table", os.Getenv("JOBS_TABLE_NAME"), "jobs table name, to queue failed jobs again")
+	quota := flag.String("quota", os.Getenv("QUOTA_TABLE_NAME"), "quota table name, to count failed jobs against the concurrent jobs quota again")
+	concurrent, _ := strconv.Atoi(os.Getenv("QUOTA_CONCURRENT"))
+	flag.IntVar(&concurrent, "concurrent", concurrent, "default concurrent jobs limit")
+	flag.Parse()
+
+	if *from == "" || *to == "" || *table == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	gofaas.Config.Jobs.TableName = *table
+	gofaas.Config.Quota.Concurrent = concurrent
+	gofaas.Config.Quota.TableName = *quota
+
+	// a segment for the instrumented clients to trace calls in
+	ctx, seg := xray.BeginSegment(context.Background(), "redrive")
+	n, err := gofaas.Redrive(ctx, *from, *to)
+	seg.Close(err)
+
+	fmt.Printf("redrove %d messages\n", n)
+	if err != nil {
+		log.Fatalf("redrive error %+v\n", err)
+	}
+}
@@ -0,0 +1,287 @@
+package gofaas
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is loaded once at cold start by each function and can be replaced in tests
+// Each handler main loads only the sections its function needs
+var Config struct {
+	Auth       AuthConfig
+	Continue   ContinueConfig
+	DeadLetter DeadLetterConfig
+	FanOut     FanOutConfig
+	Jobs       JobsConfig
+	Notify     NotifyConfig
+	Quota      QuotaConfig
+	Resource   ResourceConfig
+	Retention  RetentionConfig
+	Schedule   ScheduleConfig
+	User       UserConfig
+	Work       WorkConfig
+	Worker     WorkerConfig
+}
+
+// AuthConfig configures JWT auth for API functions
+// Auth "passes" for convenience if no hash key is set
+type AuthConfig struct {
+	HashKey Secret `env:"AUTH_HASH_KEY,base64"`
+}
+
+// ContinueConfig configures how a worker sends work back to itself, to continue a run or for a fan-out shard
+// Work is sent to the queue if one is set, otherwise the function invokes itself.
+// A run continues at most Max times, 20 by default, and saves checkpoints to the table if one is set, otherwise to the bucket.
+type ContinueConfig struct {
+	FunctionName string `env:"AWS_LAMBDA_FUNCTION_NAME"`
+	Max          int    `env:"CONTINUE_MAX"`
+	QueueURL     string `env:"WORK_QUEUE_URL"`
+	TableName    string `env:"CHECKPOINT_TABLE_NAME"`
+}
+
+// DeadLetterConfig configures the work dead-letter queue consumer
+type DeadLetterConfig struct {
+	QueueURL string `env:"DEAD_LETTER_QUEUE_URL,required"`
+}
+
+// FanOutConfig configures fan-out jobs
+// At most Concurrency shards of a job run at once, 10 by default
+type FanOutConfig struct {
+	Concurrency int `env:"FANOUT_CONCURRENCY"`
+}
+
+// JobsConfig configures the job status table
+type JobsConfig struct {
+	TableName string `env:"JOBS_TABLE_NAME,required"`
+}
+
+// NotifyConfig configures the sinks error notifications are sent to, each with a minimum severity
+// The Slack and webhook URLs are secrets like "ssm:/gofaas/NotifySlackURL". Email is sent with SES.
+// With a table, repeats of an error within Window are rolled up, or in Digest mode every error is
+// summarized in one digest per Window.
+type NotifyConfig struct {
+	Digest          bool          `env:"NOTIFY_DIGEST"`
+	EmailFrom       string        `env:"NOTIFY_EMAIL_FROM"`
+	EmailSeverity   Severity      `env:"NOTIFY_EMAIL_SEVERITY"`
+	EmailTo         []string      `env:"NOTIFY_EMAIL_TO"`
+	SlackSeverity   Severity      `env:"NOTIFY_SLACK_SEVERITY"`
+	SlackURL        Secret        `env:"NOTIFY_SLACK_URL"`
+	TableName       string        `env:"NOTIFY_TABLE_NAME"`
+	Topic           string        `env:"NOTIFICATION_TOPIC,arn"`
+	TopicSeverity   Severity      `env:"NOTIFICATION_TOPIC_SEVERITY"`
+	WebhookSeverity Severity      `env:"NOTIFY_WEBHOOK_SEVERITY"`
+	WebhookURL      Secret        `env:"NOTIFY_WEBHOOK_URL"`
+	Window          time.Duration `env:"NOTIFY_WINDOW"`
+}
+
+// QuotaConfig configures the per-subject limits on work, which are off without a table
+// Subjects can run Concurrent jobs at once and create Daily jobs per UTC day, 5 and 100 by default.
+// An override item in the table changes the limits of a subject, see cmd/quota.
+type QuotaConfig struct {
+	Concurrent int    `env:"QUOTA_CONCURRENT"`
+	Daily      int    `env:"QUOTA_DAILY"`
+	TableName  string `env:"QUOTA_TABLE_NAME"`
+}
+
+// ResourceConfig configures the custom resource function
+// The table saves what a Custom::ApiGatewayStage changed, so a delete can restore it.
+type ResourceConfig struct {
+	TableName string `env:"CUSTOM_RESOURCE_TABLE_NAME"`
+}
+
+// RetentionConfig configures which objects the periodic worker deletes from the bucket
+// Objects under an excluded prefix or not under an included prefix are never deleted.
+// The newest KeepNewest objects under each included prefix are kept, as are objects younger than MaxAge.
+type RetentionConfig struct {
+	DryRun     bool          `env:"RETENTION_DRY_RUN"`
+	Exclude    []string      `env:"RETENTION_EXCLUDE"`
+	Include    []string      `env:"RETENTION_INCLUDE"`
+	KeepNewest int           `env:"RETENTION_KEEP_NEWEST"`
+	MaxAge     time.Duration `env:"RETENTION_MAX_AGE"`
+}
+
+// ScheduleConfig configures the table of the last runs of scheduled tasks
+type ScheduleConfig struct {
+	TableName string `env:"SCHEDULE_TABLE_NAME,required"`
+}
+
+// UserConfig configures the user functions
+type UserConfig struct {
+	KeyID     string `env:"KEY_ID,required"`
+	TableName string `env:"TABLE_NAME,required"`
+}
+
+// WorkConfig configures the function that creates work
+// Work is sent to the queue if one is set, otherwise the worker function is invoked directly
+type WorkConfig struct {
+	QueueURL           string `env:"WORK_QUEUE_URL"`
+	WorkerFunctionName string `env:"WORKER_FUNCTION_NAME,required"`
+}
+
+// WorkerConfig configures the worker functions
+// ReportFormat is the format of reports for work that doesn't choose one, "json" by default
+type WorkerConfig struct {
+	Bucket       string `env:"BUCKET,required"`
+	ReportFormat string `env:"REPORT_FORMAT"`
+}
+
+// ConfigError lists every missing or malformed config value
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("invalid config: %s", strings.Join(e, "; "))
+}
+
+// LoadConfig populates config structs from the environment
+// Fields are set from the env var named in their `env:"NAME,options"` tag
+// Options are "required", "arn" and "base64". []byte values are base64 encoded,
+// []string values are comma separated, and int, bool, time.Duration and Severity values are parsed.
+// Secret values are resolved so a missing or malformed secret fails at cold start too.
+// It returns a ConfigError listing every missing or malformed value.
+func LoadConfig(cfgs ...interface{}) error {
+	return loadConfig(os.Getenv, cfgs...)
+}
+
+// MustLoadConfig loads config structs or exits with a message listing every missing or malformed value
+func MustLoadConfig(cfgs ...interface{}) {
+	if err := LoadConfig(cfgs...); err != nil {
+		log.Fatalf("%s %s\n", os.Getenv("AWS_LAMBDA_FUNCTION_NAME"), err)
+	}
+}
+
+func loadConfig(getenv func(string) string, cfgs ...interface{}) error {
+	errs := ConfigError{}
+	for _, cfg := range cfgs {
+		v := reflect.ValueOf(cfg)
+		if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+			return fmt.Errorf("config %T is not a struct pointer", cfg)
+		}
+		errs = append(errs, loadStruct(getenv, v.Elem())...)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func loadStruct(getenv func(string) string, v reflect.Value) []string {
+	errs := []string{}
+
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		fv := v.Field(i)
+
+		if f.Anonymous && fv.Kind() == reflect.Struct {
+			errs = append(errs, loadStruct(getenv, fv)...)
+			continue
+		}
+
+		tag := f.Tag.Get("env")
+		if tag == "" {
+			continue
+		}
+
+		opts := strings.Split(tag, ",")
+		name := opts[0]
+		s := getenv(name)
+
+		if s == "" {
+			if hasOption(opts, "required") {
+				errs = append(errs, fmt.Sprintf("%s is required", name))
+			}
+			continue
+		}
+
+		if hasOption(opts, "arn") && !strings.HasPrefix(s, "arn:") {
+			errs = append(errs, fmt.Sprintf("%s %q is not an ARN", name, s))
+			continue
+		}
+
+		if err := setField(fv, s); err != nil {
+			errs = append(errs, fmt.Sprintf("%s %s", name, err))
+			continue
+		}
+
+		if sec, ok := fv.Interface().(Secret); ok {
+			val, err := sec.Value()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s %s", name, err))
+				continue
+			}
+
+			if hasOption(opts, "base64") {
+				if _, err := base64.StdEncoding.DecodeString(val); err != nil {
+					errs = append(errs, fmt.Sprintf("%s is not valid base64: %s", name, err))
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+func setField(v reflect.Value, s string) error {
+	switch v.Interface().(type) {
+	case string:
+		v.SetString(s)
+	case Secret:
+		v.SetString(s)
+	case []byte:
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return fmt.Errorf("is not valid base64: %s", err)
+		}
+		v.SetBytes(b)
+	case []string:
+		parts := []string{}
+		for _, p := range strings.Split(s, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				parts = append(parts, p)
+			}
+		}
+		v.Set(reflect.ValueOf(parts))
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a bool", s)
+		}
+		v.SetBool(b)
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%q is not an int", s)
+		}
+		v.SetInt(int64(n))
+	case Severity:
+		sev, err := ParseSeverity(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(sev))
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration", s)
+		}
+		v.SetInt(int64(d))
+	default:
+		return fmt.Errorf("has unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func hasOption(opts []string, opt string) bool {
+	for _, o := range opts[1:] {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
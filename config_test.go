@@ -0,0 +1,57 @@
+package gofaas
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	env := map[string]string{
+		"AUTH_HASH_KEY":      "not base64!",
+		"NOTIFICATION_TOPIC": "gofaas-NotificationTopic",
+		"TABLE_NAME":         "gofaas-UsersTable",
+	}
+
+	auth := AuthConfig{}
+	notify := NotifyConfig{}
+	user := UserConfig{}
+
+	err := loadConfig(func(k string) string { return env[k] }, &auth, &notify, &user)
+	assert.EqualError(t, err, `invalid config: AUTH_HASH_KEY is not valid base64: illegal base64 data at input byte 3; NOTIFICATION_TOPIC "gofaas-NotificationTopic" is not an ARN; KEY_ID is required`)
+	assert.Equal(t, "gofaas-UsersTable", user.TableName)
+
+	env = map[string]string{
+		"AUTH_HASH_KEY":      "c2VjcmV0",
+		"NOTIFICATION_TOPIC": "arn:aws:sns:us-east-1:123456789012:gofaas-NotificationTopic",
+	}
+
+	err = loadConfig(func(k string) string { return env[k] }, &auth, &notify)
+	assert.NoError(t, err)
+	assert.Equal(t, Secret("c2VjcmV0"), auth.HashKey)
+	assert.Equal(t, "arn:aws:sns:us-east-1:123456789012:gofaas-NotificationTopic", notify.Topic)
+
+	types := struct {
+		Age      time.Duration `env:"AGE"`
+		DryRun   bool          `env:"DRY_RUN"`
+		Keep     int           `env:"KEEP"`
+		Key      []byte        `env:"KEY"`
+		Prefixes []string      `env:"PREFIXES"`
+	}{}
+
+	env = map[string]string{
+		"AGE":      "24h",
+		"DRY_RUN":  "true",
+		"KEEP":     "ten",
+		"KEY":      "c2VjcmV0",
+		"PREFIXES": "reports/, logs/",
+	}
+
+	err = loadConfig(func(k string) string { return env[k] }, &types)
+	assert.EqualError(t, err, `invalid config: KEEP "ten" is not an int`)
+	assert.Equal(t, 24*time.Hour, types.Age)
+	assert.True(t, types.DryRun)
+	assert.Equal(t, []byte("secret"), types.Key)
+	assert.Equal(t, []string{"reports/", "logs/"}, types.Prefixes)
+}
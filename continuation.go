@@ -0,0 +1,219 @@
+package gofaas
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// Continuation identifies a run that continues across invocations before it hits the Lambda timeout
+// Token names the checkpoint of the run and Count is how many times it has continued
+type Continuation struct {
+	Count int    `json:"count"`
+	Token string `json:"token"`
+}
+
+// ErrContinuationCap is the cause of the error Continue returns when a run hits the cap on continuations
+var ErrContinuationCap = errors.New("continuation cap reached")
+
+var (
+	// deadlineMargin is the most time left before the deadline at which work checkpoints and continues in a new invocation
+	deadlineMargin = 10 * time.Second
+
+	// deadlineMarginMin is the least margin for work with a short budget
+	deadlineMarginMin = 500 * time.Millisecond
+)
+
+type deadlineBudgetKey struct{}
+
+// withDeadlineBudget returns a copy of ctx that saves the time left before its deadline as the budget of the work,
+// unless ctx already has a budget or no deadline
+func withDeadlineBudget(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(deadlineBudgetKey{}).(time.Duration); ok {
+		return ctx
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, deadlineBudgetKey{}, time.Until(deadline))
+}
+
+// DeadlineNear returns if ctx is within the deadline margin of its deadline
+// The margin is deadlineMargin, or a fifth of the budget from withDeadlineBudget if that is less,
+// so work in a function with a 5 second timeout runs for 4 seconds instead of being near the deadline from the start.
+func DeadlineNear(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return false
+	}
+
+	margin := deadlineMargin
+	if budget, ok := ctx.Value(deadlineBudgetKey{}).(time.Duration); ok && budget/5 < margin {
+		margin = budget / 5
+		if margin < deadlineMarginMin {
+			margin = deadlineMarginMin
+		}
+	}
+
+	return time.Until(deadline) < margin
+}
+
+// continueMax returns the cap on continuations of a run
+func continueMax() int {
+	if Config.Continue.Max > 0 {
+		return Config.Continue.Max
+	}
+	return 20
+}
+
+// Continue sends the next continuation of a run to a new invocation with send
+// If the run already continued the max times it notifies instead, and returns an error caused by ErrContinuationCap
+func Continue(ctx context.Context, c Continuation, send func(Continuation) error) error {
+	if max := continueMax(); c.Count >= max {
+		err := errors.WithMessage(ErrContinuationCap, fmt.Sprintf("run %s continued %d times", c.Token, max))
+		notify(ctx, err)
+		return err
+	}
+
+	c.Count++
+	return errors.WithStack(send(c))
+}
+
+// Checkpoints saves the state of runs by continuation token
+type Checkpoints interface {
+	Delete(ctx context.Context, token string) error
+	Load(ctx context.Context, token string, v interface{}) error
+	Save(ctx context.Context, token string, v interface{}) error
+}
+
+// checkpoints returns the DynamoDB checkpoints if a table is configured, or S3 checkpoints in the worker bucket
+func checkpoints() Checkpoints {
+	if Config.Continue.TableName != "" {
+		return DynamoDBCheckpoints{TableName: Config.Continue.TableName}
+	}
+	return S3Checkpoints{Bucket: Config.Worker.Bucket, Prefix: "checkpoints/"}
+}
+
+// S3Checkpoints saves checkpoints as JSON objects under a prefix
+type S3Checkpoints struct {
+	Bucket string
+	Prefix string
+}
+
+// Delete deletes a checkpoint
+func (c S3Checkpoints) Delete(ctx context.Context, token string) error {
+	_, err := S3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(c.Bucket),
+		Delete: &s3.Delete{
+			Objects: []*s3.ObjectIdentifier{{Key: aws.String(c.Prefix + token + ".json")}},
+			Quiet:   aws.Bool(true),
+		},
+	})
+	return errors.WithStack(err)
+}
+
+// Load unmarshals a checkpoint into v
+func (c S3Checkpoints) Load(ctx context.Context, token string, v interface{}) error {
+	out, err := S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.Bucket),
+		Key:    aws.String(c.Prefix + token + ".json"),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer out.Body.Close()
+
+	return errors.WithStack(json.NewDecoder(out.Body).Decode(v))
+}
+
+// Save marshals v to a checkpoint
+func (c S3Checkpoints) Save(ctx context.Context, token string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Body:        bytes.NewReader(b),
+		Bucket:      aws.String(c.Bucket),
+		ContentType: aws.String("application/json"),
+		Key:         aws.String(c.Prefix + token + ".json"),
+	})
+	return errors.WithStack(err)
+}
+
+// DynamoDBCheckpoints saves checkpoints as JSON in the "checkpoint" attribute of items keyed by token
+// Items have an "expires" attribute for a table TTL to delete abandoned checkpoints
+type DynamoDBCheckpoints struct {
+	TableName string
+}
+
+// checkpointExpiry is how long an abandoned DynamoDB checkpoint is kept
+var checkpointExpiry = 7 * 24 * time.Hour
+
+// Delete deletes a checkpoint
+func (c DynamoDBCheckpoints) Delete(ctx context.Context, token string) error {
+	_, err := DynamoDB.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: aws.String(token),
+			},
+		},
+		TableName: aws.String(c.TableName),
+	})
+	return errors.WithStack(err)
+}
+
+// Load unmarshals a checkpoint into v
+func (c DynamoDBCheckpoints) Load(ctx context.Context, token string, v interface{}) error {
+	out, err := DynamoDB.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: aws.String(token),
+			},
+		},
+		TableName: aws.String(c.TableName),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if out.Item == nil || out.Item["checkpoint"] == nil {
+		return errors.Errorf("checkpoint %s not found", token)
+	}
+
+	return errors.WithStack(json.Unmarshal([]byte(aws.StringValue(out.Item["checkpoint"].S)), v))
+}
+
+// Save marshals v to a checkpoint
+func (c DynamoDBCheckpoints) Save(ctx context.Context, token string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = DynamoDB.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item: map[string]*dynamodb.AttributeValue{
+			"checkpoint": &dynamodb.AttributeValue{
+				S: aws.String(string(b)),
+			},
+			"expires": &dynamodb.AttributeValue{
+				N: aws.String(fmt.Sprint(time.Now().Add(checkpointExpiry).Unix())),
+			},
+			"id": &dynamodb.AttributeValue{
+				S: aws.String(token),
+			},
+		},
+		TableName: aws.String(c.TableName),
+	})
+	return errors.WithStack(err)
+}
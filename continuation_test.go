@@ -0,0 +1,216 @@
+package gofaas
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkContinue(t *testing.T) {
+	Config.Continue.FunctionName = "gofaas-WorkerFunction"
+	Config.Jobs.TableName = "gofaas-JobsTable"
+	Config.Notify.Topic = "arn:aws:sns:us-east-1:123456789012:gofaas-NotificationTopic"
+	Config.Work.WorkerFunctionName = "gofaas-WorkerFunction"
+	Config.Worker.Bucket = "gofaas-bucket"
+	defer func() {
+		Config.Continue.FunctionName = ""
+		Config.Continue.Max = 0
+		Config.Notify.Topic = ""
+	}()
+
+	defer deadlineNearAlways()()
+
+	ids := []string{"26f0dc9f-4483-4b65-8724-3d1598ff6d14", "7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d"}
+	UUIDGen = func() uuid.UUID {
+		id := ids[0]
+		ids = ids[1:]
+		return uuid.Must(uuid.FromString(id))
+	}
+
+	ml := &MockLambda{}
+	ms3 := &MockS3{}
+	ms := &MockSNS{}
+
+	DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+	Lambda = ml
+	S3 = ms3
+	SNS = ms
+
+	ctx := context.Background()
+
+	r, err := WorkCreate(ctx, events.APIGatewayProxyRequest{
+		Body:                  `[{"n": 1}, {"n": 2}, {"n": 3}]`,
+		QueryStringParameters: map[string]string{"format": "csv"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+
+	// each invocation works on one item, saves a checkpoint and continues in a new invocation
+	assert.Len(t, workContinueRun(t, ml), 0)
+	if assert.Len(t, ml.Inputs, 3) {
+		for i, in := range ml.Inputs {
+			e := WorkerEvent{}
+			assert.NoError(t, json.Unmarshal(in.Payload, &e))
+			if i == 0 {
+				assert.Nil(t, e.Continuation)
+			} else if assert.NotNil(t, e.Continuation) {
+				assert.Equal(t, Continuation{Count: i, Token: "work-26f0dc9f-4483-4b65-8724-3d1598ff6d14"}, *e.Continuation)
+			}
+		}
+	}
+
+	j := workQueueJob(t, "26f0dc9f-4483-4b65-8724-3d1598ff6d14")
+	assert.Equal(t, JobSucceeded, j.Status)
+
+	// the last invocation merges the parts into the report and deletes the parts and checkpoint
+	keys := mockKeys(ms3)
+	if assert.Len(t, keys, 1) {
+		assert.True(t, strings.HasSuffix(keys[0], "/26f0dc9f-4483-4b65-8724-3d1598ff6d14.csv"))
+		assert.Equal(t, 4, strings.Count(string(ms3.Objects[keys[0]]), "\n"))
+		for _, n := range []string{"1", "2", "3"} {
+			assert.Contains(t, string(ms3.Objects[keys[0]]), `{""n"":`+n+`}`)
+		}
+	}
+	assert.Len(t, ms.Inputs, 0)
+
+	// a job that hits the cap on continuations fails and notifies
+	Config.Continue.Max = 1
+	ml.Inputs = nil
+
+	r, err = WorkCreate(ctx, events.APIGatewayProxyRequest{Body: `[{"n": 1}, {"n": 2}, {"n": 3}]`})
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+
+	assert.Len(t, workContinueRun(t, ml), 0)
+	assert.Len(t, ml.Inputs, 2)
+
+	j = workQueueJob(t, "7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d")
+	assert.Equal(t, JobFailed, j.Status)
+	assert.Equal(t, "run work-7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d continued 1 times: continuation cap reached", j.Error)
+	if assert.Len(t, ms.Inputs, 1) {
+		assert.Contains(t, *ms.Inputs[0].Message, "continuation cap reached")
+	}
+}
+
+func TestDeadlineNear(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// without a budget the margin is deadlineMargin, so a 5 second invocation is always near
+	assert.True(t, DeadlineNear(ctx))
+	assert.False(t, DeadlineNear(context.Background()))
+
+	// with a budget the margin is a fifth of it
+	assert.False(t, DeadlineNear(withDeadlineBudget(ctx)))
+	assert.False(t, DeadlineNear(withDeadlineBudget(context.Background())))
+
+	short, cancel := context.WithTimeout(ctx, 900*time.Millisecond)
+	defer cancel()
+	assert.True(t, DeadlineNear(context.WithValue(short, deadlineBudgetKey{}, 5*time.Second)))
+	assert.False(t, DeadlineNear(withDeadlineBudget(context.WithValue(short, deadlineBudgetKey{}, time.Second/2))))
+
+	// but at least deadlineMarginMin
+	assert.True(t, DeadlineNear(context.WithValue(ctx, deadlineBudgetKey{}, time.Hour)))
+	short, cancel = context.WithTimeout(ctx, 400*time.Millisecond)
+	defer cancel()
+	assert.True(t, DeadlineNear(withDeadlineBudget(short)))
+}
+
+func TestWorkDeadlineBudget(t *testing.T) {
+	Config.Continue.FunctionName = "gofaas-WorkerFunction"
+	Config.Worker.Bucket = "gofaas-bucket"
+	defer func() { Config.Continue.FunctionName = "" }()
+
+	ml := &MockLambda{}
+	ms3 := &MockS3{}
+	Lambda = ml
+	S3 = ms3
+
+	items := []string{}
+	for i := 0; i < 100; i++ {
+		items = append(items, fmt.Sprintf(`{"n": %d}`, i))
+	}
+	e := WorkerEvent{Input: json.RawMessage("[" + strings.Join(items, ",") + "]")}
+
+	// an invocation with the 5 second Lambda timeout works on every item instead of continuing after the first
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(5*time.Second))
+	defer cancel()
+
+	key, err := work(ctx, e, "26f0dc9f-4483-4b65-8724-3d1598ff6d14")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, key)
+	assert.Len(t, ml.Inputs, 0)
+
+	r := ms3.Objects[key]
+	assert.Equal(t, 100, strings.Count(string(r), `"n":`))
+}
+
+func TestCheckpoints(t *testing.T) {
+	type state struct {
+		Next int `json:"next"`
+	}
+
+	cases := []struct {
+		name string
+		cps  Checkpoints
+	}{
+		{name: "dynamodb", cps: DynamoDBCheckpoints{TableName: "gofaas-CheckpointsTable"}},
+		{name: "s3", cps: S3Checkpoints{Bucket: "gofaas-bucket", Prefix: "checkpoints/"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			md := &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+			ms3 := &MockS3{}
+			DynamoDB = md
+			S3 = ms3
+
+			ctx := context.Background()
+
+			s := state{}
+			assert.Error(t, c.cps.Load(ctx, "token-1", &s))
+
+			assert.NoError(t, c.cps.Save(ctx, "token-1", state{Next: 3}))
+			assert.NoError(t, c.cps.Load(ctx, "token-1", &s))
+			assert.Equal(t, state{Next: 3}, s)
+
+			assert.NoError(t, c.cps.Delete(ctx, "token-1"))
+			assert.Error(t, c.cps.Load(ctx, "token-1", &s))
+			assert.Len(t, md.Items, 0)
+			assert.Len(t, ms3.Objects, 0)
+		})
+	}
+}
+
+// deadlineNearAlways makes every run near its deadline after its first item or page, and returns a func that undoes it
+func deadlineNearAlways() func() {
+	margin, min := deadlineMargin, deadlineMarginMin
+	deadlineMargin, deadlineMarginMin = time.Hour, time.Hour
+	return func() { deadlineMargin, deadlineMarginMin = margin, min }
+}
+
+// workContinueRun runs the worker with a deadline for every async invoke until there are none left, returning the worker errors
+func workContinueRun(t *testing.T, ml *MockLambda) []error {
+	errs := []error{}
+
+	for i := len(ml.Inputs) - 1; i < len(ml.Inputs); i++ {
+		e := WorkerEvent{}
+		assert.NoError(t, json.Unmarshal(ml.Inputs[i].Payload, &e))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if err := Worker(ctx, e); err != nil {
+			errs = append(errs, err)
+		}
+		cancel()
+	}
+
+	return errs
+}
@@ -0,0 +1,174 @@
+package gofaas
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Cron is a parsed cron expression with the fields minute, hour, day of month, month and day of week
+// Each field is `*` (or `?`), a value, a range `a-b`, a step `*/n` or `a-b/n`, or a comma separated list of them.
+// Days of week are 0-6 from Sunday, and 7 is Sunday too. Times are matched in UTC.
+type Cron struct {
+	Expr string
+
+	dom, dow, hour, minute, month uint64
+	domAny, dowAny                bool
+}
+
+// cronFields are the bounds of each field of a cron expression
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// ParseCron parses a cron expression
+func ParseCron(expr string) (Cron, error) {
+	fs := strings.Fields(expr)
+	if len(fs) != len(cronFields) {
+		return Cron{}, errors.Errorf("cron %q has %d fields, not %d", expr, len(fs), len(cronFields))
+	}
+
+	bits := make([]uint64, len(fs))
+	for i, f := range fs {
+		b, err := cronField(f, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return Cron{}, errors.Wrapf(err, "cron %q %s", expr, cronFields[i].name)
+		}
+		bits[i] = b
+	}
+
+	// Sunday is 0 or 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	return Cron{
+		Expr:   expr,
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		domAny: fs[2] == "*" || fs[2] == "?",
+		dowAny: fs[4] == "*" || fs[4] == "?",
+	}, nil
+}
+
+// cronField parses a field of a cron expression into a bit per value
+func cronField(f string, min, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(f, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, errors.Errorf("step %q is not a positive int", part[i+1:])
+			}
+			rng, step = part[:i], n
+		}
+
+		lo, hi := min, max
+		switch {
+		case rng == "*" || rng == "?":
+		case strings.Contains(rng, "-"):
+			i := strings.Index(rng, "-")
+			var err error
+			if lo, err = cronValue(rng[:i], min, max); err != nil {
+				return 0, err
+			}
+			if hi, err = cronValue(rng[i+1:], min, max); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, errors.Errorf("range %q is backwards", rng)
+			}
+		default:
+			n, err := cronValue(rng, min, max)
+			if err != nil {
+				return 0, err
+			}
+			lo = n
+			if step == 1 {
+				hi = n
+			}
+		}
+
+		for n := lo; n <= hi; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+
+	return bits, nil
+}
+
+// cronValue parses a value of a cron field within its bounds
+func cronValue(s string, min, max int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.Errorf("value %q is not an int", s)
+	}
+	if n < min || n > max {
+		return 0, errors.Errorf("value %d is not within %d-%d", n, min, max)
+	}
+	return n, nil
+}
+
+// Match returns if the minute of t is in the schedule
+func (c Cron) Match(t time.Time) bool {
+	t = t.UTC()
+	return c.minute&(1<<uint(t.Minute())) != 0 &&
+		c.hour&(1<<uint(t.Hour())) != 0 &&
+		c.month&(1<<uint(t.Month())) != 0 &&
+		c.matchDay(t)
+}
+
+// matchDay returns if the day of t is in the schedule
+// Like cron, when both the day of month and day of week are restricted either one matches
+func (c Cron) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// Next returns the first minute in the schedule after t, or the zero time if there is none within 5 years
+func (c Cron) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+
+	for t.Before(end) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
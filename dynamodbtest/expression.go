@@ -0,0 +1,652 @@
+// Package dynamodbtest evaluates DynamoDB condition and update expressions on in-memory items,
+// so mocks of the DynamoDB API can enforce conditions like the service does.
+package dynamodbtest
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// expr evaluates the subset of DynamoDB condition and update expressions gofaas uses
+// Conditions support AND, OR, NOT, parentheses, comparisons, BETWEEN, IN,
+// attribute_exists, attribute_not_exists, begins_with, contains and size.
+// Updates support SET with +, -, if_not_exists and list_append, REMOVE, and ADD for numbers.
+type expr struct {
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+
+	toks []string
+	pos  int
+}
+
+type pathPart struct {
+	index int
+	name  string
+}
+
+// ErrConditionalCheckFailed is returned when a condition expression is false
+var ErrConditionalCheckFailed = awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+
+func validation(format string, args ...interface{}) error {
+	return awserr.New("ValidationException", fmt.Sprintf(format, args...), nil)
+}
+
+// Condition returns if an item matches a condition expression
+func Condition(item map[string]*dynamodb.AttributeValue, cond *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (bool, error) {
+	if cond == nil {
+		return true, nil
+	}
+
+	x := &expr{names: names, values: values, toks: tokens(*cond)}
+	ok, err := x.or(item)
+	if err != nil {
+		return false, err
+	}
+	if x.pos < len(x.toks) {
+		return false, validation("unexpected %q in condition %q", x.toks[x.pos], *cond)
+	}
+	return ok, nil
+}
+
+// Update applies an update expression to an item, returning the top level attributes it updated
+func Update(item map[string]*dynamodb.AttributeValue, update *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) ([]string, error) {
+	if update == nil {
+		return nil, nil
+	}
+
+	x := &expr{names: names, values: values, toks: tokens(*update)}
+	updated := []string{}
+
+	for x.pos < len(x.toks) {
+		clause := strings.ToUpper(x.next())
+
+		for {
+			p, err := x.path()
+			if err != nil {
+				return nil, err
+			}
+			updated = append(updated, p[0].name)
+
+			switch clause {
+			case "SET":
+				if err := x.expect("="); err != nil {
+					return nil, err
+				}
+				v, err := x.setValue(item)
+				if err != nil {
+					return nil, err
+				}
+				if err := setPath(item, p, v); err != nil {
+					return nil, err
+				}
+			case "REMOVE":
+				removePath(item, p)
+			case "ADD":
+				v, err := x.operand(item)
+				if err != nil {
+					return nil, err
+				}
+				old := getPath(item, p)
+				if old == nil {
+					old = &dynamodb.AttributeValue{N: aws.String("0")}
+				}
+				n, err := arith(old, v, 1)
+				if err != nil {
+					return nil, err
+				}
+				if err := setPath(item, p, n); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, validation("unsupported update clause %q", clause)
+			}
+
+			if x.peek() != "," {
+				break
+			}
+			x.next()
+		}
+	}
+
+	return updated, nil
+}
+
+// Project returns the attributes of an item in a projection expression
+// A nested path like a.b projects all of its top level attribute a.
+func Project(item map[string]*dynamodb.AttributeValue, projection *string, names map[string]*string) (map[string]*dynamodb.AttributeValue, error) {
+	if projection == nil || item == nil {
+		return item, nil
+	}
+
+	x := &expr{names: names, toks: tokens(*projection)}
+	attrs := []string{}
+
+	for x.pos < len(x.toks) {
+		p, err := x.path()
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, p[0].name)
+
+		if x.pos < len(x.toks) {
+			if err := x.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return Attributes(item, attrs), nil
+}
+
+// tokens splits an expression into names, placeholders, numbers and operators
+func tokens(s string) []string {
+	toks := []string{}
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("(),.[]=+-", c):
+			toks = append(toks, string(c))
+			i++
+		case c == '<' || c == '>':
+			if i+1 < len(s) && (s[i+1] == '=' || (c == '<' && s[i+1] == '>')) {
+				toks = append(toks, s[i:i+2])
+				i += 2
+			} else {
+				toks = append(toks, string(c))
+				i++
+			}
+		default:
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		}
+	}
+	return toks
+}
+
+func (x *expr) peek() string {
+	if x.pos < len(x.toks) {
+		return x.toks[x.pos]
+	}
+	return ""
+}
+
+func (x *expr) next() string {
+	t := x.peek()
+	x.pos++
+	return t
+}
+
+func (x *expr) expect(t string) error {
+	if got := x.next(); got != t {
+		return validation("expected %q got %q", t, got)
+	}
+	return nil
+}
+
+func (x *expr) keyword(k string) bool {
+	if strings.EqualFold(x.peek(), k) {
+		x.pos++
+		return true
+	}
+	return false
+}
+
+func (x *expr) name(t string) (string, error) {
+	if strings.HasPrefix(t, "#") {
+		n, ok := x.names[t]
+		if !ok {
+			return "", validation("missing expression attribute name %s", t)
+		}
+		return *n, nil
+	}
+	return t, nil
+}
+
+func (x *expr) path() ([]pathPart, error) {
+	n, err := x.name(x.next())
+	if err != nil {
+		return nil, err
+	}
+	p := []pathPart{{name: n}}
+
+	for {
+		switch x.peek() {
+		case ".":
+			x.next()
+			n, err := x.name(x.next())
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, pathPart{name: n})
+		case "[":
+			x.next()
+			i, err := strconv.Atoi(x.next())
+			if err != nil {
+				return nil, validation("invalid list index")
+			}
+			if err := x.expect("]"); err != nil {
+				return nil, err
+			}
+			p = append(p, pathPart{index: i, name: ""})
+		default:
+			return p, nil
+		}
+	}
+}
+
+func (x *expr) or(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	ok, err := x.and(item)
+	for err == nil && x.keyword("OR") {
+		var r bool
+		r, err = x.and(item)
+		ok = ok || r
+	}
+	return ok, err
+}
+
+func (x *expr) and(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	ok, err := x.not(item)
+	for err == nil && x.keyword("AND") {
+		var r bool
+		r, err = x.not(item)
+		ok = ok && r
+	}
+	return ok, err
+}
+
+func (x *expr) not(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	if x.keyword("NOT") {
+		ok, err := x.not(item)
+		return !ok, err
+	}
+	return x.primary(item)
+}
+
+func (x *expr) primary(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	if x.peek() == "(" {
+		x.next()
+		ok, err := x.or(item)
+		if err != nil {
+			return false, err
+		}
+		return ok, x.expect(")")
+	}
+
+	switch f := x.peek(); f {
+	case "attribute_exists", "attribute_not_exists":
+		x.next()
+		if err := x.expect("("); err != nil {
+			return false, err
+		}
+		p, err := x.path()
+		if err != nil {
+			return false, err
+		}
+		exists := getPath(item, p) != nil
+		return exists == (f == "attribute_exists"), x.expect(")")
+	case "begins_with", "contains":
+		x.next()
+		if err := x.expect("("); err != nil {
+			return false, err
+		}
+		a, err := x.operand(item)
+		if err != nil {
+			return false, err
+		}
+		if err := x.expect(","); err != nil {
+			return false, err
+		}
+		b, err := x.operand(item)
+		if err != nil {
+			return false, err
+		}
+		if a == nil || b == nil {
+			return false, x.expect(")")
+		}
+		if f == "begins_with" {
+			return a.S != nil && b.S != nil && strings.HasPrefix(*a.S, *b.S), x.expect(")")
+		}
+		if a.S != nil && b.S != nil {
+			return strings.Contains(*a.S, *b.S), x.expect(")")
+		}
+		for _, v := range append(a.L, setMembers(a)...) {
+			if compare(v, b) == 0 {
+				return true, x.expect(")")
+			}
+		}
+		return false, x.expect(")")
+	}
+
+	a, err := x.operand(item)
+	if err != nil {
+		return false, err
+	}
+
+	if x.keyword("BETWEEN") {
+		lo, err := x.operand(item)
+		if err != nil {
+			return false, err
+		}
+		if !x.keyword("AND") {
+			return false, validation("expected AND in BETWEEN")
+		}
+		hi, err := x.operand(item)
+		if err != nil {
+			return false, err
+		}
+		return a != nil && compare(a, lo) >= 0 && compare(a, hi) <= 0, nil
+	}
+
+	if x.keyword("IN") {
+		if err := x.expect("("); err != nil {
+			return false, err
+		}
+		in := false
+		for {
+			v, err := x.operand(item)
+			if err != nil {
+				return false, err
+			}
+			in = in || (a != nil && compare(a, v) == 0)
+			if x.peek() != "," {
+				break
+			}
+			x.next()
+		}
+		return in, x.expect(")")
+	}
+
+	op := x.next()
+	b, err := x.operand(item)
+	if err != nil {
+		return false, err
+	}
+	if a == nil || b == nil {
+		return op == "<>" && (a != nil || b != nil), nil
+	}
+
+	c := compare(a, b)
+	switch op {
+	case "=":
+		return c == 0, nil
+	case "<>":
+		return c != 0, nil
+	case "<":
+		return c == -1, nil
+	case "<=":
+		return c == -1 || c == 0, nil
+	case ">":
+		return c == 1, nil
+	case ">=":
+		return c == 1 || c == 0, nil
+	}
+	return false, validation("unsupported comparator %q", op)
+}
+
+// operand returns the value of a placeholder, path or size function, or nil if a path doesn't exist
+func (x *expr) operand(item map[string]*dynamodb.AttributeValue) (*dynamodb.AttributeValue, error) {
+	t := x.peek()
+
+	if strings.HasPrefix(t, ":") {
+		x.next()
+		v, ok := x.values[t]
+		if !ok {
+			return nil, validation("missing expression attribute value %s", t)
+		}
+		return v, nil
+	}
+
+	if t == "size" {
+		x.next()
+		if err := x.expect("("); err != nil {
+			return nil, err
+		}
+		p, err := x.path()
+		if err != nil {
+			return nil, err
+		}
+		v := getPath(item, p)
+		if v == nil {
+			return nil, x.expect(")")
+		}
+		n := len(v.L) + len(v.M) + len(setMembers(v)) + len(v.B)
+		if v.S != nil {
+			n = len(*v.S)
+		}
+		return &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(n))}, x.expect(")")
+	}
+
+	p, err := x.path()
+	if err != nil {
+		return nil, err
+	}
+	return getPath(item, p), nil
+}
+
+// setValue returns the value of the right hand side of a SET action
+func (x *expr) setValue(item map[string]*dynamodb.AttributeValue) (*dynamodb.AttributeValue, error) {
+	a, err := x.setTerm(item)
+	if err != nil {
+		return nil, err
+	}
+
+	switch x.peek() {
+	case "+", "-":
+		sign := 1
+		if x.next() == "-" {
+			sign = -1
+		}
+		b, err := x.setTerm(item)
+		if err != nil {
+			return nil, err
+		}
+		return arith(a, b, sign)
+	}
+	return a, nil
+}
+
+func (x *expr) setTerm(item map[string]*dynamodb.AttributeValue) (*dynamodb.AttributeValue, error) {
+	switch x.peek() {
+	case "if_not_exists":
+		x.next()
+		if err := x.expect("("); err != nil {
+			return nil, err
+		}
+		p, err := x.path()
+		if err != nil {
+			return nil, err
+		}
+		if err := x.expect(","); err != nil {
+			return nil, err
+		}
+		v, err := x.operand(item)
+		if err != nil {
+			return nil, err
+		}
+		if cur := getPath(item, p); cur != nil {
+			v = cur
+		}
+		return v, x.expect(")")
+	case "list_append":
+		x.next()
+		if err := x.expect("("); err != nil {
+			return nil, err
+		}
+		a, err := x.setTerm(item)
+		if err != nil {
+			return nil, err
+		}
+		if err := x.expect(","); err != nil {
+			return nil, err
+		}
+		b, err := x.setTerm(item)
+		if err != nil {
+			return nil, err
+		}
+		if a == nil || b == nil {
+			return nil, validation("list_append of a missing attribute")
+		}
+		l := append(append([]*dynamodb.AttributeValue{}, a.L...), b.L...)
+		return &dynamodb.AttributeValue{L: l}, x.expect(")")
+	}
+
+	v, err := x.operand(item)
+	if err == nil && v == nil {
+		err = validation("the provided expression refers to an attribute that does not exist in the item")
+	}
+	return v, err
+}
+
+func arith(a, b *dynamodb.AttributeValue, sign int) (*dynamodb.AttributeValue, error) {
+	if a == nil || b == nil || a.N == nil || b.N == nil {
+		return nil, validation("an operand in the update expression has an incorrect data type")
+	}
+	fa, _ := strconv.ParseFloat(*a.N, 64)
+	fb, _ := strconv.ParseFloat(*b.N, 64)
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatFloat(fa+float64(sign)*fb, 'f', -1, 64))}, nil
+}
+
+// compare returns -1, 0 or 1 comparing two values, or 2 if they are not comparable
+func compare(a, b *dynamodb.AttributeValue) int {
+	switch {
+	case a.N != nil && b.N != nil:
+		fa, _ := strconv.ParseFloat(*a.N, 64)
+		fb, _ := strconv.ParseFloat(*b.N, 64)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	case a.S != nil && b.S != nil:
+		return strings.Compare(*a.S, *b.S)
+	case reflect.DeepEqual(a, b):
+		return 0
+	}
+	return 2
+}
+
+func setMembers(v *dynamodb.AttributeValue) []*dynamodb.AttributeValue {
+	vs := []*dynamodb.AttributeValue{}
+	for _, s := range v.SS {
+		vs = append(vs, &dynamodb.AttributeValue{S: s})
+	}
+	for _, n := range v.NS {
+		vs = append(vs, &dynamodb.AttributeValue{N: n})
+	}
+	return vs
+}
+
+func getPath(item map[string]*dynamodb.AttributeValue, p []pathPart) *dynamodb.AttributeValue {
+	v := item[p[0].name]
+	for _, part := range p[1:] {
+		switch {
+		case v == nil:
+			return nil
+		case part.name != "":
+			v = v.M[part.name]
+		case part.index < len(v.L):
+			v = v.L[part.index]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+func setPath(item map[string]*dynamodb.AttributeValue, p []pathPart, v *dynamodb.AttributeValue) error {
+	if len(p) == 1 {
+		item[p[0].name] = v
+		return nil
+	}
+
+	parent := getPath(item, p[:len(p)-1])
+	last := p[len(p)-1]
+	switch {
+	case parent == nil:
+		return validation("the document path provided in the update expression is invalid for update")
+	case last.name != "":
+		if parent.M == nil {
+			return validation("the document path provided in the update expression is invalid for update")
+		}
+		parent.M[last.name] = v
+	case last.index < len(parent.L):
+		parent.L[last.index] = v
+	default:
+		parent.L = append(parent.L, v)
+	}
+	return nil
+}
+
+func removePath(item map[string]*dynamodb.AttributeValue, p []pathPart) {
+	if len(p) == 1 {
+		delete(item, p[0].name)
+		return
+	}
+
+	parent := getPath(item, p[:len(p)-1])
+	last := p[len(p)-1]
+	switch {
+	case parent == nil:
+	case last.name != "":
+		delete(parent.M, last.name)
+	case last.index < len(parent.L):
+		parent.L = append(parent.L[:last.index:last.index], parent.L[last.index+1:]...)
+	}
+}
+
+// Copy deep copies an item so a failed update leaves it unchanged
+func Copy(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	if item == nil {
+		return nil
+	}
+
+	c := make(map[string]*dynamodb.AttributeValue, len(item))
+	for k, v := range item {
+		c[k] = copyValue(v)
+	}
+	return c
+}
+
+func copyValue(v *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	c := *v
+	if v.M != nil {
+		c.M = Copy(v.M)
+	}
+	if v.L != nil {
+		c.L = make([]*dynamodb.AttributeValue, len(v.L))
+		for i, e := range v.L {
+			c.L[i] = copyValue(e)
+		}
+	}
+	c.NS = append([]*string(nil), v.NS...)
+	c.SS = append([]*string(nil), v.SS...)
+	return &c
+}
+
+// Attributes returns the named top level attributes of an item
+func Attributes(item map[string]*dynamodb.AttributeValue, names []string) map[string]*dynamodb.AttributeValue {
+	sort.Strings(names)
+	attrs := map[string]*dynamodb.AttributeValue{}
+	for _, n := range names {
+		if v, ok := item[n]; ok {
+			attrs[n] = v
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,231 @@
+package dynamodbtest
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCondition(t *testing.T) {
+	item := testItem(t, map[string]interface{}{
+		"id":     "a",
+		"count":  5,
+		"list":   []interface{}{"x", "y"},
+		"map":    map[string]interface{}{"key": "value"},
+		"status": "running",
+	})
+	item["set"] = &dynamodb.AttributeValue{SS: aws.StringSlice([]string{"p", "q"})}
+
+	names := aws.StringMap(map[string]string{"#status": "status", "#key": "key"})
+	values := testItem(t, map[string]interface{}{
+		":five":    5,
+		":four":    4,
+		":p":       "p",
+		":queued":  "queued",
+		":run":     "run",
+		":running": "running",
+		":six":     6,
+		":x":       "x",
+	})
+
+	for cond, want := range map[string]bool{
+		"#status = :running":                                   true,
+		"#status <> :running":                                  false,
+		"#status = :queued":                                    false,
+		"#status IN (:queued, :running)":                       true,
+		"#status IN (:queued)":                                 false,
+		"count < :six":                                         true,
+		"count <= :five":                                       true,
+		"count > :five":                                        false,
+		"count >= :five":                                       true,
+		"count BETWEEN :four AND :six":                         true,
+		"count BETWEEN :six AND :six":                          false,
+		"attribute_exists(id)":                                 true,
+		"attribute_not_exists(id)":                             false,
+		"attribute_exists(map.#key)":                           true,
+		"attribute_exists(map.missing)":                        false,
+		"attribute_exists(list[1])":                            true,
+		"attribute_exists(list[2])":                            false,
+		"attribute_not_exists(missing.nested)":                 true,
+		"begins_with(#status, :run)":                           true,
+		"begins_with(missing, :run)":                           false,
+		"contains(#status, :run)":                              true,
+		"contains(list, :x)":                                   true,
+		"contains(list, :p)":                                   false,
+		"contains(set, :p)":                                    true,
+		"size(list) = :four":                                   false,
+		"size(#status) > :six":                                 true,
+		"missing = :x":                                         false,
+		"missing <> :x":                                        true,
+		"NOT #status = :queued":                                true,
+		"#status = :queued OR count = :five":                   true,
+		"#status = :queued OR count = :five AND id = :x":       false,
+		"(#status = :queued OR count = :five) AND NOT id = :x": true,
+	} {
+		ok, err := Condition(item, aws.String(cond), names, values)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, want, ok, cond)
+	}
+
+	ok, err := Condition(item, nil, nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = Condition(nil, aws.String("attribute_not_exists(id)"), nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	for cond, msg := range map[string]string{
+		"#missing = :x":       "ValidationException: missing expression attribute name #missing",
+		"id = :missing":       "ValidationException: missing expression attribute value :missing",
+		"id = :x :x":          `ValidationException: unexpected ":x" in condition "id = :x :x"`,
+		"(id = :x":            `ValidationException: expected ")" got ""`,
+		"count BETWEEN :four": "ValidationException: expected AND in BETWEEN",
+		"id ~ :x":             `ValidationException: unsupported comparator "~"`,
+	} {
+		_, err := Condition(item, aws.String(cond), names, values)
+		assert.EqualError(t, err, msg, cond)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	item := testItem(t, map[string]interface{}{
+		"id":    "a",
+		"count": 5,
+		"list":  []interface{}{"x", "y"},
+		"map":   map[string]interface{}{"key": "value"},
+		"old":   "remove me",
+	})
+
+	names := aws.StringMap(map[string]string{"#key": "key"})
+	values := testItem(t, map[string]interface{}{
+		":one":  1,
+		":ten":  10,
+		":z":    []interface{}{"z"},
+		":new":  "new",
+		":zero": 0,
+	})
+
+	updated, err := Update(item, aws.String(
+		"SET count = count + :one, total = if_not_exists(total, :zero) - :one, list = list_append(list, :z), "+
+			"map.#key = :new, map.other = :new "+
+			"REMOVE old, list[0] "+
+			"ADD added :ten, count :ten",
+	), names, values)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"count", "total", "list", "map", "map", "old", "list", "added", "count"}, updated)
+	assert.Equal(t, testItem(t, map[string]interface{}{
+		"id":    "a",
+		"added": 10,
+		"count": 16,
+		"list":  []interface{}{"y", "z"},
+		"map":   map[string]interface{}{"key": "new", "other": "new"},
+		"total": -1,
+	}), item)
+
+	// if_not_exists keeps an existing value
+	_, err = Update(item, aws.String("SET total = if_not_exists(total, :ten)"), nil, values)
+	assert.NoError(t, err)
+	assert.Equal(t, "-1", aws.StringValue(item["total"].N))
+
+	// list indexes past the end append
+	_, err = Update(item, aws.String("SET list[1] = :new, list[5] = :new"), nil, values)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"y", "new", "new"}, testValue(t, item["list"]))
+
+	updated, err = Update(item, nil, nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, updated)
+
+	for update, msg := range map[string]string{
+		"SET missing.nested = :new":           "ValidationException: the document path provided in the update expression is invalid for update",
+		"SET id.nested = :new":                "ValidationException: the document path provided in the update expression is invalid for update",
+		"SET count = missing + :one":          "ValidationException: the provided expression refers to an attribute that does not exist in the item",
+		"SET count = id + :one":               "ValidationException: an operand in the update expression has an incorrect data type",
+		"SET list = list_append(missing, :z)": "ValidationException: the provided expression refers to an attribute that does not exist in the item",
+		"SET count :one":                      `ValidationException: expected "=" got ":one"`,
+		"DELETE set :z":                       `ValidationException: unsupported update clause "DELETE"`,
+	} {
+		_, err := Update(Copy(item), aws.String(update), names, values)
+		assert.EqualError(t, err, msg, update)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	item := testItem(t, map[string]interface{}{
+		"list": []interface{}{map[string]interface{}{"key": "value"}},
+		"map":  map[string]interface{}{"key": "value"},
+	})
+	item["set"] = &dynamodb.AttributeValue{SS: aws.StringSlice([]string{"p"})}
+
+	c := Copy(item)
+	assert.Equal(t, item, c)
+
+	c["list"].L[0].M["key"].S = aws.String("changed")
+	c["map"].M["key"] = &dynamodb.AttributeValue{S: aws.String("changed")}
+	c["set"].SS[0] = aws.String("changed")
+	assert.Equal(t, "value", aws.StringValue(item["list"].L[0].M["key"].S))
+	assert.Equal(t, "value", aws.StringValue(item["map"].M["key"].S))
+	assert.Equal(t, "p", aws.StringValue(item["set"].SS[0]))
+
+	assert.Nil(t, Copy(nil))
+	assert.Equal(t, map[string]*dynamodb.AttributeValue{"map": item["map"]}, Attributes(item, []string{"missing", "map"}))
+}
+
+func TestProject(t *testing.T) {
+	item := testItem(t, map[string]interface{}{
+		"id":     "a",
+		"input":  []interface{}{1, 2, 3},
+		"map":    map[string]interface{}{"key": "value", "other": "value"},
+		"status": "running",
+	})
+	names := aws.StringMap(map[string]string{"#status": "status"})
+
+	attrs, err := Project(item, aws.String("#status, map.key, missing"), names)
+	assert.NoError(t, err)
+	assert.Equal(t, testItem(t, map[string]interface{}{
+		"map":    map[string]interface{}{"key": "value", "other": "value"},
+		"status": "running",
+	}), attrs)
+
+	attrs, err = Project(item, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, item, attrs)
+
+	attrs, err = Project(nil, aws.String("id"), nil)
+	assert.NoError(t, err)
+	assert.Nil(t, attrs)
+
+	_, err = Project(item, aws.String("#missing"), names)
+	assert.EqualError(t, err, "ValidationException: missing expression attribute name #missing")
+
+	_, err = Project(item, aws.String("id status"), names)
+	assert.EqualError(t, err, `ValidationException: expected "," got "status"`)
+}
+
+func TestErrConditionalCheckFailed(t *testing.T) {
+	aerr, ok := ErrConditionalCheckFailed.(awserr.Error)
+	if assert.True(t, ok) {
+		assert.Equal(t, dynamodb.ErrCodeConditionalCheckFailedException, aerr.Code())
+	}
+}
+
+func testItem(t *testing.T, in map[string]interface{}) map[string]*dynamodb.AttributeValue {
+	item, err := dynamodbattribute.MarshalMap(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return item
+}
+
+func testValue(t *testing.T, av *dynamodb.AttributeValue) interface{} {
+	var v interface{}
+	if err := dynamodbattribute.Unmarshal(av, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
@@ -0,0 +1,394 @@
+package gofaas
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fanOutMaxShards limits how many shards a job splits into so its shard status fits in the job item
+var fanOutMaxShards = 1000
+
+// fanOutConcurrency returns how many shards of a job run at once
+func fanOutConcurrency() int {
+	if Config.FanOut.Concurrency > 0 {
+		return Config.FanOut.Concurrency
+	}
+	return 10
+}
+
+// fanOutChunks splits the input array of a fan-out job into chunks of its chunk size
+func fanOutChunks(j *Job) ([][]json.RawMessage, error) {
+	items := []json.RawMessage{}
+	if err := json.Unmarshal(j.Input, &items); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	size := j.ChunkSize
+	if size < 1 {
+		size = 1
+	}
+
+	chunks := [][]json.RawMessage{}
+	for i := 0; i < len(items); i += size {
+		end := i + size
+		if end > len(items) {
+			end = len(items)
+		}
+		chunks = append(chunks, items[i:end])
+	}
+	return chunks, nil
+}
+
+// fanOut coordinates a queued fan-out job, sending its shards to the worker up to the concurrency cap
+// Each shard that finishes starts the next one in the queue, and the last one to finish runs fanIn.
+// A retried job sends only the shards that didn't succeed, or goes straight to fanIn if they all did.
+func fanOut(ctx context.Context, e WorkerEvent, j *Job) error {
+	names := map[string]string{"#error": "error", "#status": "status"}
+	values := map[string]interface{}{
+		":now":     time.Now(),
+		":queued":  JobQueued,
+		":running": JobRunning,
+		":zero":    0,
+	}
+	set := "SET #status = :running, time_start = :now, shards_failed = :zero, shards_next = :next"
+	remove := " REMOVE #error, time_end"
+
+	shards := []int{}
+	if j.Shards == 0 {
+		chunks, err := fanOutChunks(j)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		status := map[string]JobStatus{}
+		for n := 1; n <= len(chunks); n++ {
+			shards = append(shards, n)
+			status[strconv.Itoa(n)] = JobQueued
+		}
+
+		set += ", shards = :shards, shards_succeeded = :zero, shard_status = :status, shard_errors = :errors"
+		values[":errors"] = jobEmptyMap{}
+		values[":shards"] = len(chunks)
+		values[":status"] = status
+	} else {
+		for n := 1; n <= j.Shards; n++ {
+			s := strconv.Itoa(n)
+			if j.ShardStatus[s] == JobSucceeded {
+				continue
+			}
+
+			shards = append(shards, n)
+			names["#s"+s] = s
+			set += fmt.Sprintf(", shard_status.#s%s = :queued", s)
+			remove += fmt.Sprintf(", shard_errors.#s%s", s)
+		}
+	}
+
+	next := fanOutConcurrency()
+	if next > len(shards) {
+		next = len(shards)
+	}
+	values[":next"] = next
+
+	if len(shards) > next {
+		set += ", shards_queue = :queue"
+		values[":queue"] = shards
+	} else {
+		remove += ", shards_queue"
+	}
+
+	j, err := jobUpdate(ctx, j.ID, set+remove, "#status = :queued", names, values)
+	if err != nil {
+		if jobConflict(err) {
+			log.Printf("Worker job %s already started\n", e.JobID)
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+
+	quotaRenew(ctx, j)
+	log.Printf("Worker job %s fanning out %d of %d shards\n", j.ID, len(shards), j.Shards)
+
+	if len(shards) == 0 {
+		return fanIn(ctx, j)
+	}
+
+	for _, n := range shards[:next] {
+		if err := shardSend(ctx, e, n); err != nil {
+			return jobFail(ctx, j.ID, err)
+		}
+	}
+	return nil
+}
+
+// runShard performs the work for a chunk of a fan-out job
+// If retry is set a shard that fails is left running for the queue to retry, otherwise it is failed
+func runShard(ctx context.Context, e WorkerEvent, retry bool) error {
+	s := strconv.Itoa(e.Shard)
+
+	j, err := jobUpdate(ctx, e.JobID,
+		"SET shard_status.#shard = :running",
+		"shard_status.#shard IN (:queued, :running) AND #status = :running",
+		map[string]string{"#shard": s, "#status": "status"},
+		map[string]interface{}{":queued": JobQueued, ":running": JobRunning},
+	)
+	if err != nil {
+		if jobConflict(err) {
+			log.Printf("Worker job %s shard %s already finished or cancelled\n", e.JobID, s)
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+
+	if j.CancelRequested {
+		return jobCancel(ctx, j)
+	}
+	quotaRenew(ctx, j)
+
+	wctx, cancel := WithJobCancel(ctx, j.ID)
+	err = workShard(wctx, j, e.Shard)
+	cancel()
+
+	if JobCancelRequested(wctx) {
+		return jobCancel(ctx, j)
+	}
+	if err != nil && retry {
+		return errors.WithStack(err)
+	}
+
+	return shardFinish(ctx, e, err)
+}
+
+// shardFinish atomically marks a shard succeeded or failed, starts the next queued shard,
+// then runs fanIn if it was the last shard to finish
+// It returns the error of a failed shard, or an error for the job if any shard failed
+func shardFinish(ctx context.Context, e WorkerEvent, errShard error) error {
+	s := strconv.Itoa(e.Shard)
+
+	names := map[string]string{"#shard": s}
+	values := map[string]interface{}{
+		":one":       1,
+		":queued":    JobQueued,
+		":running":   JobRunning,
+		":succeeded": JobSucceeded,
+	}
+	update := "SET shard_status.#shard = :succeeded ADD shards_succeeded :one"
+
+	if errShard != nil {
+		values[":error"] = errShard.Error()
+		values[":failed"] = JobFailed
+		update = "SET shard_status.#shard = :failed, shard_errors.#shard = :error ADD shards_failed :one"
+	}
+
+	names["#status"] = "status"
+	j, err := jobUpdate(ctx, e.JobID, update, "shard_status.#shard IN (:queued, :running) AND #status = :running", names, values)
+	if err != nil {
+		if jobConflict(err) {
+			log.Printf("Worker job %s shard %s already finished or cancelled\n", e.JobID, s)
+			return shardCancelled(ctx, e)
+		}
+		return errors.WithStack(err)
+	}
+
+	if err := shardNext(ctx, e); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if j.ShardsSucceeded+j.ShardsFailed < j.Shards {
+		return errors.WithStack(errShard)
+	}
+
+	if j.ShardsFailed > 0 {
+		return jobFail(ctx, j.ID, errors.Errorf("job %s %d of %d shards failed", j.ID, j.ShardsFailed, j.Shards))
+	}
+
+	return fanIn(ctx, j)
+}
+
+// shardCancelled deletes the output of a shard that finished after its job was cancelled
+func shardCancelled(ctx context.Context, e WorkerEvent) error {
+	j, err := jobGet(ctx, e.JobID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if j.Status != JobCancelled {
+		return nil
+	}
+
+	key, _, err := reportKey(shardEvent(j), shardID(j, e.Shard))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return reportDelete(ctx, []string{key})
+}
+
+// shardNext claims the next shard in the queue of a job and sends it
+func shardNext(ctx context.Context, e WorkerEvent) error {
+	j, err := jobUpdate(ctx, e.JobID,
+		"ADD shards_next :one",
+		"shards_next < size(shards_queue)",
+		nil,
+		map[string]interface{}{":one": 1},
+	)
+	if err != nil {
+		if jobConflict(err) {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+
+	return shardSend(ctx, e, j.ShardsQueue[j.ShardsNext-1])
+}
+
+// shardRequeue queues a failed shard again so a redriven message can run it
+// The job's quota_held attribute is set from j, since a failed job takes its concurrent slot again.
+func shardRequeue(ctx context.Context, j *Job, shard int) error {
+	_, err := jobUpdate(ctx, j.ID,
+		"SET shard_status.#shard = :queued, #status = :running, quota_held = :held ADD shards_failed :minus REMOVE shard_errors.#shard, time_end, #error",
+		"shard_status.#shard = :failed AND #status = :status",
+		map[string]string{"#error": "error", "#shard": strconv.Itoa(shard), "#status": "status"},
+		map[string]interface{}{":failed": JobFailed, ":held": j.QuotaHeld, ":minus": -1, ":queued": JobQueued, ":running": JobRunning, ":status": j.Status},
+	)
+	return errors.WithStack(err)
+}
+
+// shardSend sends a shard of a job back to the worker
+func shardSend(ctx context.Context, e WorkerEvent, shard int) error {
+	e.Continuation = nil
+	e.Input = nil
+	e.Shard = shard
+	return workerSend(ctx, e)
+}
+
+// workShard performs the work for each item in the chunk of a shard and streams the results to S3
+func workShard(ctx context.Context, j *Job, shard int) error {
+	chunks, err := fanOutChunks(j)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if shard < 1 || shard > len(chunks) {
+		return errors.Errorf("job %s has no shard %d", j.ID, shard)
+	}
+
+	w, err := NewReportWriter(ctx, shardEvent(j), shardID(j, shard))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, item := range chunks[shard-1] {
+		if err := ctx.Err(); err != nil {
+			return w.Abort(err)
+		}
+
+		// perform work on item here
+		if err := w.Write(item); err != nil {
+			return w.Abort(err)
+		}
+	}
+
+	return w.Close()
+}
+
+// fanIn reduces the shard outputs of a job into one report, then marks the job succeeded or failed
+func fanIn(ctx context.Context, j *Job) error {
+	key, err := reduce(ctx, j)
+	if err != nil {
+		return jobFail(ctx, j.ID, err)
+	}
+
+	_, err = jobUpdate(ctx, j.ID,
+		"SET #status = :succeeded, report_key = :key, time_end = :now",
+		"#status = :running",
+		map[string]string{"#status": "status"},
+		map[string]interface{}{":key": key, ":now": time.Now(), ":running": JobRunning, ":succeeded": JobSucceeded},
+	)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	quotaRelease(ctx, j.ID)
+
+	shardCleanup(ctx, j)
+	return nil
+}
+
+// reduce merges the shard outputs of a job in order into a report in the format of the job
+func reduce(ctx context.Context, j *Job) (string, error) {
+	w, err := NewReportWriter(ctx, WorkerEvent{
+		Format:    j.Format,
+		Gzip:      j.Gzip,
+		JobID:     j.ID,
+		Subject:   j.Subject,
+		TimeStart: j.TimeCreated,
+	}, j.ID)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	for _, key := range shardKeys(j) {
+		if err := reportCopy(ctx, w, key); err != nil {
+			return "", w.Abort(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return w.Key, nil
+}
+
+// shardCleanup deletes the shard outputs of a job once they are reduced
+func shardCleanup(ctx context.Context, j *Job) {
+	if err := reportDelete(ctx, shardKeys(j)); err != nil {
+		log.Printf("Worker job %s shard cleanup error %+v\n", j.ID, err)
+	}
+}
+
+// shardKeys returns the keys of the shard outputs of a job in order
+func shardKeys(j *Job) []string {
+	keys := []string{}
+	for n := 1; n <= j.Shards; n++ {
+		key, _, err := reportKey(shardEvent(j), shardID(j, n))
+		if err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// shardEvent returns the event shard outputs are written for, always NDJSON so they can be streamed back
+func shardEvent(j *Job) WorkerEvent {
+	return WorkerEvent{
+		Format:    "ndjson",
+		JobID:     j.ID,
+		Subject:   j.Subject,
+		TimeStart: j.TimeCreated,
+	}
+}
+
+func shardID(j *Job, shard int) string {
+	return fmt.Sprintf("%s/shards/%04d", j.ID, shard)
+}
+
+// jobFail marks a running job failed with an error, returning the error
+func jobFail(ctx context.Context, id string, err error) error {
+	_, errUpdate := jobUpdate(ctx, id,
+		"SET #status = :failed, #error = :error, time_end = :now",
+		"#status = :running",
+		map[string]string{"#error": "error", "#status": "status"},
+		map[string]interface{}{":error": err.Error(), ":failed": JobFailed, ":now": time.Now(), ":running": JobRunning},
+	)
+	if errUpdate != nil && !jobConflict(errUpdate) {
+		log.Printf("Worker job %s fail error %+v\n", id, errUpdate)
+	}
+	if errUpdate == nil {
+		quotaRelease(ctx, id)
+	}
+	return errors.WithStack(err)
+}
@@ -0,0 +1,172 @@
+package gofaas
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFanOut(t *testing.T) {
+	Config.Continue.FunctionName = "gofaas-WorkerFunction"
+	Config.FanOut.Concurrency = 2
+	Config.Jobs.TableName = "gofaas-JobsTable"
+	Config.Work.WorkerFunctionName = "gofaas-WorkerFunction"
+	Config.Worker.Bucket = "gofaas-bucket"
+	defer func() {
+		Config.Continue.FunctionName = ""
+		Config.FanOut.Concurrency = 0
+	}()
+
+	UUIDGen = func() uuid.UUID {
+		return uuid.Must(uuid.FromString("26f0dc9f-4483-4b65-8724-3d1598ff6d14"))
+	}
+
+	ml := &MockLambda{}
+	ms3 := &MockS3{}
+
+	DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+	Lambda = ml
+	S3 = FaultS3{ms3, &Faults{Faults: []Fault{{Op: "PutObject", Call: 2, Err: ErrAccessDenied()}}}}
+
+	ctx := context.Background()
+
+	r, err := WorkCreate(ctx, events.APIGatewayProxyRequest{
+		Body:                  `[{"n": 1}, {"n": 2}, {"n": 3}, {"n": 4}, {"n": 5}, {"n": 6}, {"n": 7}]`,
+		QueryStringParameters: map[string]string{"chunk_size": "2", "format": "csv"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+
+	// the coordinator sends the first 2 of 4 shards, and each shard that finishes sends the next
+	// the second shard fails, then the last shard to finish fails the job
+	errs := fanOutRun(t, ml)
+	if assert.Len(t, errs, 2) {
+		assert.Contains(t, errs[0].Error(), "AccessDeniedException")
+		assert.Contains(t, errs[1].Error(), "1 of 4 shards failed")
+	}
+
+	j := workQueueJob(t, "26f0dc9f-4483-4b65-8724-3d1598ff6d14")
+	assert.Equal(t, JobFanOut, j.Type)
+	assert.Equal(t, JobFailed, j.Status)
+	assert.Equal(t, "job 26f0dc9f-4483-4b65-8724-3d1598ff6d14 1 of 4 shards failed", j.Error)
+	assert.Equal(t, 4, j.Shards)
+	assert.Equal(t, 3, j.ShardsSucceeded)
+	assert.Equal(t, 1, j.ShardsFailed)
+	for s, status := range map[string]JobStatus{"1": JobSucceeded, "2": JobFailed, "3": JobSucceeded, "4": JobSucceeded} {
+		assert.Equal(t, status, j.ShardStatus[s], s)
+	}
+	assert.Contains(t, j.ShardErrors["2"], "AccessDeniedException")
+	assert.Empty(t, j.ReportURL)
+
+	// retrying only runs the failed shard, then reduces every shard into one report
+	r, err = WorkRetry(ctx, events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"id": "26f0dc9f-4483-4b65-8724-3d1598ff6d14"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+
+	n := len(ml.Inputs)
+	assert.Len(t, fanOutRun(t, ml), 0)
+	assert.Equal(t, n+1, len(ml.Inputs))
+
+	j = workQueueJob(t, "26f0dc9f-4483-4b65-8724-3d1598ff6d14")
+	assert.Equal(t, JobSucceeded, j.Status)
+	assert.Empty(t, j.Error)
+	assert.Equal(t, 4, j.ShardsSucceeded)
+	assert.Equal(t, 0, j.ShardsFailed)
+	assert.Empty(t, j.ShardErrors)
+	assert.Contains(t, j.ReportURL, "/26f0dc9f-4483-4b65-8724-3d1598ff6d14.csv?")
+
+	// the shard outputs are deleted after they are reduced
+	keys := mockKeys(ms3)
+	if assert.Len(t, keys, 1) {
+		assert.True(t, strings.HasSuffix(keys[0], "/26f0dc9f-4483-4b65-8724-3d1598ff6d14.csv"))
+		assert.Equal(t, "n\n1\n2\n3\n4\n5\n6\n7\n", string(ms3.Objects[keys[0]]))
+	}
+
+	r, err = WorkRetry(ctx, events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"id": "26f0dc9f-4483-4b65-8724-3d1598ff6d14"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 409, r.StatusCode)
+
+	r, err = WorkRetry(ctx, events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"id": "missing"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 404, r.StatusCode)
+}
+
+func TestFanOutInput(t *testing.T) {
+	Config.Jobs.TableName = "gofaas-JobsTable"
+	UUIDGen = uuid.NewV4
+
+	fanOutMaxShards = 3
+	defer func() { fanOutMaxShards = 1000 }()
+
+	DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+	Lambda = &MockLambda{}
+
+	cases := []struct {
+		body      string
+		chunkSize string
+		status    int
+		err       string
+	}{
+		{body: `[1, 2, 3]`, chunkSize: "1", status: 202},
+		{body: `[1, 2, 3]`, chunkSize: "0", status: 400, err: "is not a positive int"},
+		{body: `{"n": 1}`, chunkSize: "1", status: 400, err: "fan-out input is not a non-empty JSON array"},
+		{body: `[]`, chunkSize: "1", status: 400, err: "fan-out input is not a non-empty JSON array"},
+		{body: `[1, 2, 3, 4]`, chunkSize: "1", status: 400, err: "fan-out input splits into 4 shards, more than 3"},
+	}
+
+	for _, c := range cases {
+		r, err := WorkCreate(context.Background(), events.APIGatewayProxyRequest{
+			Body:                  c.body,
+			QueryStringParameters: map[string]string{"chunk_size": c.chunkSize},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, c.status, r.StatusCode, c.body)
+		assert.Contains(t, r.Body, c.err)
+	}
+
+	chunks, err := fanOutChunks(&Job{ChunkSize: 2, Input: json.RawMessage(`[1, 2, 3, 4, 5]`)})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]json.RawMessage{
+		{json.RawMessage("1"), json.RawMessage("2")},
+		{json.RawMessage("3"), json.RawMessage("4")},
+		{json.RawMessage("5")},
+	}, chunks)
+}
+
+// fanOutRun runs the worker for every async invoke until there are none left, returning the worker errors
+// It checks that no more shards are outstanding at once than the concurrency cap
+func fanOutRun(t *testing.T, ml *MockLambda) []error {
+	errs := []error{}
+
+	for i := len(ml.Inputs) - 1; i < len(ml.Inputs); i++ {
+		shards := 0
+		for _, in := range ml.Inputs[i:] {
+			e := WorkerEvent{}
+			assert.NoError(t, json.Unmarshal(in.Payload, &e))
+			if e.Shard > 0 {
+				shards++
+			}
+		}
+		assert.True(t, shards <= fanOutConcurrency(), "%d shards outstanding", shards)
+
+		e := WorkerEvent{}
+		assert.NoError(t, json.Unmarshal(ml.Inputs[i].Payload, &e))
+		if err := Worker(context.Background(), e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
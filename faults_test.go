@@ -0,0 +1,334 @@
+package gofaas
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/apigateway"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// Fault is a programmable failure for calls to an AWS client
+type Fault struct {
+	Op      string        // operation to fail, e.g. "PutItem", or "" for every operation
+	Call    int           // fail only the Nth matching call, or 0 for every matching call
+	Err     error         // error to return
+	Latency time.Duration // delay before the call, returning a canceled error if the context is done first
+}
+
+// Faults injects failures into calls to AWS clients wrapped with it
+type Faults struct {
+	Faults []Fault
+
+	calls map[string]int
+	mu    sync.Mutex
+}
+
+// inject counts a call to op then applies matching faults
+func (f *Faults) inject(ctx aws.Context, op string) error {
+	f.mu.Lock()
+	if f.calls == nil {
+		f.calls = map[string]int{}
+	}
+	f.calls[op]++
+	n := f.calls[op]
+	f.mu.Unlock()
+
+	for _, ft := range f.Faults {
+		if ft.Op != "" && ft.Op != op {
+			continue
+		}
+		if ft.Call != 0 && ft.Call != n {
+			continue
+		}
+
+		if ft.Latency > 0 {
+			select {
+			case <-time.After(ft.Latency):
+			case <-ctx.Done():
+				return awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+			}
+		}
+
+		if ft.Err != nil {
+			return ft.Err
+		}
+	}
+
+	return nil
+}
+
+// Calls returns how many times op was called
+func (f *Faults) Calls(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// ErrAccessDenied returns an AccessDeniedException like KMS and Lambda return
+func ErrAccessDenied() error {
+	return awserr.NewRequestFailure(awserr.New("AccessDeniedException", "User is not authorized to perform this operation", nil), 400, "fault")
+}
+
+// ErrThrottling returns a throttling exception with the given code, e.g. ProvisionedThroughputExceededException
+func ErrThrottling(code string) error {
+	return awserr.NewRequestFailure(awserr.New(code, "Rate exceeded", nil), 400, "fault")
+}
+
+// FaultAPIGateway wraps an APIGatewayAPI with Faults
+type FaultAPIGateway struct {
+	APIGatewayAPI
+	*Faults
+}
+
+func (f FaultAPIGateway) GetStageWithContext(ctx aws.Context, input *apigateway.GetStageInput, opts ...request.Option) (*apigateway.Stage, error) {
+	if err := f.inject(ctx, "GetStage"); err != nil {
+		return nil, err
+	}
+	return f.APIGatewayAPI.GetStageWithContext(ctx, input, opts...)
+}
+
+func (f FaultAPIGateway) UpdateStageWithContext(ctx aws.Context, input *apigateway.UpdateStageInput, opts ...request.Option) (*apigateway.Stage, error) {
+	if err := f.inject(ctx, "UpdateStage"); err != nil {
+		return nil, err
+	}
+	return f.APIGatewayAPI.UpdateStageWithContext(ctx, input, opts...)
+}
+
+// FaultDynamoDB wraps a DynamoDBAPI with Faults
+type FaultDynamoDB struct {
+	DynamoDBAPI
+	*Faults
+}
+
+func (f FaultDynamoDB) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	if err := f.inject(ctx, "DeleteItem"); err != nil {
+		return nil, err
+	}
+	return f.DynamoDBAPI.DeleteItemWithContext(ctx, input, opts...)
+}
+
+func (f FaultDynamoDB) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	if err := f.inject(ctx, "GetItem"); err != nil {
+		return nil, err
+	}
+	return f.DynamoDBAPI.GetItemWithContext(ctx, input, opts...)
+}
+
+func (f FaultDynamoDB) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	if err := f.inject(ctx, "PutItem"); err != nil {
+		return nil, err
+	}
+	return f.DynamoDBAPI.PutItemWithContext(ctx, input, opts...)
+}
+
+func (f FaultDynamoDB) ScanPagesWithContext(ctx aws.Context, input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	if err := f.inject(ctx, "Scan"); err != nil {
+		return err
+	}
+	return f.DynamoDBAPI.ScanPagesWithContext(ctx, input, fn, opts...)
+}
+
+func (f FaultDynamoDB) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	if err := f.inject(ctx, "UpdateItem"); err != nil {
+		return nil, err
+	}
+	return f.DynamoDBAPI.UpdateItemWithContext(ctx, input, opts...)
+}
+
+// FaultKMS wraps a KMSAPI with Faults
+type FaultKMS struct {
+	KMSAPI
+	*Faults
+}
+
+func (f FaultKMS) DecryptWithContext(ctx aws.Context, input *kms.DecryptInput, opts ...request.Option) (*kms.DecryptOutput, error) {
+	if err := f.inject(ctx, "Decrypt"); err != nil {
+		return nil, err
+	}
+	return f.KMSAPI.DecryptWithContext(ctx, input, opts...)
+}
+
+func (f FaultKMS) EncryptWithContext(ctx aws.Context, input *kms.EncryptInput, opts ...request.Option) (*kms.EncryptOutput, error) {
+	if err := f.inject(ctx, "Encrypt"); err != nil {
+		return nil, err
+	}
+	return f.KMSAPI.EncryptWithContext(ctx, input, opts...)
+}
+
+// FaultLambda wraps a LambdaAPI with Faults
+type FaultLambda struct {
+	LambdaAPI
+	*Faults
+}
+
+func (f FaultLambda) InvokeWithContext(ctx aws.Context, input *lambda.InvokeInput, opts ...request.Option) (*lambda.InvokeOutput, error) {
+	if err := f.inject(ctx, "Invoke"); err != nil {
+		return nil, err
+	}
+	return f.LambdaAPI.InvokeWithContext(ctx, input, opts...)
+}
+
+// FaultS3 wraps an S3API with Faults
+type FaultS3 struct {
+	S3API
+	*Faults
+}
+
+func (f FaultS3) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	if err := f.inject(ctx, "AbortMultipartUpload"); err != nil {
+		return nil, err
+	}
+	return f.S3API.AbortMultipartUploadWithContext(ctx, input, opts...)
+}
+
+func (f FaultS3) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	if err := f.inject(ctx, "CompleteMultipartUpload"); err != nil {
+		return nil, err
+	}
+	return f.S3API.CompleteMultipartUploadWithContext(ctx, input, opts...)
+}
+
+func (f FaultS3) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	if err := f.inject(ctx, "CreateMultipartUpload"); err != nil {
+		return nil, err
+	}
+	return f.S3API.CreateMultipartUploadWithContext(ctx, input, opts...)
+}
+
+func (f FaultS3) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	if err := f.inject(ctx, "DeleteObjects"); err != nil {
+		return nil, err
+	}
+	return f.S3API.DeleteObjectsWithContext(ctx, input, opts...)
+}
+
+func (f FaultS3) ListObjectsPagesWithContext(ctx aws.Context, input *s3.ListObjectsInput, fn func(*s3.ListObjectsOutput, bool) bool, opts ...request.Option) error {
+	if err := f.inject(ctx, "ListObjects"); err != nil {
+		return err
+	}
+	return f.S3API.ListObjectsPagesWithContext(ctx, input, fn, opts...)
+}
+
+func (f FaultS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	if err := f.inject(ctx, "GetObject"); err != nil {
+		return nil, err
+	}
+	return f.S3API.GetObjectWithContext(ctx, input, opts...)
+}
+
+// PutObjectRequest injects faults for "PutObject" when the request is sent
+func (f FaultS3) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	r, out := f.S3API.PutObjectRequest(input)
+	r.Handlers.Send.PushFront(func(r *request.Request) {
+		if err := f.inject(r.Context(), "PutObject"); err != nil {
+			r.Error = err
+		}
+	})
+	r.Handlers.Send.AfterEachFn = request.HandlerListStopOnError
+	return r, out
+}
+
+func (f FaultS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	if err := f.inject(ctx, "PutObject"); err != nil {
+		return nil, err
+	}
+	return f.S3API.PutObjectWithContext(ctx, input, opts...)
+}
+
+func (f FaultS3) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	if err := f.inject(ctx, "UploadPart"); err != nil {
+		return nil, err
+	}
+	return f.S3API.UploadPartWithContext(ctx, input, opts...)
+}
+
+// FaultSecretsManager wraps a SecretsManagerAPI with Faults
+type FaultSecretsManager struct {
+	SecretsManagerAPI
+	*Faults
+}
+
+func (f FaultSecretsManager) GetSecretValueWithContext(ctx aws.Context, input *secretsmanager.GetSecretValueInput, opts ...request.Option) (*secretsmanager.GetSecretValueOutput, error) {
+	if err := f.inject(ctx, "GetSecretValue"); err != nil {
+		return nil, err
+	}
+	return f.SecretsManagerAPI.GetSecretValueWithContext(ctx, input, opts...)
+}
+
+// FaultSES wraps an SESAPI with Faults
+type FaultSES struct {
+	SESAPI
+	*Faults
+}
+
+func (f FaultSES) SendEmailWithContext(ctx aws.Context, input *ses.SendEmailInput, opts ...request.Option) (*ses.SendEmailOutput, error) {
+	if err := f.inject(ctx, "SendEmail"); err != nil {
+		return nil, err
+	}
+	return f.SESAPI.SendEmailWithContext(ctx, input, opts...)
+}
+
+// FaultSNS wraps an SNSAPI with Faults
+type FaultSNS struct {
+	SNSAPI
+	*Faults
+}
+
+func (f FaultSNS) PublishWithContext(ctx aws.Context, input *sns.PublishInput, opts ...request.Option) (*sns.PublishOutput, error) {
+	if err := f.inject(ctx, "Publish"); err != nil {
+		return nil, err
+	}
+	return f.SNSAPI.PublishWithContext(ctx, input, opts...)
+}
+
+// FaultSQS wraps an SQSAPI with Faults
+type FaultSQS struct {
+	SQSAPI
+	*Faults
+}
+
+func (f FaultSQS) DeleteMessageWithContext(ctx aws.Context, input *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	if err := f.inject(ctx, "DeleteMessage"); err != nil {
+		return nil, err
+	}
+	return f.SQSAPI.DeleteMessageWithContext(ctx, input, opts...)
+}
+
+func (f FaultSQS) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	if err := f.inject(ctx, "ReceiveMessage"); err != nil {
+		return nil, err
+	}
+	return f.SQSAPI.ReceiveMessageWithContext(ctx, input, opts...)
+}
+
+func (f FaultSQS) SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	if err := f.inject(ctx, "SendMessage"); err != nil {
+		return nil, err
+	}
+	return f.SQSAPI.SendMessageWithContext(ctx, input, opts...)
+}
+
+// FaultSSM wraps an SSMAPI with Faults
+type FaultSSM struct {
+	SSMAPI
+	*Faults
+}
+
+func (f FaultSSM) GetParameterWithContext(ctx aws.Context, input *ssm.GetParameterInput, opts ...request.Option) (*ssm.GetParameterOutput, error) {
+	if err := f.inject(ctx, "GetParameter"); err != nil {
+		return nil, err
+	}
+	return f.SSMAPI.GetParameterWithContext(ctx, input, opts...)
+}
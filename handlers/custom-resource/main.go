@@ -6,5 +6,6 @@ import (
 )
 
 func main() {
-	lambda.Start(gofaas.CFRespond)
+	gofaas.MustLoadConfig(&gofaas.Config.Notify, &gofaas.Config.Resource)
+	lambda.Start(gofaas.NotifyHandler(gofaas.CFRespond))
 }
@@ -6,5 +6,6 @@ import (
 )
 
 func main() {
+	gofaas.MustLoadConfig(&gofaas.Config.Notify)
 	lambda.Start(gofaas.NotifyAPIGateway(gofaas.Dashboard))
 }
@@ -6,5 +6,6 @@ import (
 )
 
 func main() {
+	gofaas.MustLoadConfig(&gofaas.Config.Auth, &gofaas.Config.Notify, &gofaas.Config.User)
 	lambda.Start(gofaas.NotifyAPIGateway(gofaas.UserRead))
 }
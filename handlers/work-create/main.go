@@ -6,5 +6,6 @@ import (
 )
 
 func main() {
+	gofaas.MustLoadConfig(&gofaas.Config.Auth, &gofaas.Config.Jobs, &gofaas.Config.Notify, &gofaas.Config.Quota, &gofaas.Config.Work)
 	lambda.Start(gofaas.NotifyAPIGateway(gofaas.WorkCreate))
 }
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/nzoschke/gofaas"
+)
+
+func main() {
+	gofaas.MustLoadConfig(&gofaas.Config.Auth, &gofaas.Config.Jobs, &gofaas.Config.Notify, &gofaas.Config.Worker)
+	lambda.Start(gofaas.NotifyAPIGateway(gofaas.WorkRead))
+}
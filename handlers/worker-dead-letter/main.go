@@ -0,0 +1,11 @@
+package main
+
+import (
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/nzoschke/gofaas"
+)
+
+func main() {
+	gofaas.MustLoadConfig(&gofaas.Config.Continue, &gofaas.Config.DeadLetter, &gofaas.Config.FanOut, &gofaas.Config.Jobs, &gofaas.Config.Notify, &gofaas.Config.Quota, &gofaas.Config.Worker)
+	lambda.Start(gofaas.NotifyCloudWatch(gofaas.WorkerDeadLetter))
+}
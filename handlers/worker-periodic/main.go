@@ -6,5 +6,6 @@ import (
 )
 
 func main() {
+	gofaas.MustLoadConfig(&gofaas.Config.Continue, &gofaas.Config.Notify, &gofaas.Config.Retention, &gofaas.Config.Schedule, &gofaas.Config.Worker)
 	lambda.Start(gofaas.NotifyCloudWatch(gofaas.WorkerPeriodic))
 }
@@ -6,5 +6,6 @@ import (
 )
 
 func main() {
+	gofaas.MustLoadConfig(&gofaas.Config.Continue, &gofaas.Config.FanOut, &gofaas.Config.Jobs, &gofaas.Config.Notify, &gofaas.Config.Quota, &gofaas.Config.Worker)
 	lambda.Start(gofaas.NotifyWorker(gofaas.Worker))
 }
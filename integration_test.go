@@ -0,0 +1,198 @@
+//go:build integration
+// +build integration
+
+package gofaas
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/stretchr/testify/assert"
+)
+
+// Integration tests run the user and worker flows against local stand-ins for AWS services:
+//
+//	docker run -d -p 8000:8000 amazon/dynamodb-local
+//	docker run -d -p 9000:9000 -e MINIO_ACCESS_KEY=test -e MINIO_SECRET_KEY=testtest minio/minio server /data
+//
+//	AWS_REGION=us-east-1 AWS_ACCESS_KEY_ID=test AWS_SECRET_ACCESS_KEY=testtest \
+//	GOFAAS_DYNAMODB_ENDPOINT=http://localhost:8000 \
+//	GOFAAS_S3_ENDPOINT=http://localhost:9000 GOFAAS_S3_FORCE_PATH_STYLE=true \
+//	go test -v -tags integration ./...
+//
+// KMS is mocked unless GOFAAS_KMS_ENDPOINT (or GOFAAS_ENDPOINT for LocalStack) is set.
+// Lambda is always replaced by an in-process invoke of Worker.
+
+// invokeWorker is a LambdaAPI implementation that runs Worker in-process
+type invokeWorker struct{}
+
+func (i invokeWorker) InvokeWithContext(ctx aws.Context, input *lambda.InvokeInput, opts ...request.Option) (*lambda.InvokeOutput, error) {
+	e := WorkerEvent{}
+	if len(input.Payload) > 0 {
+		if err := json.Unmarshal(input.Payload, &e); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := Worker(ctx, e); err != nil {
+		return nil, err
+	}
+	return &lambda.InvokeOutput{StatusCode: aws.Int64(202)}, nil
+}
+
+func integrationContext(t *testing.T) (context.Context, func()) {
+	if os.Getenv("GOFAAS_DYNAMODB_ENDPOINT") == "" && os.Getenv("GOFAAS_ENDPOINT") == "" {
+		t.Skip("GOFAAS_DYNAMODB_ENDPOINT or GOFAAS_ENDPOINT not set")
+	}
+
+	ctx, seg := xray.BeginSegment(context.Background(), "integration")
+	return ctx, func() { seg.Close(nil) }
+}
+
+// integrationTable creates a table with an "id" hash key like SimpleTable, returning "" on error
+func integrationTable(ctx context.Context, t *testing.T, ddb *dynamodb.DynamoDB, prefix string) string {
+	table := fmt.Sprintf("%s-%d", prefix, time.Now().UnixNano())
+
+	_, err := ddb.CreateTableWithContext(ctx, &dynamodb.CreateTableInput{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("id"), AttributeType: aws.String("S")},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("id"), KeyType: aws.String("HASH")},
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(1),
+			WriteCapacityUnits: aws.Int64(1),
+		},
+		TableName: aws.String(table),
+	})
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	return table
+}
+
+func TestIntegrationUser(t *testing.T) {
+	ctx, done := integrationContext(t)
+	defer done()
+
+	ddb := NewDynamoDB()
+	table := integrationTable(ctx, t, ddb, "gofaas-users")
+	if table == "" {
+		return
+	}
+	defer ddb.DeleteTable(&dynamodb.DeleteTableInput{TableName: aws.String(table)})
+
+	Config.User = UserConfig{
+		KeyID:     os.Getenv("KEY_ID"),
+		TableName: table,
+	}
+	DynamoDB = ddb
+
+	if os.Getenv("GOFAAS_KMS_ENDPOINT") == "" && os.Getenv("GOFAAS_ENDPOINT") == "" {
+		KMS = &MockKMS{}
+	}
+
+	r, err := UserCreate(ctx, events.APIGatewayProxyRequest{
+		Body: `{"username": "test"}`,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 200, r.StatusCode)
+
+	u := User{}
+	assert.NoError(t, json.Unmarshal([]byte(r.Body), &u))
+
+	r, err = UserRead(ctx, events.APIGatewayProxyRequest{
+		PathParameters:        map[string]string{"id": u.ID},
+		QueryStringParameters: map[string]string{"token": "true"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 200, r.StatusCode)
+	assert.Contains(t, r.Body, `"token"`)
+
+	r, err = UserUpdate(ctx, events.APIGatewayProxyRequest{
+		Body:           `{"username": "test2"}`,
+		PathParameters: map[string]string{"id": u.ID},
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, r.Body, "test2")
+
+	r, err = UserDelete(ctx, events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"id": u.ID},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 200, r.StatusCode)
+
+	r, err = UserRead(ctx, events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"id": u.ID},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 404, r.StatusCode)
+}
+
+func TestIntegrationWorker(t *testing.T) {
+	ctx, done := integrationContext(t)
+	defer done()
+
+	bucket := fmt.Sprintf("gofaas-bucket-%d", time.Now().UnixNano())
+	s := NewS3()
+
+	_, err := s.CreateBucketWithContext(ctx, &s3.CreateBucketInput{
+		Bucket: aws.String(bucket),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String(bucket)})
+
+	ddb := NewDynamoDB()
+	table := integrationTable(ctx, t, ddb, "gofaas-jobs")
+	if table == "" {
+		return
+	}
+	defer ddb.DeleteTable(&dynamodb.DeleteTableInput{TableName: aws.String(table)})
+
+	Config.Jobs.TableName = table
+	Config.Worker.Bucket = bucket
+	DynamoDB = ddb
+	Lambda = invokeWorker{}
+	S3 = s
+
+	r, err := WorkCreate(ctx, events.APIGatewayProxyRequest{Body: `{"n": 1}`})
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+
+	j := Job{}
+	assert.NoError(t, json.Unmarshal([]byte(r.Body), &j))
+
+	r, err = WorkRead(ctx, events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"id": j.ID},
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, r.Body, `"status": "succeeded"`)
+	assert.Contains(t, r.Body, `"report_url"`)
+
+	count := func() int {
+		out, err := s.ListObjectsWithContext(ctx, &s3.ListObjectsInput{Bucket: aws.String(bucket)})
+		assert.NoError(t, err)
+		return len(out.Contents)
+	}
+
+	assert.Equal(t, 1, count())
+
+	err = scheduleCleanup(ctx, time.Now())
+	assert.NoError(t, err)
+
+	assert.Equal(t, 0, count())
+}
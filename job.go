@@ -0,0 +1,295 @@
+package gofaas
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// JobStatus is the state of a Job
+type JobStatus string
+
+// Job statuses
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+// JobType is the kind of work a Job does
+type JobType string
+
+// Job types
+const (
+	JobSingle JobType = ""
+	JobFanOut JobType = "fanout"
+)
+
+// Job represents a unit of work created by WorkCreate and performed by Worker
+// A job whose cancellation is requested is cancelled by its worker, see cancel.go
+// A fan-out job splits its input into chunks of ChunkSize that are worked on as shards, see fanout.go
+type Job struct {
+	ID              string               `json:"id"`
+	CancelRequested bool                 `json:"cancel_requested,omitempty"`
+	ChunkSize       int                  `json:"chunk_size,omitempty"`
+	Error           string               `json:"error,omitempty"`
+	Format          string               `json:"format,omitempty"`
+	Gzip            bool                 `json:"gzip,omitempty"`
+	Input           json.RawMessage      `json:"input,omitempty"`
+	QuotaHeld       bool                 `json:"-" dynamodbav:"quota_held,omitempty"`
+	ReportKey       string               `json:"-" dynamodbav:"report_key,omitempty"`
+	ReportURL       string               `json:"report_url,omitempty" dynamodbav:"-"`
+	ShardErrors     map[string]string    `json:"shard_errors,omitempty"`
+	ShardStatus     map[string]JobStatus `json:"shard_status,omitempty"`
+	Shards          int                  `json:"shards,omitempty"`
+	ShardsFailed    int                  `json:"shards_failed,omitempty"`
+	ShardsNext      int                  `json:"-" dynamodbav:"shards_next,omitempty"`
+	ShardsQueue     []int                `json:"-" dynamodbav:"shards_queue,omitempty"`
+	ShardsSucceeded int                  `json:"shards_succeeded,omitempty"`
+	Status          JobStatus            `json:"status"`
+	Subject         string               `json:"subject,omitempty"`
+	TimeCancel      *time.Time           `json:"-" dynamodbav:"time_cancel,omitempty"`
+	TimeCreated     time.Time            `json:"time_created"`
+	TimeEnd         *time.Time           `json:"time_end,omitempty"`
+	TimeStart       *time.Time           `json:"time_start,omitempty"`
+	Type            JobType              `json:"type,omitempty"`
+}
+
+// jobReportExpiry is how long a presigned report URL is valid
+var jobReportExpiry = 15 * time.Minute
+
+// start marks a job as running
+func (j *Job) start() {
+	t := time.Now()
+	j.Status = JobRunning
+	j.TimeStart = &t
+}
+
+// finish marks a job as succeeded, or failed with the error
+func (j *Job) finish(err error) {
+	t := time.Now()
+	j.Error = ""
+	j.Status = JobSucceeded
+	j.TimeEnd = &t
+
+	if err != nil {
+		j.Error = err.Error()
+		j.Status = JobFailed
+	}
+}
+
+// retry queues a job that failed an attempt again, keeping the error until the next attempt
+func (j *Job) retry(err error) {
+	j.Error = err.Error()
+	j.Status = JobQueued
+	j.TimeStart = nil
+}
+
+func jobGet(ctx context.Context, id string) (*Job, error) {
+	out, err := DynamoDB.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: aws.String(id),
+			},
+		},
+		TableName: aws.String(Config.Jobs.TableName),
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if out.Item == nil {
+		return nil, ResponseError{"not found", 404}
+	}
+
+	j := Job{}
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &j); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &j, nil
+}
+
+// jobGetFor gets a job of the subject of a request
+// A job of another subject is a 404 ResponseError like a missing one, so callers can't find out which IDs exist.
+func jobGetFor(ctx context.Context, id, subject string) (*Job, error) {
+	j, err := jobGet(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if j.Subject != subject {
+		return nil, ResponseError{"not found", 404}
+	}
+	return j, nil
+}
+
+func jobPut(ctx context.Context, j *Job) error {
+	item, err := dynamodbattribute.MarshalMap(j)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = DynamoDB.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(Config.Jobs.TableName),
+	})
+
+	return errors.WithStack(err)
+}
+
+// jobStart marks a job running with a conditional update, so it doesn't overwrite a concurrent cancel
+// A running job can start again after its last worker crashed. Use jobConflict to check if the job was
+// cancelled, its cancellation was requested, or it already ended.
+func jobStart(ctx context.Context, j *Job) error {
+	j.start()
+
+	_, err := jobUpdate(ctx, j.ID,
+		"SET #status = :running, time_start = :start",
+		"#status IN (:queued, :running) AND attribute_not_exists(cancel_requested)",
+		map[string]string{"#status": "status"},
+		map[string]interface{}{":queued": JobQueued, ":running": JobRunning, ":start": j.TimeStart},
+	)
+	return errors.WithStack(err)
+}
+
+// jobEnd saves the status, error, report and times of a running job that ended an attempt
+// It updates only those attributes if the job is still running and its cancellation wasn't requested,
+// so a concurrent cancel isn't overwritten. Use jobConflict to check for that.
+func jobEnd(ctx context.Context, j *Job) error {
+	set := []string{"#status = :status"}
+	remove := []string{}
+	values := map[string]interface{}{":running": JobRunning, ":status": j.Status}
+
+	for _, a := range []struct {
+		name  string
+		value interface{}
+		ok    bool
+	}{
+		{"#error", j.Error, j.Error != ""},
+		{"report_key", j.ReportKey, j.ReportKey != ""},
+		{"time_end", j.TimeEnd, j.TimeEnd != nil},
+		{"time_start", j.TimeStart, j.TimeStart != nil},
+	} {
+		if !a.ok {
+			remove = append(remove, a.name)
+			continue
+		}
+		v := ":" + strings.TrimPrefix(a.name, "#")
+		set = append(set, a.name+" = "+v)
+		values[v] = a.value
+	}
+
+	update := "SET " + strings.Join(set, ", ")
+	if len(remove) > 0 {
+		update += " REMOVE " + strings.Join(remove, ", ")
+	}
+
+	_, err := jobUpdate(ctx, j.ID, update,
+		"#status = :running AND attribute_not_exists(cancel_requested)",
+		map[string]string{"#error": "error", "#status": "status"},
+		values,
+	)
+	return errors.WithStack(err)
+}
+
+// jobUpdate atomically updates a job with an update expression if the condition holds, returning the updated job
+// Values are marshalled with dynamodbattribute. Use jobConflict to check for a failed condition.
+func jobUpdate(ctx context.Context, id, update, cond string, names map[string]string, values map[string]interface{}) (*Job, error) {
+	input := &dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: aws.String(id),
+			},
+		},
+		ReturnValues:     aws.String(dynamodb.ReturnValueAllNew),
+		TableName:        aws.String(Config.Jobs.TableName),
+		UpdateExpression: aws.String(update),
+	}
+
+	if cond != "" {
+		input.ConditionExpression = aws.String(cond)
+	}
+	if len(names) > 0 {
+		input.ExpressionAttributeNames = aws.StringMap(names)
+	}
+	if len(values) > 0 {
+		vs, err := dynamodbattribute.MarshalMap(values)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		input.ExpressionAttributeValues = vs
+	}
+
+	out, err := DynamoDB.UpdateItemWithContext(ctx, input)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	j := Job{}
+	if err := dynamodbattribute.UnmarshalMap(out.Attributes, &j); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &j, nil
+}
+
+// jobEmptyMap marshals to an empty map attribute, where dynamodbattribute marshals an empty Go map to NULL
+// Nested attributes can only be set in a map that exists
+type jobEmptyMap struct{}
+
+func (jobEmptyMap) MarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
+	av.M = map[string]*dynamodb.AttributeValue{}
+	return nil
+}
+
+// jobConflict returns if an error is from a failed update condition
+func jobConflict(err error) bool {
+	aerr, ok := errors.Cause(err).(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// jobReportURL sets a presigned URL to the report of a succeeded job
+func jobReportURL(ctx context.Context, j *Job) error {
+	if j.Status != JobSucceeded || j.ReportKey == "" {
+		return nil
+	}
+
+	req, _ := S3.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(Config.Worker.Bucket),
+		Key:    aws.String(j.ReportKey),
+	})
+	req.SetContext(ctx)
+
+	u, err := req.Presign(jobReportExpiry)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	j.ReportURL = u
+	return nil
+}
+
+func jobResponse(j *Job, status int) (events.APIGatewayProxyResponse, error) {
+	b, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return responseEmpty, errors.WithStack(err)
+	}
+
+	return events.APIGatewayProxyResponse{
+		Body: string(b) + "\n",
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		StatusCode: status,
+	}, nil
+}
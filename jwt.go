@@ -3,7 +3,6 @@ package gofaas
 import (
 	"encoding/base64"
 	"fmt"
-	"os"
 	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -23,11 +22,17 @@ func JWTClaims(e events.APIGatewayProxyRequest, claims jwt.Claims) (events.APIGa
 	}
 
 	// for convenience, "pass" auth if no hash key is set
-	k := os.Getenv("AUTH_HASH_KEY")
-	if k == "" {
+	if Config.Auth.HashKey == "" {
 		return r, claims, nil
 	}
 
+	k, err := Config.Auth.HashKey.Value()
+	if err != nil {
+		r.Body = fmt.Sprintf("{\"error\": %q}", err)
+		r.StatusCode = 500
+		return r, claims, errors.WithStack(err)
+	}
+
 	key, err := base64.StdEncoding.DecodeString(k)
 	if err != nil {
 		r.Body = fmt.Sprintf("{\"error\": %q}", err)
@@ -0,0 +1,360 @@
+package gofaas
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/pkg/errors"
+)
+
+// Severity orders notifications so a sink can ignore the ones below its minimum
+type Severity int
+
+// Severities from least to most severe
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+	SeverityCritical
+)
+
+var severityNames = []string{"info", "warning", "error", "critical"}
+
+// ParseSeverity returns the severity with a name like "error"
+func ParseSeverity(s string) (Severity, error) {
+	for i, n := range severityNames {
+		if strings.EqualFold(s, n) {
+			return Severity(i), nil
+		}
+	}
+	return SeverityInfo, fmt.Errorf("%q is not one of %s", s, strings.Join(severityNames, ", "))
+}
+
+func (s Severity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+	return severityNames[s]
+}
+
+// MarshalText encodes a severity as its name
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes a severity from its name
+func (s *Severity) UnmarshalText(b []byte) error {
+	v, err := ParseSeverity(string(b))
+	if err != nil {
+		return err
+	}
+	*s = v
+	return nil
+}
+
+// Notification is a message for the people operating the functions
+// Notifications about errors carry the context of the invocation, see newNotification.
+type Notification struct {
+	APIRequestID string    `json:"api_request_id,omitempty"`
+	EventSource  string    `json:"event_source,omitempty"`
+	Function     string    `json:"function,omitempty"`
+	LogURL       string    `json:"log_url,omitempty"`
+	Message      string    `json:"message"`
+	Method       string    `json:"method,omitempty"`
+	Path         string    `json:"path,omitempty"`
+	RequestID    string    `json:"request_id,omitempty"`
+	Severity     Severity  `json:"severity"`
+	Status       int       `json:"status,omitempty"`
+	Subject      string    `json:"subject"`
+	Time         time.Time `json:"time"`
+	TraceID      string    `json:"trace_id,omitempty"`
+	Version      string    `json:"version,omitempty"`
+}
+
+// Text renders the notification for people, e.g. in an email or chat message
+func (n Notification) Text() string {
+	return n.Subject + "\n\n" + n.details()
+}
+
+// JSON renders the notification for machines, e.g. a queue or an HTTP endpoint
+func (n Notification) JSON() string {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Sprintf(`{"error": %q}`, err.Error())
+	}
+	return string(b)
+}
+
+// details renders the fields of the notification that are set, then the message
+func (n Notification) details() string {
+	b := &strings.Builder{}
+	field := func(k, v string) {
+		if v != "" {
+			fmt.Fprintf(b, "%-9s %s\n", k+":", v)
+		}
+	}
+
+	fn := n.Function
+	if fn != "" && n.Version != "" {
+		fn += ":" + n.Version
+	}
+	req := strings.TrimSpace(n.Method + " " + n.Path)
+	if n.Status != 0 {
+		req = strings.TrimSpace(fmt.Sprintf("%s %d", req, n.Status))
+	}
+
+	field("Severity", n.Severity.String())
+	field("Function", fn)
+	field("Request", n.RequestID)
+	field("API Req", n.APIRequestID)
+	field("Trace", n.TraceID)
+	field("HTTP", req)
+	field("Source", n.EventSource)
+	if !n.Time.IsZero() {
+		field("Time", n.Time.UTC().Format(time.RFC3339))
+	}
+	field("Logs", n.LogURL)
+
+	if b.Len() > 0 {
+		b.WriteString("\n")
+	}
+	b.WriteString(n.Message)
+	return b.String()
+}
+
+// Notifier sends notifications to a sink like an SNS topic or a Slack channel
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// NotifySink is a named Notifier that only gets notifications at or above Min
+type NotifySink struct {
+	Min      Severity
+	Name     string
+	Notifier Notifier
+}
+
+// Notifiers are sinks to send notifications to in addition to the ones in Config.Notify
+var Notifiers []NotifySink
+
+// notifyClient is the HTTP client for webhook sinks
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// Notify sends a notification to every sink that takes its severity, at once
+// An error from one sink doesn't stop the others, and every error is logged and returned together
+func Notify(ctx context.Context, n Notification) error {
+	sinks, err := notifySinks()
+	if err != nil {
+		log.Printf("NotifyError config error %+v\n", err)
+		return errors.WithStack(err)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := []string{}
+
+	for _, s := range sinks {
+		if n.Severity < s.Min {
+			continue
+		}
+
+		wg.Add(1)
+		go func(s NotifySink) {
+			defer wg.Done()
+			if err := s.Notifier.Notify(ctx, n); err != nil {
+				log.Printf("NotifyError %s error %+v\n", s.Name, err)
+				mu.Lock()
+				failed = append(failed, fmt.Sprintf("%s: %s", s.Name, err))
+				mu.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return errors.Errorf("%d notify sinks failed: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// notifySinks returns the sinks set in Config.Notify followed by Notifiers
+func notifySinks() ([]NotifySink, error) {
+	c := Config.Notify
+	sinks := []NotifySink{}
+
+	if c.Topic != "" {
+		sinks = append(sinks, NotifySink{c.TopicSeverity, "sns", SNSNotifier{Topic: c.Topic}})
+	}
+
+	if c.SlackURL != "" {
+		url, err := c.SlackURL.Value()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		sinks = append(sinks, NotifySink{c.SlackSeverity, "slack", SlackNotifier{URL: url}})
+	}
+
+	if c.WebhookURL != "" {
+		url, err := c.WebhookURL.Value()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		sinks = append(sinks, NotifySink{c.WebhookSeverity, "webhook", WebhookNotifier{URL: url}})
+	}
+
+	if c.EmailFrom != "" && len(c.EmailTo) > 0 {
+		sinks = append(sinks, NotifySink{c.EmailSeverity, "ses", SESNotifier{From: c.EmailFrom, To: c.EmailTo}})
+	}
+
+	return append(sinks, Notifiers...), nil
+}
+
+// SNSNotifier publishes notifications to an SNS topic
+// Email subscribers get the text, SMS subscribers the subject and every other protocol the JSON.
+// The severity and function are message attributes, so subscriptions can filter on them.
+type SNSNotifier struct {
+	Topic string
+}
+
+// Notify publishes the notification
+func (s SNSNotifier) Notify(ctx context.Context, n Notification) error {
+	subject := snsSubject(n.Subject)
+	text := n.Text()
+
+	msg, err := json.Marshal(map[string]string{
+		"default": text,
+		"email":   text,
+		"http":    n.JSON(),
+		"https":   n.JSON(),
+		"lambda":  n.JSON(),
+		"sms":     subject,
+		"sqs":     n.JSON(),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	attrs := map[string]*sns.MessageAttributeValue{
+		"severity": &sns.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(n.Severity.String()),
+		},
+	}
+	if n.Function != "" {
+		attrs["function"] = &sns.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(n.Function),
+		}
+	}
+
+	_, err = SNS.PublishWithContext(ctx, &sns.PublishInput{
+		Message:           aws.String(string(msg)),
+		MessageAttributes: attrs,
+		MessageStructure:  aws.String("json"),
+		Subject:           aws.String(subject),
+		TopicArn:          aws.String(s.Topic),
+	})
+	return errors.WithStack(err)
+}
+
+// snsSubject makes a subject SNS accepts: printable ASCII on one line of at most 100 characters
+func snsSubject(s string) string {
+	b := []byte{}
+	for _, r := range s {
+		if r < ' ' || r > '~' {
+			r = ' '
+		}
+		b = append(b, byte(r))
+	}
+
+	s = strings.TrimSpace(string(b))
+	if len(s) > 100 {
+		s = s[:97] + "..."
+	}
+	return s
+}
+
+// SlackNotifier posts notifications to a Slack incoming webhook
+type SlackNotifier struct {
+	URL string
+}
+
+// Notify posts the notification as a Slack message
+func (s SlackNotifier) Notify(ctx context.Context, n Notification) error {
+	return notifyPost(ctx, s.URL, map[string]string{
+		"text": fmt.Sprintf("*%s*\n```\n%s```", n.Subject, n.details()),
+	})
+}
+
+// WebhookNotifier posts notifications as JSON to any URL, e.g. an incident management service
+type WebhookNotifier struct {
+	URL string
+}
+
+// Notify posts the JSON rendering of the notification
+func (w WebhookNotifier) Notify(ctx context.Context, n Notification) error {
+	return notifyPost(ctx, w.URL, n)
+}
+
+// SESNotifier emails notifications with SES
+// The From address must be verified in SES.
+type SESNotifier struct {
+	From string
+	To   []string
+}
+
+// Notify emails the notification
+func (s SESNotifier) Notify(ctx context.Context, n Notification) error {
+	_, err := SES.SendEmailWithContext(ctx, &ses.SendEmailInput{
+		Destination: &ses.Destination{
+			ToAddresses: aws.StringSlice(s.To),
+		},
+		Message: &ses.Message{
+			Body: &ses.Body{
+				Text: &ses.Content{Data: aws.String(n.Text())},
+			},
+			Subject: &ses.Content{Data: aws.String(n.Subject)},
+		},
+		Source: aws.String(s.From),
+	})
+	return errors.WithStack(err)
+}
+
+// notifyPost posts v as JSON to a webhook URL and checks for a 2xx status
+// The URL is left out of errors since webhook URLs are secrets.
+func notifyPost(ctx context.Context, url string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return errors.New("invalid webhook URL")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := notifyClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Errorf("webhook post error: %s", strings.Replace(err.Error(), url, "<url>", -1))
+	}
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+	if res.StatusCode/100 != 2 {
+		return errors.Errorf("webhook returned %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
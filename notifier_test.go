@@ -0,0 +1,182 @@
+package gofaas
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotify(t *testing.T) {
+	slack := &notifyServer{}
+	hook := &notifyServer{}
+	slackServer := httptest.NewServer(slack)
+	hookServer := httptest.NewServer(hook)
+	defer slackServer.Close()
+	defer hookServer.Close()
+
+	Config.Notify = NotifyConfig{
+		EmailFrom:       "gofaas@example.com",
+		EmailSeverity:   SeverityInfo,
+		EmailTo:         []string{"oncall@example.com"},
+		SlackSeverity:   SeverityWarning,
+		SlackURL:        Secret(slackServer.URL),
+		Topic:           "arn:aws:sns:us-east-1:123456789012:gofaas-NotificationTopic",
+		TopicSeverity:   SeverityError,
+		WebhookSeverity: SeverityCritical,
+		WebhookURL:      Secret(hookServer.URL),
+	}
+	defer func() { Config.Notify = NotifyConfig{} }()
+
+	mses := &MockSES{}
+	msns := &MockSNS{}
+	SES = mses
+	SNS = msns
+
+	ctx := context.Background()
+	n := Notification{
+		Function: "gofaas-WorkerFunction",
+		Message:  "disk almost full\n",
+		Severity: SeverityWarning,
+		Subject:  "WARNING gofaas-WorkerFunction",
+		Time:     time.Date(2018, 2, 22, 3, 0, 0, 0, time.UTC),
+	}
+
+	// each sink only gets notifications at or above its minimum severity
+	assert.NoError(t, Notify(ctx, n))
+	assert.Len(t, mses.Inputs, 1)
+	assert.Len(t, msns.Inputs, 0)
+	assert.Len(t, slack.bodies(), 1)
+	assert.Len(t, hook.bodies(), 0)
+
+	if assert.Len(t, mses.Inputs, 1) {
+		assert.Equal(t, []*string{aws.String("oncall@example.com")}, mses.Inputs[0].Destination.ToAddresses)
+		assert.Equal(t, "WARNING gofaas-WorkerFunction", aws.StringValue(mses.Inputs[0].Message.Subject.Data))
+		assert.Equal(t, "WARNING gofaas-WorkerFunction\n\n"+
+			"Severity: warning\n"+
+			"Function: gofaas-WorkerFunction\n"+
+			"Time:     2018-02-22T03:00:00Z\n"+
+			"\ndisk almost full\n", aws.StringValue(mses.Inputs[0].Message.Body.Text.Data))
+		assert.Equal(t, "gofaas@example.com", aws.StringValue(mses.Inputs[0].Source))
+	}
+	assert.Equal(t, []string{`{"text":"*WARNING gofaas-WorkerFunction*\n` + "```" + `\nSeverity: warning\nFunction: gofaas-WorkerFunction\nTime:     2018-02-22T03:00:00Z\n\ndisk almost full\n` + "```" + `"}`}, slack.bodies())
+
+	n.Severity = SeverityCritical
+	assert.NoError(t, Notify(ctx, n))
+	assert.Len(t, mses.Inputs, 2)
+	assert.Len(t, msns.Inputs, 1)
+	assert.Len(t, slack.bodies(), 2)
+
+	// SNS subscribers get a rendering for their protocol and can filter on severity
+	if assert.Len(t, msns.Inputs, 1) {
+		in := msns.Inputs[0]
+		assert.Equal(t, "json", aws.StringValue(in.MessageStructure))
+		assert.Equal(t, "critical", aws.StringValue(in.MessageAttributes["severity"].StringValue))
+		assert.Equal(t, "gofaas-WorkerFunction", aws.StringValue(in.MessageAttributes["function"].StringValue))
+		assert.Equal(t, n.Text(), snsMessage(in, "email"))
+		assert.Equal(t, "WARNING gofaas-WorkerFunction", snsMessage(in, "sms"))
+		assert.Equal(t, n.JSON(), snsMessage(in, "sqs"))
+	}
+
+	if assert.Len(t, hook.bodies(), 1) {
+		assert.JSONEq(t, `{
+			"function": "gofaas-WorkerFunction",
+			"message": "disk almost full\n",
+			"severity": "critical",
+			"subject": "WARNING gofaas-WorkerFunction",
+			"time": "2018-02-22T03:00:00Z"
+		}`, hook.bodies()[0])
+	}
+
+	// a failed sink doesn't stop the others
+	hook.status = 503
+	var custom []Notification
+	Notifiers = []NotifySink{{Min: SeverityError, Name: "custom", Notifier: notifierFunc(func(ctx context.Context, n Notification) error {
+		custom = append(custom, n)
+		return nil
+	})}}
+	defer func() { Notifiers = nil }()
+
+	err := Notify(ctx, n)
+	assert.EqualError(t, err, "1 notify sinks failed: webhook: webhook returned 503 Service Unavailable: down")
+	assert.Len(t, mses.Inputs, 3)
+	assert.Len(t, msns.Inputs, 2)
+	assert.Len(t, slack.bodies(), 3)
+	assert.Len(t, custom, 1)
+}
+
+func TestSNSSubject(t *testing.T) {
+	assert.Equal(t, "ERROR gofaas-WorkerFunction: bad input", snsSubject("ERROR gofaas-WorkerFunction: bad\tinput\n"))
+	assert.Equal(t, "ERROR caf  au lait", snsSubject("ERROR café au lait"))
+	assert.Len(t, snsSubject(strings.Repeat("x", 200)), 100)
+}
+
+func TestParseSeverity(t *testing.T) {
+	s, err := ParseSeverity("Warning")
+	assert.NoError(t, err)
+	assert.Equal(t, SeverityWarning, s)
+	assert.Equal(t, "warning", s.String())
+
+	_, err = ParseSeverity("fatal")
+	assert.EqualError(t, err, `"fatal" is not one of info, warning, error, critical`)
+
+	cfg := NotifyConfig{}
+	env := map[string]string{"NOTIFY_SLACK_SEVERITY": "error", "NOTIFY_WEBHOOK_SEVERITY": "loud"}
+	err = loadConfig(func(k string) string { return env[k] }, &cfg)
+	assert.EqualError(t, err, `invalid config: NOTIFY_WEBHOOK_SEVERITY "loud" is not one of info, warning, error, critical`)
+	assert.Equal(t, SeverityError, cfg.SlackSeverity)
+}
+
+// notifyServer is a webhook that saves request bodies and responds with status, or 200
+type notifyServer struct {
+	mu     sync.Mutex
+	posts  []string
+	status int
+}
+
+func (s *notifyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		w.Write([]byte("down\n"))
+		return
+	}
+	s.posts = append(s.posts, string(b))
+}
+
+func (s *notifyServer) bodies() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.posts...)
+}
+
+// snsMessage returns the message an SNS subscriber with a protocol gets from a publish with a JSON message structure
+func snsMessage(in *sns.PublishInput, protocol string) string {
+	m := map[string]string{}
+	if err := json.Unmarshal([]byte(aws.StringValue(in.Message)), &m); err != nil {
+		return aws.StringValue(in.Message)
+	}
+	if v, ok := m[protocol]; ok {
+		return v
+	}
+	return m["default"]
+}
+
+type notifierFunc func(ctx context.Context, n Notification) error
+
+func (f notifierFunc) Notify(ctx context.Context, n Notification) error {
+	return f(ctx, n)
+}
@@ -4,11 +4,17 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	xrayheader "github.com/aws/aws-xray-sdk-go/header"
+	"github.com/pkg/errors"
 )
 
 // HandlerAPIGateway is an API Gateway Proxy Request handler function
@@ -17,56 +23,281 @@ type HandlerAPIGateway func(context.Context, events.APIGatewayProxyRequest) (eve
 // HandlerCloudWatch is a CloudWatchEvent handler function
 type HandlerCloudWatch func(context.Context, events.CloudWatchEvent) error
 
+// HandlerSQS is an SQSEvent handler function that reports partial batch failures
+type HandlerSQS func(context.Context, events.SQSEvent) (SQSBatchResponse, error)
+
 // HandlerWorker is a Worker handler function
 type HandlerWorker func(context.Context, WorkerEvent) error
 
+// notifyEvent is what a Notify wrapper knows about the event being handled, for notifications
+type notifyEvent struct {
+	APIRequestID string
+	Method       string
+	Path         string
+	Source       string
+	Status       int
+}
+
+type notifyEventKey struct{}
+
+// withNotifyEvent returns a context with the event for notifications
+func withNotifyEvent(ctx context.Context, ev *notifyEvent) context.Context {
+	return context.WithValue(ctx, notifyEventKey{}, ev)
+}
+
 // NotifyAPIGateway wraps a handler func and sends an SNS notification on error
+// A panic is recovered, notified and returned as a 500 response with the request ID.
 func NotifyAPIGateway(h HandlerAPIGateway) HandlerAPIGateway {
-	return func(ctx context.Context, e events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-		r, err := h(ctx, e)
-		notify(ctx, err)
-		return r, err
-	}
+	return NotifyHandler(h).(HandlerAPIGateway)
 }
 
 // NotifyCloudWatch wraps a handler func and sends an SNS notification on error
+// A panic is recovered, notified and returned as an error.
 func NotifyCloudWatch(h HandlerCloudWatch) HandlerCloudWatch {
-	return func(ctx context.Context, e events.CloudWatchEvent) error {
-		err := h(ctx, e)
-		notify(ctx, err)
-		return err
-	}
+	return NotifyHandler(h).(HandlerCloudWatch)
+}
+
+// NotifySQS wraps a handler func and sends an SNS notification on error
+// A panic is recovered, notified and returned as an error, so the whole batch is retried.
+func NotifySQS(h HandlerSQS) HandlerSQS {
+	return NotifyHandler(h).(HandlerSQS)
 }
 
 // NotifyWorker wraps a handler func and sends an SNS notification on error
+// A panic is recovered, notified and returned as an error.
 func NotifyWorker(h HandlerWorker) HandlerWorker {
-	return func(ctx context.Context, e WorkerEvent) error {
-		err := h(ctx, e)
+	return NotifyHandler(h).(HandlerWorker)
+}
+
+var (
+	contextType  = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+	responseType = reflect.TypeOf(events.APIGatewayProxyResponse{})
+)
+
+// NotifyHandler wraps any handler func that lambda.Start takes and returns a func of the same type
+// The wrapper logs how long the handler took, and sends a notification if it returns an error.
+// A panic is recovered and notified, then returned as a 500 response from an API Gateway handler, or as an error.
+// It panics if h is not a valid handler, like lambda.Start would fail on every invoke.
+func NotifyHandler(h interface{}) interface{} {
+	hv := reflect.ValueOf(h)
+	ht := reflect.TypeOf(h)
+	if err := handlerValidate(ht); err != nil {
+		panic(fmt.Sprintf("NotifyHandler: %s", err))
+	}
+
+	takesContext := ht.NumIn() > 0 && ht.In(0).Implements(contextType)
+	returnsError := ht.NumOut() > 0
+
+	return reflect.MakeFunc(ht, func(args []reflect.Value) (results []reflect.Value) {
+		ctx := context.Background()
+		if takesContext {
+			ctx = args[0].Interface().(context.Context)
+		}
+
+		var e interface{}
+		if len(args) > 0 && !(takesContext && len(args) == 1) {
+			e = args[len(args)-1].Interface()
+		}
+
+		ev := notifyEventFor(e)
+		ctx = withNotifyEvent(ctx, ev)
+		if takesContext {
+			args[0] = reflect.ValueOf(ctx)
+		}
+
+		start := time.Now()
+		defer func() {
+			v := recover()
+			if v != nil {
+				perr := newPanicError(v)
+				ev.Status = http.StatusInternalServerError
+				notify(ctx, perr)
+				results = handlerPanic(ht, e, perr)
+			}
+			log.Printf("Handler %s duration %s\n", ev.Source, time.Since(start))
+
+			if v != nil && !returnsError {
+				// there is no error to return, so fail the invoke like the panic would have
+				panic(v)
+			}
+		}()
+
+		results = hv.Call(args)
+
+		var err error
+		if returnsError {
+			err, _ = results[len(results)-1].Interface().(error)
+		}
+		if len(results) == 2 && ht.Out(0) == responseType {
+			ev.Status = results[0].Interface().(events.APIGatewayProxyResponse).StatusCode
+			if err != nil {
+				// API Gateway responds 502 to a function error
+				ev.Status = http.StatusBadGateway
+			}
+		}
+
 		notify(ctx, err)
-		return err
+		return results
+	}).Interface()
+}
+
+// handlerValidate checks a handler func type with the same rules as lambda.Start
+// It may take a context and an event, and may return a value and an error.
+func handlerValidate(t reflect.Type) error {
+	if t == nil || t.Kind() != reflect.Func {
+		return errors.Errorf("handler kind %v is not func", t)
 	}
+
+	switch {
+	case t.NumIn() > 2:
+		return errors.Errorf("handler takes %d arguments, not at most 2", t.NumIn())
+	case t.NumIn() == 2 && !t.In(0).Implements(contextType):
+		return errors.Errorf("handler takes 2 arguments, but the first is %s, not a context.Context", t.In(0))
+	}
+
+	switch {
+	case t.NumOut() > 2:
+		return errors.Errorf("handler returns %d values, not at most 2", t.NumOut())
+	case t.NumOut() > 0 && !t.Out(t.NumOut()-1).Implements(errorType):
+		return errors.Errorf("handler returns %s last, not an error", t.Out(t.NumOut()-1))
+	}
+
+	return nil
+}
+
+// handlerPanic returns the results of a handler that panicked
+// An API Gateway handler responds with a 500 and the request ID, and others return the panic as the error.
+func handlerPanic(t reflect.Type, e interface{}, err error) []reflect.Value {
+	results := make([]reflect.Value, t.NumOut())
+	for i := range results {
+		results[i] = reflect.Zero(t.Out(i))
+	}
+
+	if req, ok := e.(events.APIGatewayProxyRequest); ok && t.NumOut() == 2 && t.Out(0) == responseType {
+		results[0] = reflect.ValueOf(responsePanic(req.RequestContext.RequestID))
+		return results
+	}
+
+	if len(results) > 0 {
+		results[len(results)-1] = reflect.ValueOf(&err).Elem()
+	}
+	return results
+}
+
+// notifyEventFor returns what a notification says about an event, like the HTTP request or the source
+func notifyEventFor(e interface{}) *notifyEvent {
+	switch e := e.(type) {
+	case events.APIGatewayProxyRequest:
+		return &notifyEvent{APIRequestID: e.RequestContext.RequestID, Method: e.HTTPMethod, Path: e.Path, Source: "aws:apigateway"}
+	case events.CloudWatchEvent:
+		if e.DetailType != "" {
+			return &notifyEvent{Source: fmt.Sprintf("%s (%s)", e.Source, e.DetailType)}
+		}
+		return &notifyEvent{Source: e.Source}
+	case events.DynamoDBEvent:
+		if len(e.Records) > 0 && e.Records[0].EventSourceArn != "" {
+			return &notifyEvent{Source: e.Records[0].EventSourceArn}
+		}
+		return &notifyEvent{Source: "aws:dynamodb"}
+	case events.KinesisEvent:
+		if len(e.Records) > 0 && e.Records[0].EventSourceArn != "" {
+			return &notifyEvent{Source: e.Records[0].EventSourceArn}
+		}
+		return &notifyEvent{Source: "aws:kinesis"}
+	case events.S3Event:
+		if len(e.Records) > 0 {
+			r := e.Records[0]
+			return &notifyEvent{Source: fmt.Sprintf("aws:s3 %s s3://%s/%s", r.EventName, r.S3.Bucket.Name, r.S3.Object.Key)}
+		}
+		return &notifyEvent{Source: "aws:s3"}
+	case events.SNSEvent:
+		if len(e.Records) > 0 && e.Records[0].SNS.TopicArn != "" {
+			return &notifyEvent{Source: e.Records[0].SNS.TopicArn}
+		}
+		return &notifyEvent{Source: "aws:sns"}
+	case events.SQSEvent:
+		if len(e.Records) > 0 && e.Records[0].EventSourceARN != "" {
+			return &notifyEvent{Source: e.Records[0].EventSourceARN}
+		}
+		return &notifyEvent{Source: "aws:sqs"}
+	case CFEvent:
+		return &notifyEvent{Source: fmt.Sprintf("aws:cloudformation %s %s %s", e.RequestType, e.ResourceType, e.LogicalResourceID)}
+	case WorkerEvent:
+		if e.JobID != "" {
+			return &notifyEvent{Source: "worker job " + e.JobID}
+		}
+		return &notifyEvent{Source: "worker"}
+	case nil:
+		return &notifyEvent{Source: "invoke"}
+	}
+	return &notifyEvent{Source: fmt.Sprintf("%T", e)}
 }
 
+// notify logs an error and sends it to every notification sink
+// With a table, repeats of an error are counted and rolled up instead of sent, see notifyRollup.
 func notify(ctx context.Context, err error) {
 	if err == nil {
 		return
 	}
 
-	subj := fmt.Sprintf("ERROR %s", os.Getenv("AWS_LAMBDA_FUNCTION_NAME"))
-	msg := fmt.Sprintf("%+v\n", err)
-	log.Printf("%s %s\n", subj, msg)
+	n := newNotification(ctx, SeverityError, err)
+	log.Printf("%s %s\n", n.Subject, n.Message)
 
-	topic := os.Getenv("NOTIFICATION_TOPIC")
-	if topic == "" {
-		return
+	if Config.Notify.TableName != "" {
+		send, err := notifyCount(ctx, err, n)
+		if err != nil {
+			log.Printf("NotifyError count error %+v\n", err)
+		}
+		if !send {
+			return
+		}
+	}
+
+	Notify(ctx, n)
+}
+
+// newNotification returns a notification for an error with the context of the invocation
+// The function, log group and stream come from the environment Lambda sets up, like in lambdacontext.
+func newNotification(ctx context.Context, s Severity, err error) Notification {
+	fn := os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+	subject := strings.ToUpper(s.String())
+	if fn != "" {
+		subject += " " + fn
+	}
+
+	n := Notification{
+		Function: fn,
+		LogURL:   notifyLogURL(os.Getenv("AWS_REGION"), os.Getenv("AWS_LAMBDA_LOG_GROUP_NAME"), os.Getenv("AWS_LAMBDA_LOG_STREAM_NAME")),
+		Message:  fmt.Sprintf("%+v\n", err),
+		Severity: s,
+		Subject:  fmt.Sprintf("%s: %s", subject, strings.SplitN(err.Error(), "\n", 2)[0]),
+		Time:     time.Now(),
+		Version:  os.Getenv("AWS_LAMBDA_FUNCTION_VERSION"),
+	}
+
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		n.RequestID = lc.AwsRequestID
+	}
+	if h := traceHeader(ctx); h != "" {
+		n.TraceID = xrayheader.FromString(h).TraceID
 	}
+	if ev, ok := ctx.Value(notifyEventKey{}).(*notifyEvent); ok {
+		n.APIRequestID = ev.APIRequestID
+		n.EventSource = ev.Source
+		n.Method = ev.Method
+		n.Path = ev.Path
+		n.Status = ev.Status
+	}
+
+	return n
+}
 
-	_, err = SNS.PublishWithContext(ctx, &sns.PublishInput{
-		Message:  aws.String(msg),
-		Subject:  aws.String(subj),
-		TopicArn: aws.String(topic),
-	})
-	if err != nil {
-		log.Printf("NotifyError SNS Publish error %+v\n", err)
+// notifyLogURL returns a link to a log stream in the CloudWatch console, or "" outside of Lambda
+func notifyLogURL(region, group, stream string) string {
+	if region == "" || group == "" || stream == "" {
+		return ""
 	}
+	return fmt.Sprintf("https://%s.console.aws.amazon.com/cloudwatch/home?region=%s#logEventViewer:group=%s;stream=%s",
+		region, region, url.QueryEscape(group), url.QueryEscape(stream))
 }
@@ -0,0 +1,203 @@
+package gofaas
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifyPanic(t *testing.T) {
+	Config.Notify.Topic = "arn:aws:sns:us-east-1:123456789012:gofaas-NotificationTopic"
+	defer func() { Config.Notify.Topic = "" }()
+
+	ms := &MockSNS{}
+	SNS = ms
+
+	ctx := context.Background()
+
+	err := NotifyCloudWatch(func(ctx context.Context, e events.CloudWatchEvent) error {
+		var m map[string]int
+		m["n"] = 1
+		return nil
+	})(ctx, events.CloudWatchEvent{})
+	assert.EqualError(t, err, "panic: assignment to entry in nil map")
+
+	err = NotifyWorker(func(ctx context.Context, e WorkerEvent) error {
+		panic(fmt.Sprintf("job %s", e.JobID))
+	})(ctx, WorkerEvent{JobID: "26f0dc9f-4483-4b65-8724-3d1598ff6d14"})
+	assert.EqualError(t, err, "panic: job 26f0dc9f-4483-4b65-8724-3d1598ff6d14")
+
+	_, err = NotifySQS(func(ctx context.Context, e events.SQSEvent) (SQSBatchResponse, error) {
+		panic(e.Records[0].MessageId)
+	})(ctx, events.SQSEvent{})
+	assert.EqualError(t, err, "panic: runtime error: index out of range [0] with length 0")
+
+	if assert.Len(t, ms.Inputs, 3) {
+		// the stack starts where the panic happened
+		msg := snsMessage(ms.Inputs[0], "email")
+		assert.Contains(t, msg, "panic: assignment to entry in nil map\ngithub.com/nzoschke/gofaas.TestNotifyPanic.func")
+		assert.Contains(t, msg, "gofaas.NotifyHandler.func1")
+	}
+
+	// an API caller gets the API Gateway request ID that the notification has, not the Lambda one
+	lctx := lambdacontext.NewContext(ctx, &lambdacontext.LambdaContext{AwsRequestID: "c6af9ac6-7b61-11e6-9a41-93e8deadbeef"})
+	r, err := NotifyAPIGateway(func(ctx context.Context, e events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		panic("boom")
+	})(lctx, events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{RequestID: "41b45ea3-70b5-11e6-b7bd-69b5aaebc7d9"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 500, r.StatusCode)
+
+	body := map[string]string{}
+	assert.NoError(t, json.Unmarshal([]byte(r.Body), &body))
+	assert.Equal(t, "41b45ea3-70b5-11e6-b7bd-69b5aaebc7d9", body["request_id"])
+
+	if assert.Len(t, ms.Inputs, 4) {
+		n := Notification{}
+		assert.NoError(t, json.Unmarshal([]byte(snsMessage(ms.Inputs[3], "sqs")), &n))
+		assert.Equal(t, body["request_id"], n.APIRequestID)
+		assert.Equal(t, "c6af9ac6-7b61-11e6-9a41-93e8deadbeef", n.RequestID)
+	}
+
+	// a panic with a stack is fingerprinted by where it happened
+	assert.NotEqual(t, notifyFingerprint(newPanicError("a")), notifyFingerprint(notifyPanicAt()))
+}
+
+func notifyPanicAt() (err error) {
+	defer func() { err = newPanicError(recover()) }()
+	panic("b")
+}
+
+func TestNotifyContext(t *testing.T) {
+	hook := &notifyServer{}
+	s := httptest.NewServer(hook)
+	defer s.Close()
+
+	Config.Notify = NotifyConfig{WebhookSeverity: SeverityError, WebhookURL: Secret(s.URL)}
+	defer func() { Config.Notify = NotifyConfig{} }()
+
+	env := map[string]string{
+		"AWS_LAMBDA_FUNCTION_NAME":    "gofaas-UserReadFunction",
+		"AWS_LAMBDA_FUNCTION_VERSION": "$LATEST",
+		"AWS_LAMBDA_LOG_GROUP_NAME":   "/aws/lambda/gofaas-UserReadFunction",
+		"AWS_LAMBDA_LOG_STREAM_NAME":  "2018/02/22/[$LATEST]8f1c",
+		"AWS_REGION":                  "us-east-1",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "c6af9ac6-7b61-11e6-9a41-93e8deadbeef"})
+	ctx = context.WithValue(ctx, xray.LambdaTraceHeaderKey, "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1")
+
+	_, err := NotifyAPIGateway(func(ctx context.Context, e events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return events.APIGatewayProxyResponse{}, errors.New("boom")
+	})(ctx, events.APIGatewayProxyRequest{
+		HTTPMethod:     "GET",
+		Path:           "/users/6ba7b810",
+		RequestContext: events.APIGatewayProxyRequestContext{RequestID: "41b45ea3-70b5-11e6-b7bd-69b5aaebc7d9"},
+	})
+	assert.EqualError(t, err, "boom")
+
+	if assert.Len(t, hook.bodies(), 1) {
+		n := Notification{}
+		assert.NoError(t, json.Unmarshal([]byte(hook.bodies()[0]), &n))
+		assert.Equal(t, "41b45ea3-70b5-11e6-b7bd-69b5aaebc7d9", n.APIRequestID)
+		assert.Equal(t, "aws:apigateway", n.EventSource)
+		assert.Equal(t, "gofaas-UserReadFunction", n.Function)
+		assert.Equal(t, "https://us-east-1.console.aws.amazon.com/cloudwatch/home?region=us-east-1"+
+			"#logEventViewer:group=%2Faws%2Flambda%2Fgofaas-UserReadFunction;stream=2018%2F02%2F22%2F%5B%24LATEST%5D8f1c", n.LogURL)
+		assert.Equal(t, "GET", n.Method)
+		assert.Equal(t, "/users/6ba7b810", n.Path)
+		assert.Equal(t, "c6af9ac6-7b61-11e6-9a41-93e8deadbeef", n.RequestID)
+		assert.Equal(t, 502, n.Status)
+		assert.Equal(t, "ERROR gofaas-UserReadFunction: boom", n.Subject)
+		assert.Equal(t, "1-5759e988-bd862e3fe1be46a994272793", n.TraceID)
+		assert.Equal(t, "$LATEST", n.Version)
+
+		text := n.Text()
+		assert.Contains(t, text, "Function: gofaas-UserReadFunction:$LATEST\n")
+		assert.Contains(t, text, "Request:  c6af9ac6-7b61-11e6-9a41-93e8deadbeef\n")
+		assert.Contains(t, text, "API Req:  41b45ea3-70b5-11e6-b7bd-69b5aaebc7d9\n")
+		assert.Contains(t, text, "HTTP:     GET /users/6ba7b810 502\n")
+		assert.Contains(t, text, "\nboom\n")
+	}
+
+	// other handlers name their event source
+	NotifySQS(func(ctx context.Context, e events.SQSEvent) (SQSBatchResponse, error) {
+		return SQSBatchResponse{}, errors.New("boom")
+	})(ctx, events.SQSEvent{Records: []events.SQSMessage{{EventSourceARN: "arn:aws:sqs:us-east-1:123456789012:gofaas-WorkerQueue"}}})
+
+	if assert.Len(t, hook.bodies(), 2) {
+		assert.Contains(t, hook.bodies()[1], `"event_source":"arn:aws:sqs:us-east-1:123456789012:gofaas-WorkerQueue"`)
+		assert.NotContains(t, hook.bodies()[1], `"method"`)
+		assert.NotContains(t, hook.bodies()[1], `"api_request_id"`)
+	}
+}
+
+func TestNotifyHandler(t *testing.T) {
+	hook := &notifyServer{}
+	s := httptest.NewServer(hook)
+	defer s.Close()
+
+	Config.Notify = NotifyConfig{WebhookSeverity: SeverityError, WebhookURL: Secret(s.URL)}
+	defer func() { Config.Notify = NotifyConfig{} }()
+
+	ctx := context.Background()
+
+	// any handler signature keeps its type
+	s3 := NotifyHandler(func(ctx context.Context, e events.S3Event) error {
+		return errors.New("boom")
+	}).(func(context.Context, events.S3Event) error)
+	err := s3(ctx, events.S3Event{Records: []events.S3EventRecord{{
+		EventName: "ObjectCreated:Put",
+		S3: events.S3Entity{
+			Bucket: events.S3Bucket{Name: "gofaas-bucket"},
+			Object: events.S3Object{Key: "reports/1.csv"},
+		},
+	}}})
+	assert.EqualError(t, err, "boom")
+
+	cf := NotifyHandler(func(e CFEvent) (string, error) {
+		panic("nil props")
+	}).(func(CFEvent) (string, error))
+	id, err := cf(CFEvent{LogicalResourceID: "ApiGatewayStage", RequestType: "Create", ResourceType: "Custom::ApiGatewayStage"})
+	assert.Equal(t, "", id)
+	assert.EqualError(t, err, "panic: nil props")
+
+	ok := NotifyHandler(func() error { return nil }).(func() error)
+	assert.NoError(t, ok())
+
+	if assert.Len(t, hook.bodies(), 2) {
+		assert.Contains(t, hook.bodies()[0], `"event_source":"aws:s3 ObjectCreated:Put s3://gofaas-bucket/reports/1.csv"`)
+		assert.Contains(t, hook.bodies()[1], `"event_source":"aws:cloudformation Create Custom::ApiGatewayStage ApiGatewayStage"`)
+	}
+
+	// a panic without an error to return still fails the invoke
+	assert.PanicsWithValue(t, "no error", func() {
+		NotifyHandler(func(ctx context.Context) { panic("no error") }).(func(context.Context))(ctx)
+	})
+	assert.Len(t, hook.bodies(), 3)
+
+	// invalid handlers are rejected like lambda.Start would
+	assert.PanicsWithValue(t, "NotifyHandler: handler takes 2 arguments, but the first is string, not a context.Context", func() {
+		NotifyHandler(func(a, b string) error { return nil })
+	})
+	assert.PanicsWithValue(t, "NotifyHandler: handler returns string last, not an error", func() {
+		NotifyHandler(func() string { return "" })
+	})
+	assert.PanicsWithValue(t, "NotifyHandler: handler kind string is not func", func() {
+		NotifyHandler("CFRespond")
+	})
+}
@@ -0,0 +1,67 @@
+package gofaas
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PanicError is a panic recovered in a handler, with the stack of where it happened
+type PanicError struct {
+	Value interface{}
+	stack []uintptr
+}
+
+// newPanicError returns a PanicError for a recovered value
+// It must be called from the deferred function that recovered, so the stack starts at the panic.
+func newPanicError(v interface{}) PanicError {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(3, pcs)
+	pcs = pcs[:n]
+
+	// skip the recovering function and the runtime's panic frames
+	start := 0
+	for i, pc := range pcs {
+		fn := runtime.FuncForPC(pc - 1)
+		if fn != nil && strings.HasPrefix(fn.Name(), "runtime.") {
+			start = i + 1
+		} else if start > 0 {
+			break
+		}
+	}
+
+	return PanicError{Value: v, stack: pcs[start:]}
+}
+
+func (e PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// StackTrace returns the stack of the panic in the format of github.com/pkg/errors
+func (e PanicError) StackTrace() errors.StackTrace {
+	st := make(errors.StackTrace, len(e.stack))
+	for i, pc := range e.stack {
+		st[i] = errors.Frame(pc)
+	}
+	return st
+}
+
+// Format prints the stack with %+v like github.com/pkg/errors
+func (e PanicError) Format(s fmt.State, verb rune) {
+	switch verb {
+	case 'v':
+		if s.Flag('+') {
+			io.WriteString(s, e.Error())
+			e.StackTrace().Format(s, verb)
+			return
+		}
+		fallthrough
+	case 's':
+		io.WriteString(s, e.Error())
+	case 'q':
+		fmt.Fprintf(s, "%q", e.Error())
+	}
+}
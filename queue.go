@@ -0,0 +1,236 @@
+package gofaas
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+)
+
+// SQSBatchResponse reports the messages in a batch that failed so only they are retried
+// The event source mapping needs the ReportBatchItemFailures function response type
+type SQSBatchResponse struct {
+	BatchItemFailures []SQSBatchItemFailure `json:"batchItemFailures"`
+}
+
+// SQSBatchItemFailure identifies a failed message by ID
+type SQSBatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+// deadLetterVisibility hides dead-lettered messages from the consumer for a while after each receive
+var deadLetterVisibility int64 = 60
+
+// WorkerQueue performs the work for a batch of messages from the work queue
+// Failed messages are retried until SQS moves them to the dead-letter queue after the max receive count
+// The batch shares the invocation, so once the deadline is near the messages left are reported failed untried,
+// instead of the invocation timing out and failing the whole batch.
+func WorkerQueue(ctx context.Context, e events.SQSEvent) (SQSBatchResponse, error) {
+	ctx = withDeadlineBudget(ctx)
+	r := SQSBatchResponse{
+		BatchItemFailures: []SQSBatchItemFailure{},
+	}
+
+	for _, m := range e.Records {
+		if DeadlineNear(ctx) {
+			log.Printf("WorkerQueue message %s left for a new invocation near the deadline\n", m.MessageId)
+			r.BatchItemFailures = append(r.BatchItemFailures, SQSBatchItemFailure{ItemIdentifier: m.MessageId})
+			continue
+		}
+
+		ev := WorkerEvent{}
+		err := json.Unmarshal([]byte(m.Body), &ev)
+		if err == nil {
+			err = runWorker(ctx, ev, true)
+		}
+
+		if err != nil {
+			log.Printf("WorkerQueue message %s receive %s error %+v\n", m.MessageId, m.Attributes["ApproximateReceiveCount"], err)
+			r.BatchItemFailures = append(r.BatchItemFailures, SQSBatchItemFailure{ItemIdentifier: m.MessageId})
+		}
+	}
+
+	return r, nil
+}
+
+// WorkerDeadLetter runs on a schedule to mark the jobs in the dead-letter queue failed and notify
+// Messages are left in the queue for Redrive, so a job is only notified about once until it is redriven
+// Messages without a job can't be redriven or tracked, so they are deleted after notifying
+func WorkerDeadLetter(ctx context.Context, e events.CloudWatchEvent) error {
+	for ctx.Err() == nil {
+		out, err := SQS.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			AttributeNames:      []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount)},
+			MaxNumberOfMessages: aws.Int64(10),
+			QueueUrl:            aws.String(Config.DeadLetter.QueueURL),
+			VisibilityTimeout:   aws.Int64(deadLetterVisibility),
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if len(out.Messages) == 0 {
+			return nil
+		}
+
+		for _, m := range out.Messages {
+			if err := deadLetter(ctx, m); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	return errors.WithStack(ctx.Err())
+}
+
+func deadLetter(ctx context.Context, m *sqs.Message) error {
+	n := aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount])
+
+	var j *Job
+	e := WorkerEvent{}
+	if err := json.Unmarshal([]byte(aws.StringValue(m.Body)), &e); err == nil && e.JobID != "" {
+		j, err = jobGet(ctx, e.JobID)
+		if _, ok := err.(ResponseError); err != nil && !ok {
+			return errors.WithStack(err)
+		}
+	}
+
+	if j == nil {
+		notify(ctx, errors.Errorf("dead-lettered message %s without a job after %s receives: %s", aws.StringValue(m.MessageId), n, aws.StringValue(m.Body)))
+
+		_, err := SQS.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(Config.DeadLetter.QueueURL),
+			ReceiptHandle: m.ReceiptHandle,
+		})
+		return errors.WithStack(err)
+	}
+
+	if e.Shard > 0 {
+		err := shardFinish(ctx, e, errors.Errorf("job %s shard %d dead-lettered after %s receives", j.ID, e.Shard, n))
+		if err != nil {
+			notify(ctx, err)
+		}
+		return nil
+	}
+
+	if j.Status == JobCancelled || j.Status == JobFailed || j.Status == JobSucceeded {
+		return nil
+	}
+
+	// the worker that would have cancelled the job gave up on it
+	if j.CancelRequested {
+		return jobCancel(ctx, j)
+	}
+
+	err := errors.Errorf("job %s dead-lettered after %s receives, last error: %s", j.ID, n, j.Error)
+	j.finish(err)
+	if err := jobPut(ctx, j); err != nil {
+		return errors.WithStack(err)
+	}
+	quotaRelease(ctx, j.ID)
+
+	notify(ctx, err)
+	return nil
+}
+
+// Redrive moves messages from a dead-letter queue back to a queue, queueing their failed jobs again
+// It returns the number of messages moved
+func Redrive(ctx context.Context, from, to string) (int, error) {
+	n := 0
+
+	for {
+		out, err := SQS.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			MaxNumberOfMessages:   aws.Int64(10),
+			MessageAttributeNames: []*string{aws.String("All")},
+			QueueUrl:              aws.String(from),
+		})
+		if err != nil {
+			return n, errors.WithStack(err)
+		}
+		if len(out.Messages) == 0 {
+			return n, nil
+		}
+
+		for _, m := range out.Messages {
+			if err := redriveJob(ctx, m); err != nil {
+				// a job over quota is left in the dead-letter queue for a later redrive
+				if _, ok := errors.Cause(err).(QuotaError); ok {
+					log.Printf("Redrive message %s skipped: %s\n", aws.StringValue(m.MessageId), err)
+					continue
+				}
+				return n, errors.WithStack(err)
+			}
+
+			_, err := SQS.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+				MessageAttributes: m.MessageAttributes,
+				MessageBody:       m.Body,
+				QueueUrl:          aws.String(to),
+			})
+			if err != nil {
+				return n, errors.WithStack(err)
+			}
+
+			_, err = SQS.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(from),
+				ReceiptHandle: m.ReceiptHandle,
+			})
+			if err != nil {
+				return n, errors.WithStack(err)
+			}
+
+			n++
+		}
+	}
+}
+
+// redriveJob queues the failed job or fan-out shard of a message again
+func redriveJob(ctx context.Context, m *sqs.Message) error {
+	e := WorkerEvent{}
+	if err := json.Unmarshal([]byte(aws.StringValue(m.Body)), &e); err != nil || e.JobID == "" {
+		return nil
+	}
+
+	j, err := jobGet(ctx, e.JobID)
+	if err != nil {
+		if _, ok := err.(ResponseError); ok {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+
+	if e.Shard == 0 && j.Status != JobFailed {
+		return nil
+	}
+
+	// a failed job freed its concurrent slot, so it takes one again before it is queued
+	acquired := false
+	if j.Status == JobFailed && !j.QuotaHeld {
+		if err := quotaAcquire(ctx, j, false); err != nil {
+			return err
+		}
+		acquired = j.QuotaHeld
+	}
+
+	if e.Shard > 0 {
+		err = shardRequeue(ctx, j, e.Shard)
+	} else {
+		_, err = jobUpdate(ctx, j.ID,
+			"SET #status = :queued, quota_held = :held REMOVE #error, time_end, time_start",
+			"#status = :failed",
+			map[string]string{"#error": "error", "#status": "status"},
+			map[string]interface{}{":failed": JobFailed, ":held": j.QuotaHeld, ":queued": JobQueued},
+		)
+	}
+	if err != nil {
+		if acquired {
+			quotaFree(ctx, j.Subject, j.ID)
+		}
+		if jobConflict(err) {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package gofaas
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkQueue(t *testing.T) {
+	Config.DeadLetter.QueueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/gofaas-WorkDeadLetterQueue"
+	Config.Jobs.TableName = "gofaas-JobsTable"
+	Config.Notify.Topic = "arn:aws:sns:us-east-1:123456789012:gofaas-NotificationTopic"
+	Config.Work.QueueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/gofaas-WorkQueue"
+	defer func() {
+		Config.Notify.Topic = ""
+		Config.Work.QueueURL = ""
+	}()
+
+	ids := []string{"26f0dc9f-4483-4b65-8724-3d1598ff6d14", "7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d"}
+	UUIDGen = func() uuid.UUID {
+		id := ids[0]
+		ids = ids[1:]
+		return uuid.Must(uuid.FromString(id))
+	}
+
+	ml := &MockLambda{}
+	ms3 := &MockS3{}
+	ms := &MockSNS{}
+	mq := &MockSQS{}
+
+	DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+	Lambda = ml
+	S3 = FaultS3{ms3, &Faults{Faults: []Fault{{Op: "PutObject", Call: 2, Err: ErrThrottling("SlowDown")}}}}
+	SNS = ms
+	SQS = mq
+
+	ctx := context.Background()
+
+	for _, body := range []string{`{"n": 1}`, `{"n": 2}`} {
+		r, err := WorkCreate(ctx, events.APIGatewayProxyRequest{Body: body})
+		assert.NoError(t, err)
+		assert.Equal(t, 202, r.StatusCode)
+	}
+
+	assert.Len(t, ml.Inputs, 0)
+	assert.Len(t, mq.Queues[Config.Work.QueueURL], 2)
+
+	// the second job fails and is reported so only it is retried
+	r, err := WorkerQueue(ctx, sqsEvent(t, mq, Config.Work.QueueURL))
+	assert.NoError(t, err)
+	assert.Equal(t, SQSBatchResponse{
+		BatchItemFailures: []SQSBatchItemFailure{{ItemIdentifier: "message-2"}},
+	}, r)
+
+	j := workQueueJob(t, "26f0dc9f-4483-4b65-8724-3d1598ff6d14")
+	assert.Equal(t, JobSucceeded, j.Status)
+
+	j = workQueueJob(t, "7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d")
+	assert.Equal(t, JobQueued, j.Status)
+	assert.Contains(t, j.Error, "SlowDown")
+	assert.Len(t, ms.Inputs, 0)
+
+	// after the max receive count SQS moves the message to the dead-letter queue
+	m := &sqs.Message{
+		Attributes:    map[string]*string{"ApproximateReceiveCount": aws.String("3")},
+		Body:          aws.String(`{"job_id": "7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d"}`),
+		MessageId:     aws.String("message-2"),
+		ReceiptHandle: aws.String("receipt-message-2"),
+	}
+	mq.Queues[Config.DeadLetter.QueueURL] = []*sqs.Message{
+		m,
+		{
+			Body:          aws.String(`not json`),
+			MessageId:     aws.String("message-3"),
+			ReceiptHandle: aws.String("receipt-message-3"),
+		},
+	}
+
+	mq.inflight = nil
+	assert.NoError(t, WorkerDeadLetter(ctx, events.CloudWatchEvent{}))
+
+	j = workQueueJob(t, "7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d")
+	assert.Equal(t, JobFailed, j.Status)
+	assert.Contains(t, j.Error, "dead-lettered after 3 receives, last error: SlowDown")
+
+	if assert.Len(t, ms.Inputs, 2) {
+		assert.Contains(t, *ms.Inputs[0].Message, "job 7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d dead-lettered")
+		assert.Contains(t, *ms.Inputs[1].Message, "message message-3 without a job")
+	}
+
+	// the job message is left for redrive, and is only notified about once
+	assert.Equal(t, 1, mq.InFlight())
+	mq.inflight = nil
+	mq.Queues[Config.DeadLetter.QueueURL] = []*sqs.Message{m}
+
+	assert.NoError(t, WorkerDeadLetter(ctx, events.CloudWatchEvent{}))
+	assert.Len(t, ms.Inputs, 2)
+
+	mq.inflight = nil
+	mq.Queues[Config.DeadLetter.QueueURL] = []*sqs.Message{m}
+
+	n, err := Redrive(ctx, Config.DeadLetter.QueueURL, Config.Work.QueueURL)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Len(t, mq.Queues[Config.DeadLetter.QueueURL], 0)
+	assert.Equal(t, 0, mq.InFlight())
+
+	j = workQueueJob(t, "7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d")
+	assert.Equal(t, JobQueued, j.Status)
+	assert.Empty(t, j.Error)
+
+	r, err = WorkerQueue(ctx, sqsEvent(t, mq, Config.Work.QueueURL))
+	assert.NoError(t, err)
+	assert.Len(t, r.BatchItemFailures, 0)
+
+	j = workQueueJob(t, "7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d")
+	assert.Equal(t, JobSucceeded, j.Status)
+}
+
+func TestWorkerQueueDeadline(t *testing.T) {
+	Config.Jobs.TableName = "gofaas-JobsTable"
+	Config.Work.QueueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/gofaas-WorkQueue"
+	defer func() { Config.Work.QueueURL = "" }()
+
+	ids := []string{"26f0dc9f-4483-4b65-8724-3d1598ff6d14", "7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d"}
+	UUIDGen = func() uuid.UUID {
+		id := ids[0]
+		ids = ids[1:]
+		return uuid.Must(uuid.FromString(id))
+	}
+
+	mq := &MockSQS{}
+
+	DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+	S3 = &MockS3{}
+	SQS = mq
+
+	ctx := context.Background()
+
+	for _, body := range []string{`{"n": 1}`, `{"n": 2}`} {
+		r, err := WorkCreate(ctx, events.APIGatewayProxyRequest{Body: body})
+		assert.NoError(t, err)
+		assert.Equal(t, 202, r.StatusCode)
+	}
+
+	// near the deadline the messages are reported failed without running, so they are retried
+	defer deadlineNearAlways()()
+	wctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	r, err := WorkerQueue(wctx, sqsEvent(t, mq, Config.Work.QueueURL))
+	assert.NoError(t, err)
+	assert.Equal(t, SQSBatchResponse{
+		BatchItemFailures: []SQSBatchItemFailure{{ItemIdentifier: "message-1"}, {ItemIdentifier: "message-2"}},
+	}, r)
+
+	for _, id := range []string{"26f0dc9f-4483-4b65-8724-3d1598ff6d14", "7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d"} {
+		j := workQueueJob(t, id)
+		assert.Equal(t, JobQueued, j.Status)
+		assert.Nil(t, j.TimeStart)
+	}
+}
+
+func TestWorkerQueueTrace(t *testing.T) {
+	Config.Jobs.TableName = "gofaas-JobsTable"
+	Config.Work.QueueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/gofaas-WorkQueue"
+	defer func() { Config.Work.QueueURL = "" }()
+
+	UUIDGen = func() uuid.UUID {
+		return uuid.Must(uuid.FromString("26f0dc9f-4483-4b65-8724-3d1598ff6d14"))
+	}
+
+	md := &traceDynamoDB{DynamoDBAPI: &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}}
+	mq := &MockSQS{}
+
+	DynamoDB = md
+	S3 = &MockS3{}
+	SQS = mq
+
+	ctx, seg := xray.BeginSegment(context.Background(), "WorkCreate")
+	r, err := WorkCreate(ctx, events.APIGatewayProxyRequest{Body: `{"n": 1}`})
+	seg.Close(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+
+	// the queue invocation has its own trace, but the work continues the caller's
+	md.traces = nil
+	lctx := context.WithValue(context.Background(), xray.LambdaTraceHeaderKey, "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1")
+	resp, err := WorkerQueue(lctx, sqsEvent(t, mq, Config.Work.QueueURL))
+	assert.NoError(t, err)
+	assert.Len(t, resp.BatchItemFailures, 0)
+
+	if assert.NotEmpty(t, md.traces) {
+		for _, id := range md.traces {
+			assert.Equal(t, seg.TraceID, id)
+		}
+	}
+
+	e := WorkerEvent{TraceHeader: "Root=" + seg.TraceID + ";Parent=" + seg.ID + ";Sampled=1"}
+	wctx, wseg := workerSegment(lctx, e)
+	if assert.NotNil(t, wseg) {
+		assert.Equal(t, seg.TraceID, xray.TraceID(wctx))
+		assert.Equal(t, seg.ID, wseg.ParentID)
+		assert.Equal(t, "1-5759e988-bd862e3fe1be46a994272793", wseg.Annotations["invocation_trace_id"])
+		wseg.Close(nil)
+	}
+
+	// a direct invoke that Lambda already continued the trace of gets a subsegment
+	e.TraceHeader = "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"
+	_, wseg = workerSegment(lctx, e)
+	if assert.NotNil(t, wseg) {
+		assert.Equal(t, "1-5759e988-bd862e3fe1be46a994272793", wseg.ParentSegment.TraceID)
+		assert.Nil(t, wseg.Annotations["invocation_trace_id"])
+		wseg.Close(nil)
+	}
+}
+
+// traceDynamoDB records the trace ID of every job update, like the X-Ray instrumented client sends it
+type traceDynamoDB struct {
+	DynamoDBAPI
+
+	traces []string
+}
+
+func (d *traceDynamoDB) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	d.traces = append(d.traces, xray.TraceID(ctx))
+	return d.DynamoDBAPI.UpdateItemWithContext(ctx, input, opts...)
+}
+
+func TestRedriveQuota(t *testing.T) {
+	Config.DeadLetter.QueueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/gofaas-WorkDeadLetterQueue"
+	Config.Jobs.TableName = "gofaas-JobsTable"
+	Config.Quota = QuotaConfig{Concurrent: 1, Daily: 10, TableName: "gofaas-QuotaTable"}
+	Config.Work.QueueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/gofaas-WorkQueue"
+	defer func() {
+		Config.Quota = QuotaConfig{}
+		Config.Work.QueueURL = ""
+	}()
+
+	UUIDGen = func() uuid.UUID {
+		return uuid.Must(uuid.FromString("26f0dc9f-4483-4b65-8724-3d1598ff6d14"))
+	}
+
+	mq := &MockSQS{}
+
+	DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+	SQS = mq
+
+	ctx := context.Background()
+
+	r, err := WorkCreate(ctx, events.APIGatewayProxyRequest{Body: `{"n": 1}`})
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+
+	assert.NoError(t, jobPut(ctx, &Job{ID: "7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d", Error: "SlowDown", Status: JobFailed}))
+	m := &sqs.Message{
+		Body:          aws.String(`{"job_id": "7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d"}`),
+		MessageId:     aws.String("message-2"),
+		ReceiptHandle: aws.String("receipt-message-2"),
+	}
+
+	// a failed job over the concurrent quota is left in the dead-letter queue
+	mq.Queues[Config.DeadLetter.QueueURL] = []*sqs.Message{m}
+
+	n, err := Redrive(ctx, Config.DeadLetter.QueueURL, Config.Work.QueueURL)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 1, mq.InFlight())
+	assert.Len(t, mq.Queues[Config.Work.QueueURL], 1)
+
+	j, err := jobGet(ctx, "7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d")
+	assert.NoError(t, err)
+	assert.Equal(t, JobFailed, j.Status)
+	assert.False(t, j.QuotaHeld)
+
+	// once a slot is free the job takes it and is queued again
+	quotaRelease(ctx, "26f0dc9f-4483-4b65-8724-3d1598ff6d14")
+	mq.inflight = nil
+	mq.Queues[Config.DeadLetter.QueueURL] = []*sqs.Message{m}
+
+	n, err = Redrive(ctx, Config.DeadLetter.QueueURL, Config.Work.QueueURL)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Len(t, mq.Queues[Config.Work.QueueURL], 2)
+
+	j, err = jobGet(ctx, "7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d")
+	assert.NoError(t, err)
+	assert.Equal(t, JobQueued, j.Status)
+	assert.Empty(t, j.Error)
+	assert.True(t, j.QuotaHeld)
+	assert.Equal(t, []string{"7d5c6a9e-7e7b-4f7c-9f0f-6b8f7b1a2c3d"}, quotaLeases(t))
+}
+
+// sqsEvent receives every message in a queue as an SQSEvent like the event source mapping does
+func sqsEvent(t *testing.T, mq *MockSQS, url string) events.SQSEvent {
+	out, err := mq.ReceiveMessageWithContext(context.Background(), &sqs.ReceiveMessageInput{
+		MaxNumberOfMessages: aws.Int64(10),
+		QueueUrl:            aws.String(url),
+	})
+	assert.NoError(t, err)
+
+	e := events.SQSEvent{}
+	for _, m := range out.Messages {
+		e.Records = append(e.Records, events.SQSMessage{
+			Attributes:    map[string]string{"ApproximateReceiveCount": "1"},
+			Body:          *m.Body,
+			MessageId:     *m.MessageId,
+			ReceiptHandle: *m.ReceiptHandle,
+		})
+	}
+	return e
+}
+
+func workQueueJob(t *testing.T, id string) Job {
+	r, err := WorkRead(context.Background(), events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"id": id},
+	})
+	assert.NoError(t, err)
+
+	j := Job{}
+	assert.NoError(t, json.Unmarshal([]byte(r.Body), &j))
+	return j
+}
@@ -0,0 +1,348 @@
+package gofaas
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/pkg/errors"
+)
+
+var (
+	// quotaLease is how long a job holds its concurrent slot unless its worker renews it
+	// A job whose worker crashed, ran out of memory or timed out frees its slot once the lease expires.
+	quotaLease = 15 * time.Minute
+
+	// quotaRetryAfter is how long a caller over the concurrent jobs quota is asked to wait
+	quotaRetryAfter = 30 * time.Second
+)
+
+// QuotaOverride changes the limits of a subject, where a zero limit uses the default
+type QuotaOverride struct {
+	Concurrent int `json:"concurrent,omitempty"`
+	Daily      int `json:"daily,omitempty"`
+}
+
+// QuotaError is the error for work over a quota, with how long until the caller may retry
+type QuotaError struct {
+	Limit      int
+	Name       string
+	RetryAfter time.Duration
+}
+
+func (e QuotaError) Error() string {
+	return fmt.Sprintf("quota of %d %s exceeded", e.Limit, e.Name)
+}
+
+// Response returns a 429 API Gateway Response event with a Retry-After header
+func (e QuotaError) Response() (events.APIGatewayProxyResponse, error) {
+	r, err := ResponseError{e.Error(), 429}.Response()
+	r.Headers = map[string]string{
+		"Retry-After": strconv.Itoa(int((e.RetryAfter + time.Second - 1) / time.Second)),
+	}
+	return r, err
+}
+
+// quotaLimits returns the concurrent jobs and jobs per day limits of a subject
+func quotaLimits(ctx context.Context, subject string) (int, int, error) {
+	concurrent, daily := Config.Quota.Concurrent, Config.Quota.Daily
+	if concurrent == 0 {
+		concurrent = 5
+	}
+	if daily == 0 {
+		daily = 100
+	}
+
+	o, err := QuotaGet(ctx, subject)
+	if err != nil {
+		return 0, 0, errors.WithStack(err)
+	}
+	if o.Concurrent > 0 {
+		concurrent = o.Concurrent
+	}
+	if o.Daily > 0 {
+		daily = o.Daily
+	}
+
+	return concurrent, daily, nil
+}
+
+// quotaAcquire counts a new or retried job against the concurrent jobs quota of its subject, and a new job
+// against the jobs per day quota if daily is set. It returns a QuotaError if either is exceeded,
+// or marks the job as holding a concurrent slot until quotaRelease. Quotas are off without a table.
+func quotaAcquire(ctx context.Context, j *Job, daily bool) error {
+	if Config.Quota.TableName == "" {
+		return nil
+	}
+
+	concurrent, perDay, err := quotaLimits(ctx, j.Subject)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	ok, err := quotaTake(ctx, j.Subject, j.ID, concurrent)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !ok {
+		return QuotaError{concurrent, "concurrent jobs", quotaRetryAfter}
+	}
+
+	if daily {
+		now := time.Now().UTC()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+
+		err = quotaAdd(ctx, "daily/"+j.Subject+"/"+now.Format("2006-01-02"), perDay, midnight)
+		if err != nil {
+			quotaFree(ctx, j.Subject, j.ID)
+			if jobConflict(err) {
+				return QuotaError{perDay, "jobs per day", midnight.Sub(now)}
+			}
+			return errors.WithStack(err)
+		}
+	}
+
+	j.QuotaHeld = true
+	return nil
+}
+
+// quotaRelease frees the concurrent slot a job holds once it ends
+// The job's quota_held attribute is removed first so a job is only released once
+func quotaRelease(ctx context.Context, id string) {
+	if Config.Quota.TableName == "" {
+		return
+	}
+
+	j, err := jobUpdate(ctx, id,
+		"REMOVE quota_held",
+		"quota_held = :true",
+		nil,
+		map[string]interface{}{":true": true},
+	)
+	if err != nil {
+		if !jobConflict(err) {
+			log.Printf("Job %s quota release error %+v\n", id, err)
+		}
+		return
+	}
+
+	quotaFree(ctx, j.Subject, id)
+}
+
+// quotaRunning is the item of the concurrent slots of a subject: the lease expiry of each job by ID
+// Version changes with every slot taken, so expired leases are removed without racing another taker.
+type quotaRunning struct {
+	Jobs    map[string]int64 `dynamodbav:"jobs"`
+	Version int              `dynamodbav:"version"`
+}
+
+// quotaTake takes a concurrent slot lease for a job if the subject has fewer than limit unexpired leases,
+// removing the expired ones. It returns false if the subject is at the limit.
+func quotaTake(ctx context.Context, subject, id string, limit int) (bool, error) {
+	key := "running/" + subject
+
+	for i := 0; i < 5; i++ {
+		out, err := DynamoDB.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			ConsistentRead: aws.Bool(true),
+			Key: map[string]*dynamodb.AttributeValue{
+				"id": &dynamodb.AttributeValue{
+					S: aws.String(key),
+				},
+			},
+			TableName: aws.String(Config.Quota.TableName),
+		})
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+
+		r := quotaRunning{}
+		if err := dynamodbattribute.UnmarshalMap(out.Item, &r); err != nil {
+			return false, errors.WithStack(err)
+		}
+
+		now := time.Now()
+		expires := now.Add(quotaLease).Unix()
+
+		live := 0
+		remove := []string{}
+		names := map[string]string{"#jobs": "jobs"}
+		for _, job := range quotaJobs(r) {
+			switch {
+			case job == id:
+			case r.Jobs[job] > now.Unix():
+				live++
+			default:
+				n := fmt.Sprintf("#expired%d", len(remove))
+				names[n] = job
+				remove = append(remove, "#jobs."+n)
+			}
+		}
+		if live >= limit {
+			return false, nil
+		}
+
+		update := "SET #jobs.#job = :expires, version = :next"
+		cond := "version = :version"
+		names["#job"] = id
+		values := map[string]interface{}{":expires": expires, ":next": r.Version + 1, ":version": r.Version}
+
+		if r.Jobs == nil {
+			// nested attributes can only be set in a map that exists
+			update = "SET #jobs = :jobs, version = :next"
+			delete(names, "#job")
+			delete(values, ":expires")
+			values[":jobs"] = map[string]int64{id: expires}
+		}
+		if r.Version == 0 {
+			cond = "attribute_not_exists(version)"
+			delete(values, ":version")
+		}
+		if len(remove) > 0 {
+			update += " REMOVE " + strings.Join(remove, ", ")
+		}
+
+		err = quotaUpdate(ctx, key, update, cond, names, values)
+		if jobConflict(err) {
+			continue
+		}
+		return err == nil, errors.WithStack(err)
+	}
+
+	return false, errors.Errorf("quota %s changed by too many jobs at once", key)
+}
+
+// quotaJobs returns the IDs of the jobs with leases in order
+func quotaJobs(r quotaRunning) []string {
+	ids := []string{}
+	for id := range r.Jobs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// quotaRenew extends the concurrent slot lease of a job when its worker starts or continues it
+// A lease that expired and was taken by another job is added back, since the job is running.
+func quotaRenew(ctx context.Context, j *Job) {
+	if Config.Quota.TableName == "" || !j.QuotaHeld {
+		return
+	}
+
+	err := quotaUpdate(ctx, "running/"+j.Subject,
+		"SET #jobs.#job = :expires",
+		"attribute_exists(#jobs)",
+		map[string]string{"#job": j.ID, "#jobs": "jobs"},
+		map[string]interface{}{":expires": time.Now().Add(quotaLease).Unix()},
+	)
+	if err != nil && !jobConflict(err) {
+		log.Printf("Job %s quota renew error %+v\n", j.ID, err)
+	}
+}
+
+// quotaFree removes the concurrent slot lease of a job
+func quotaFree(ctx context.Context, subject, id string) {
+	err := quotaUpdate(ctx, "running/"+subject,
+		"REMOVE #jobs.#job",
+		"attribute_exists(#jobs)",
+		map[string]string{"#job": id, "#jobs": "jobs"},
+		nil,
+	)
+	if err != nil && !jobConflict(err) {
+		log.Printf("Quota %q job %s free error %+v\n", subject, id, err)
+	}
+}
+
+// quotaAdd atomically adds 1 to a counter if it keeps it within limit
+// The counter is deleted by the table TTL a day after it expires.
+func quotaAdd(ctx context.Context, id string, limit int, expires time.Time) error {
+	return quotaUpdate(ctx, id,
+		"ADD #n :n SET expires = :expires",
+		"attribute_not_exists(#n) OR #n < :limit",
+		map[string]string{"#n": "n"},
+		map[string]interface{}{":expires": expires.Add(24 * time.Hour).Unix(), ":limit": limit, ":n": 1},
+	)
+}
+
+// quotaUpdate updates a quota item with an update expression if the condition holds
+// Values are marshalled with dynamodbattribute. Use jobConflict to check for a failed condition.
+func quotaUpdate(ctx context.Context, id, update, cond string, names map[string]string, values map[string]interface{}) error {
+	input := &dynamodb.UpdateItemInput{
+		ConditionExpression:      aws.String(cond),
+		ExpressionAttributeNames: aws.StringMap(names),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: aws.String(id),
+			},
+		},
+		TableName:        aws.String(Config.Quota.TableName),
+		UpdateExpression: aws.String(update),
+	}
+
+	if len(values) > 0 {
+		vs, err := dynamodbattribute.MarshalMap(values)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		input.ExpressionAttributeValues = vs
+	}
+
+	_, err := DynamoDB.UpdateItemWithContext(ctx, input)
+	return errors.WithStack(err)
+}
+
+// QuotaGet returns the override of a subject's limits
+func QuotaGet(ctx context.Context, subject string) (QuotaOverride, error) {
+	o := QuotaOverride{}
+
+	out, err := DynamoDB.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: aws.String("override/" + subject),
+			},
+		},
+		TableName: aws.String(Config.Quota.TableName),
+	})
+	if err != nil {
+		return o, errors.WithStack(err)
+	}
+
+	err = dynamodbattribute.UnmarshalMap(out.Item, &o)
+	return o, errors.WithStack(err)
+}
+
+// QuotaSet overrides a subject's limits, or removes the override if both limits are zero
+func QuotaSet(ctx context.Context, subject string, o QuotaOverride) error {
+	key := map[string]*dynamodb.AttributeValue{
+		"id": &dynamodb.AttributeValue{
+			S: aws.String("override/" + subject),
+		},
+	}
+
+	if o == (QuotaOverride{}) {
+		_, err := DynamoDB.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			Key:       key,
+			TableName: aws.String(Config.Quota.TableName),
+		})
+		return errors.WithStack(err)
+	}
+
+	item, err := dynamodbattribute.MarshalMap(o)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	item["id"] = key["id"]
+
+	_, err = DynamoDB.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(Config.Quota.TableName),
+	})
+	return errors.WithStack(err)
+}
@@ -0,0 +1,177 @@
+package gofaas
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuota(t *testing.T) {
+	Config.Jobs.TableName = "gofaas-JobsTable"
+	Config.Quota = QuotaConfig{Concurrent: 2, Daily: 3, TableName: "gofaas-QuotaTable"}
+	Config.Work.WorkerFunctionName = "gofaas-WorkerFunction"
+	Config.Worker.Bucket = "gofaas-bucket"
+	defer func() { Config.Quota = QuotaConfig{} }()
+
+	n := 0
+	UUIDGen = func() uuid.UUID {
+		n++
+		return uuid.Must(uuid.FromString("26f0dc9f-4483-4b65-8724-3d1598ff6d1" + strconv.Itoa(n)))
+	}
+
+	ml := &MockLambda{}
+
+	DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+	Lambda = ml
+	S3 = &MockS3{}
+
+	ctx := context.Background()
+	create := func() events.APIGatewayProxyResponse {
+		r, err := WorkCreate(ctx, events.APIGatewayProxyRequest{Body: `{"n": 1}`})
+		assert.NoError(t, err)
+		return r
+	}
+
+	// two jobs run at once, then the concurrent limit is hit
+	assert.Equal(t, 202, create().StatusCode)
+	assert.Equal(t, 202, create().StatusCode)
+
+	r := create()
+	assert.Equal(t, 429, r.StatusCode)
+	assert.Equal(t, "30", r.Headers["Retry-After"])
+	assert.Equal(t, `{"error": "quota of 2 concurrent jobs exceeded"}`+"\n", r.Body)
+	assert.Equal(t, 2, len(quotaLeases(t)))
+
+	// a finished job frees its slot once, even if released again
+	e := WorkerEvent{}
+	assert.NoError(t, json.Unmarshal(ml.Inputs[0].Payload, &e))
+	assert.NoError(t, Worker(ctx, e))
+	quotaRelease(ctx, e.JobID)
+	assert.Equal(t, 1, len(quotaLeases(t)))
+
+	// a cancelled job frees its slot
+	r = create()
+	assert.Equal(t, 202, r.StatusCode)
+	assert.Equal(t, 2, len(quotaLeases(t)))
+
+	j := Job{}
+	assert.NoError(t, json.Unmarshal([]byte(r.Body), &j))
+	r, err := workCancel(ctx, j.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+	assert.Equal(t, 1, len(quotaLeases(t)))
+
+	// that was the third job of the day
+	r = create()
+	assert.Equal(t, 429, r.StatusCode)
+	assert.Equal(t, `{"error": "quota of 3 jobs per day exceeded"}`+"\n", r.Body)
+	after, err := strconv.Atoi(r.Headers["Retry-After"])
+	assert.NoError(t, err)
+	assert.True(t, after > 0 && after <= 86400)
+	assert.Equal(t, 1, len(quotaLeases(t)))
+
+	// an override raises the limits of a subject
+	assert.NoError(t, QuotaSet(ctx, "", QuotaOverride{Daily: 10}))
+	o, err := QuotaGet(ctx, "")
+	assert.NoError(t, err)
+	assert.Equal(t, QuotaOverride{Daily: 10}, o)
+
+	assert.Equal(t, 202, create().StatusCode)
+	assert.Equal(t, 429, create().StatusCode)
+	assert.Equal(t, 2, len(quotaLeases(t)))
+
+	assert.NoError(t, QuotaSet(ctx, "", QuotaOverride{}))
+	o, err = QuotaGet(ctx, "")
+	assert.NoError(t, err)
+	assert.Equal(t, QuotaOverride{}, o)
+}
+
+func TestQuotaLease(t *testing.T) {
+	Config.Jobs.TableName = "gofaas-JobsTable"
+	Config.Quota = QuotaConfig{Concurrent: 1, Daily: 10, TableName: "gofaas-QuotaTable"}
+	Config.Work.WorkerFunctionName = "gofaas-WorkerFunction"
+	Config.Worker.Bucket = "gofaas-bucket"
+	defer func() { Config.Quota = QuotaConfig{} }()
+
+	ml := &MockLambda{}
+
+	DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+	Lambda = ml
+	S3 = &MockS3{}
+
+	ctx := context.Background()
+	create := func() Job {
+		r, err := WorkCreate(ctx, events.APIGatewayProxyRequest{Body: `{"n": 1}`})
+		assert.NoError(t, err)
+		assert.Equal(t, 202, r.StatusCode)
+
+		j := Job{}
+		assert.NoError(t, json.Unmarshal([]byte(r.Body), &j))
+		return j
+	}
+
+	// a job whose worker never ends it holds its slot until the lease expires
+	lease := quotaLease
+	quotaLease = -time.Minute
+	leaked := create()
+	quotaLease = lease
+
+	assert.Equal(t, []string{leaked.ID}, quotaLeases(t))
+	j := create()
+	assert.Equal(t, []string{j.ID}, quotaLeases(t))
+
+	// the worker renews the lease of its job
+	e := WorkerEvent{}
+	assert.NoError(t, json.Unmarshal(ml.Inputs[1].Payload, &e))
+
+	md := &quotaRenewDynamoDB{DynamoDBAPI: DynamoDB, t: t, id: j.ID}
+	DynamoDB = md
+	assert.NoError(t, Worker(ctx, e))
+	assert.Equal(t, 1, md.renewed)
+
+	assert.Equal(t, []string{}, quotaLeases(t))
+}
+
+// quotaRenewDynamoDB checks a job's lease is renewed before its worker ends it
+type quotaRenewDynamoDB struct {
+	DynamoDBAPI
+	id      string
+	renewed int
+	t       *testing.T
+}
+
+func (m *quotaRenewDynamoDB) UpdateItemWithContext(ctx aws.Context, in *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	if aws.StringValue(in.UpdateExpression) == "SET #jobs.#job = :expires" {
+		assert.Equal(m.t, m.id, aws.StringValue(in.ExpressionAttributeNames["#job"]))
+		expires, err := strconv.ParseInt(aws.StringValue(in.ExpressionAttributeValues[":expires"].N), 10, 64)
+		assert.NoError(m.t, err)
+		assert.True(m.t, expires > time.Now().Add(quotaLease-time.Minute).Unix())
+		m.renewed++
+	}
+	return m.DynamoDBAPI.UpdateItemWithContext(ctx, in, opts...)
+}
+
+// quotaLeases returns the IDs of the jobs holding concurrent slots of the empty subject
+func quotaLeases(t *testing.T) []string {
+	out, err := DynamoDB.GetItemWithContext(context.Background(), &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{S: aws.String("running/")},
+		},
+		TableName: aws.String(Config.Quota.TableName),
+	})
+	assert.NoError(t, err)
+
+	r := quotaRunning{}
+	assert.NoError(t, dynamodbattribute.UnmarshalMap(out.Item, &r))
+	return quotaJobs(r)
+}
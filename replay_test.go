@@ -0,0 +1,251 @@
+package gofaas
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/corehandlers"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// ReplayCall is a recorded AWS API request and response
+type ReplayCall struct {
+	Service   string         `json:"service"`
+	Operation string         `json:"operation"`
+	Request   ReplayRequest  `json:"request"`
+	Response  ReplayResponse `json:"response"`
+}
+
+// ReplayRequest is the part of an API request that must match the recording
+type ReplayRequest struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Body   string `json:"body,omitempty"`
+}
+
+// ReplayResponse is a recorded API response
+type ReplayResponse struct {
+	StatusCode int               `json:"status_code"`
+	Header     map[string]string `json:"header,omitempty"`
+	Body       string            `json:"body,omitempty"`
+}
+
+// Replay swaps in real AWS clients whose API calls are replayed from testdata/<TestName>.json
+// Set GOFAAS_RECORD=true to call AWS, or local stand-ins with GOFAAS_ENDPOINT, and record the calls instead
+// It returns a context for the calls and a func that restores the clients and checks every call was replayed
+func Replay(t *testing.T) (context.Context, func()) {
+	rp := &replayer{
+		path:   filepath.Join("testdata", t.Name()+".json"),
+		record: os.Getenv("GOFAAS_RECORD") != "",
+		t:      t,
+	}
+
+	if !rp.record {
+		b, err := ioutil.ReadFile(rp.path)
+		if err != nil {
+			t.Fatalf("Replay read %s error: %s (record with GOFAAS_RECORD=true)", rp.path, err)
+		}
+		if err := json.Unmarshal(b, &rp.calls); err != nil {
+			t.Fatalf("Replay unmarshal %s error: %s", rp.path, err)
+		}
+	}
+
+	handlers := SessionHandlers
+	apigateway, dynamodb, kms, lambda, s3, secretsmanager, sns, sqs, ssm := APIGateway, DynamoDB, KMS, Lambda, S3, SecretsManager, SNS, SQS, SSM
+
+	SessionHandlers = rp.handlers
+	APIGateway, DynamoDB, KMS, Lambda, S3, SecretsManager, SNS, SQS, SSM = &lazyAPIGateway{}, &lazyDynamoDB{}, &lazyKMS{}, &lazyLambda{}, &lazyS3{}, &lazySecretsManager{}, &lazySNS{}, &lazySQS{}, &lazySSM{}
+
+	ctx, seg := xray.BeginSegment(context.Background(), "replay")
+
+	return ctx, func() {
+		seg.Close(nil)
+
+		SessionHandlers = handlers
+		APIGateway, DynamoDB, KMS, Lambda, S3, SecretsManager, SNS, SQS, SSM = apigateway, dynamodb, kms, lambda, s3, secretsmanager, sns, sqs, ssm
+
+		rp.finish()
+	}
+}
+
+type replayer struct {
+	calls  []ReplayCall
+	n      int
+	path   string
+	record bool
+	t      *testing.T
+}
+
+func (rp *replayer) handlers(h *request.Handlers) {
+	if rp.record {
+		h.Send.PushBackNamed(request.NamedHandler{Name: "gofaas.Record", Fn: rp.recordCall})
+		return
+	}
+
+	// no network, credentials or region are needed to replay
+	h.Validate.Remove(corehandlers.ValidateEndpointHandler)
+	h.Sign.Clear()
+	h.Send.Swap(corehandlers.SendHandler.Name, request.NamedHandler{Name: "gofaas.Replay", Fn: rp.replayCall})
+}
+
+func (rp *replayer) recordCall(r *request.Request) {
+	if r.HTTPResponse == nil {
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.HTTPResponse.Body)
+	if err != nil {
+		r.Error = err
+		return
+	}
+	r.HTTPResponse.Body.Close()
+	r.HTTPResponse.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	header := map[string]string{}
+	for k := range r.HTTPResponse.Header {
+		if k != "Date" {
+			header[k] = r.HTTPResponse.Header.Get(k)
+		}
+	}
+
+	rp.calls = append(rp.calls, ReplayCall{
+		Service:   r.ClientInfo.ServiceName,
+		Operation: r.Operation.Name,
+		Request:   replayRequest(r),
+		Response: ReplayResponse{
+			StatusCode: r.HTTPResponse.StatusCode,
+			Header:     header,
+			Body:       string(b),
+		},
+	})
+}
+
+func (rp *replayer) replayCall(r *request.Request) {
+	got := ReplayCall{
+		Service:   r.ClientInfo.ServiceName,
+		Operation: r.Operation.Name,
+		Request:   replayRequest(r),
+	}
+
+	if rp.n >= len(rp.calls) {
+		rp.t.Errorf("Replay %s call %d %s.%s is not in the recording\n%s", rp.path, rp.n, got.Service, got.Operation, got.Request)
+		r.Error = awserr.New("ReplayMismatch", "call not in recording", nil)
+		r.Retryable = new(bool)
+		return
+	}
+
+	want := rp.calls[rp.n]
+	rp.n++
+
+	if diff := replayDiff(want, got); diff != "" {
+		rp.t.Errorf("Replay %s call %d does not match the recording:\n%s", rp.path, rp.n-1, diff)
+		r.Error = awserr.New("ReplayMismatch", "call does not match recording", nil)
+		r.Retryable = new(bool)
+		return
+	}
+
+	header := http.Header{}
+	for k, v := range want.Response.Header {
+		header.Set(k, v)
+	}
+
+	r.HTTPResponse = &http.Response{
+		Body:          ioutil.NopCloser(strings.NewReader(want.Response.Body)),
+		ContentLength: int64(len(want.Response.Body)),
+		Header:        header,
+		Status:        fmt.Sprintf("%d %s", want.Response.StatusCode, http.StatusText(want.Response.StatusCode)),
+		StatusCode:    want.Response.StatusCode,
+	}
+}
+
+func (rp *replayer) finish() {
+	if rp.record {
+		b, err := json.MarshalIndent(rp.calls, "", "  ")
+		if err != nil {
+			rp.t.Fatalf("Replay marshal error: %s", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(rp.path), 0755); err != nil {
+			rp.t.Fatalf("Replay mkdir error: %s", err)
+		}
+		if err := ioutil.WriteFile(rp.path, append(b, '\n'), 0644); err != nil {
+			rp.t.Fatalf("Replay write %s error: %s", rp.path, err)
+		}
+		return
+	}
+
+	if rp.n < len(rp.calls) {
+		rp.t.Errorf("Replay %s has %d calls that were not made, starting with %s.%s", rp.path, len(rp.calls)-rp.n, rp.calls[rp.n].Service, rp.calls[rp.n].Operation)
+	}
+}
+
+// replayRequest captures the method, path and body of a request, rewinding the body for sending
+func replayRequest(r *request.Request) ReplayRequest {
+	rr := ReplayRequest{
+		Method: r.HTTPRequest.Method,
+		Path:   r.HTTPRequest.URL.Path,
+	}
+	if q := r.HTTPRequest.URL.RawQuery; q != "" {
+		rr.Path += "?" + q
+	}
+
+	if r.Body == nil {
+		return rr
+	}
+
+	if _, err := r.Body.Seek(r.BodyStart, io.SeekStart); err != nil {
+		r.Error = err
+		return rr
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		r.Error = err
+		return rr
+	}
+	if _, err := r.Body.Seek(r.BodyStart, io.SeekStart); err != nil {
+		r.Error = err
+		return rr
+	}
+
+	// indent JSON bodies so diffs are readable
+	buf := bytes.Buffer{}
+	if json.Indent(&buf, b, "", "  ") == nil {
+		b = buf.Bytes()
+	}
+	rr.Body = string(b)
+
+	return rr
+}
+
+func (rr ReplayRequest) String() string {
+	return fmt.Sprintf("%s %s\n%s\n", rr.Method, rr.Path, rr.Body)
+}
+
+// replayDiff returns a unified diff of the recorded and actual calls, or "" if they match
+func replayDiff(want, got ReplayCall) string {
+	a := fmt.Sprintf("%s.%s\n%s", want.Service, want.Operation, want.Request)
+	b := fmt.Sprintf("%s.%s\n%s", got.Service, got.Operation, got.Request)
+	if a == b {
+		return ""
+	}
+
+	diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(a),
+		B:        difflib.SplitLines(b),
+		FromFile: "recorded",
+		ToFile:   "actual",
+		Context:  3,
+	})
+	return diff
+}
@@ -0,0 +1,343 @@
+package gofaas
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+)
+
+// ReportFormat encodes the records of a report
+type ReportFormat interface {
+	ContentType() string
+	Extension() string
+	NewEncoder(w io.Writer) ReportEncoder
+}
+
+// ReportEncoder writes records to a report as they are encoded
+// Close writes anything that ends the report
+type ReportEncoder interface {
+	Encode(v interface{}) error
+	Close() error
+}
+
+// ReportFormats are the report formats by name
+var ReportFormats = map[string]ReportFormat{
+	"csv":    csvFormat{},
+	"json":   jsonFormat{},
+	"ndjson": ndjsonFormat{},
+}
+
+// reportPartSize is the size of the parts a report is uploaded in
+var reportPartSize = s3manager.DefaultUploadPartSize
+
+// ReportWriter streams report records to an S3 object as they are written
+// The object is uploaded in parts so a report doesn't need to fit in memory
+type ReportWriter struct {
+	Key string
+
+	done chan error
+	enc  ReportEncoder
+	gz   *gzip.Writer
+	pw   *io.PipeWriter
+}
+
+// NewReportWriter starts uploading a report for a worker event in its format
+// The key is partitioned by the date the work started, and the object metadata links back to the job
+func NewReportWriter(ctx context.Context, e WorkerEvent, id string) (*ReportWriter, error) {
+	key, f, err := reportKey(e, id)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	w := &ReportWriter{
+		Key:  key,
+		done: make(chan error, 1),
+	}
+
+	pr, pw := io.Pipe()
+	w.pw = pw
+
+	input := &s3manager.UploadInput{
+		Body:        pr,
+		Bucket:      aws.String(Config.Worker.Bucket),
+		ContentType: aws.String(f.ContentType()),
+		Key:         aws.String(w.Key),
+		Metadata:    reportMetadata(e),
+	}
+
+	var out io.Writer = pw
+	if e.Gzip {
+		w.gz = gzip.NewWriter(pw)
+		out = w.gz
+		input.ContentEncoding = aws.String("gzip")
+	}
+	w.enc = f.NewEncoder(out)
+
+	go func() {
+		_, err := NewUploader().UploadWithContext(ctx, input, func(u *s3manager.Uploader) {
+			u.PartSize = reportPartSize
+		})
+		// unblock writes if the upload fails before reading everything
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+
+	return w, nil
+}
+
+// Write encodes a record to the report
+func (w *ReportWriter) Write(v interface{}) error {
+	return errors.WithStack(w.enc.Encode(v))
+}
+
+// Close ends the report and waits for the upload to complete
+func (w *ReportWriter) Close() error {
+	err := w.enc.Close()
+	if err == nil && w.gz != nil {
+		err = w.gz.Close()
+	}
+	if err != nil {
+		return w.Abort(err)
+	}
+
+	w.pw.Close()
+	return errors.WithStack(<-w.done)
+}
+
+// Abort stops the upload with an error so no partial report is saved
+func (w *ReportWriter) Abort(err error) error {
+	w.pw.CloseWithError(err)
+	<-w.done
+	return errors.WithStack(err)
+}
+
+// reportKey returns the key and format of the report for a worker event
+func reportKey(e WorkerEvent, id string) (string, ReportFormat, error) {
+	name := e.Format
+	if name == "" {
+		name = Config.Worker.ReportFormat
+	}
+	if name == "" {
+		name = "json"
+	}
+
+	f, ok := ReportFormats[name]
+	if !ok {
+		return "", nil, errors.Errorf("unknown report format %q", name)
+	}
+
+	key := reportPrefix(e.TimeStart, id) + "." + f.Extension()
+	if e.Gzip {
+		key += ".gz"
+	}
+	return key, f, nil
+}
+
+// reportPrefix returns the prefix of the report and other output of work started at t, partitioned by its UTC date
+func reportPrefix(t time.Time, id string) string {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return fmt.Sprintf("reports/%s/%s", t.UTC().Format("2006/01/02"), id)
+}
+
+// reportMetadata returns the user-defined object metadata for a worker event
+func reportMetadata(e WorkerEvent) map[string]*string {
+	m := map[string]*string{}
+	for k, v := range map[string]string{
+		"job-id":     e.JobID,
+		"request-id": e.RequestID,
+		"subject":    e.Subject,
+	} {
+		if v != "" {
+			m[k] = aws.String(v)
+		}
+	}
+	return m
+}
+
+// reportCopy streams the records of an NDJSON report part into a report
+func reportCopy(ctx context.Context, w *ReportWriter, key string) error {
+	out, err := S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(Config.Worker.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer out.Body.Close()
+
+	dec := json.NewDecoder(out.Body)
+	for {
+		var r json.RawMessage
+		if err := dec.Decode(&r); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := w.Write(r); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+// reportDelete deletes report objects by key
+func reportDelete(ctx context.Context, keys []string) error {
+	objs := []*s3.ObjectIdentifier{}
+	for _, key := range keys {
+		objs = append(objs, &s3.ObjectIdentifier{Key: aws.String(key)})
+	}
+
+	// DeleteObjects takes up to 1000 keys
+	for len(objs) > 0 {
+		n := len(objs)
+		if n > 1000 {
+			n = 1000
+		}
+
+		_, err := S3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(Config.Worker.Bucket),
+			Delete: &s3.Delete{
+				Objects: objs[:n],
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		objs = objs[n:]
+	}
+	return nil
+}
+
+type jsonFormat struct{}
+
+func (jsonFormat) ContentType() string { return "application/json" }
+func (jsonFormat) Extension() string   { return "json" }
+
+func (jsonFormat) NewEncoder(w io.Writer) ReportEncoder {
+	return &jsonEncoder{w: w}
+}
+
+// jsonEncoder writes records as the elements of a JSON array
+type jsonEncoder struct {
+	n int
+	w io.Writer
+}
+
+func (e *jsonEncoder) Encode(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	sep := ",\n"
+	if e.n == 0 {
+		sep = "[\n"
+	}
+	e.n++
+
+	_, err = e.w.Write(append([]byte(sep), b...))
+	return err
+}
+
+func (e *jsonEncoder) Close() error {
+	end := "\n]\n"
+	if e.n == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(e.w, end)
+	return err
+}
+
+type ndjsonFormat struct{}
+
+func (ndjsonFormat) ContentType() string { return "application/x-ndjson" }
+func (ndjsonFormat) Extension() string   { return "ndjson" }
+
+func (ndjsonFormat) NewEncoder(w io.Writer) ReportEncoder {
+	return ndjsonEncoder{json.NewEncoder(w)}
+}
+
+// ndjsonEncoder writes records as newline delimited JSON
+type ndjsonEncoder struct {
+	*json.Encoder
+}
+
+func (ndjsonEncoder) Close() error { return nil }
+
+type csvFormat struct{}
+
+func (csvFormat) ContentType() string { return "text/csv" }
+func (csvFormat) Extension() string   { return "csv" }
+
+func (csvFormat) NewEncoder(w io.Writer) ReportEncoder {
+	return &csvEncoder{w: csv.NewWriter(w)}
+}
+
+// csvEncoder writes records as CSV rows
+// The header is the sorted fields of the first record, and values that aren't strings are written as JSON
+type csvEncoder struct {
+	header []string
+	w      *csv.Writer
+}
+
+func (e *csvEncoder) Encode(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	m := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return errors.Errorf("csv record %T is not an object", v)
+	}
+
+	if e.header == nil {
+		e.header = []string{}
+		for k := range m {
+			e.header = append(e.header, k)
+		}
+		sort.Strings(e.header)
+
+		if err := e.w.Write(e.header); err != nil {
+			return err
+		}
+	}
+
+	row := make([]string, len(e.header))
+	for i, k := range e.header {
+		raw, ok := m[k]
+		if !ok || string(raw) == "null" {
+			continue
+		}
+
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			s = string(raw)
+		}
+		row[i] = s
+	}
+
+	if err := e.w.Write(row); err != nil {
+		return err
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvEncoder) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
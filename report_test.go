@@ -0,0 +1,199 @@
+package gofaas
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportWriter(t *testing.T) {
+	Config.Worker.Bucket = "gofaas-bucket"
+
+	type record struct {
+		ID    int               `json:"id"`
+		Name  string            `json:"name"`
+		Attrs map[string]string `json:"attrs,omitempty"`
+	}
+	records := []record{
+		{ID: 1, Name: "a", Attrs: map[string]string{"k": "v"}},
+		{ID: 2, Name: "b, c"},
+	}
+
+	cases := []struct {
+		format string
+		gzip   bool
+
+		key         string
+		contentType string
+		body        string
+	}{
+		{
+			format:      "json",
+			key:         "reports/2018/02/22/job-1.json",
+			contentType: "application/json",
+			body:        "[\n{\"id\":1,\"name\":\"a\",\"attrs\":{\"k\":\"v\"}},\n{\"id\":2,\"name\":\"b, c\"}\n]\n",
+		},
+		{
+			format:      "ndjson",
+			key:         "reports/2018/02/22/job-1.ndjson",
+			contentType: "application/x-ndjson",
+			body:        "{\"id\":1,\"name\":\"a\",\"attrs\":{\"k\":\"v\"}}\n{\"id\":2,\"name\":\"b, c\"}\n",
+		},
+		{
+			format:      "csv",
+			key:         "reports/2018/02/22/job-1.csv",
+			contentType: "text/csv",
+			body:        "attrs,id,name\n\"{\"\"k\"\":\"\"v\"\"}\",1,a\n,2,\"b, c\"\n",
+		},
+		{
+			format:      "ndjson",
+			gzip:        true,
+			key:         "reports/2018/02/22/job-1.ndjson.gz",
+			contentType: "application/x-ndjson",
+			body:        "{\"id\":1,\"name\":\"a\",\"attrs\":{\"k\":\"v\"}}\n{\"id\":2,\"name\":\"b, c\"}\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.key, func(t *testing.T) {
+			ms3 := &MockS3{}
+			S3 = ms3
+
+			w, err := NewReportWriter(context.Background(), WorkerEvent{
+				Format:    c.format,
+				Gzip:      c.gzip,
+				JobID:     "job-1",
+				TimeStart: time.Date(2018, 2, 21, 23, 0, 0, 0, time.FixedZone("PST", -8*3600)),
+			}, "job-1")
+			assert.NoError(t, err)
+
+			for _, r := range records {
+				assert.NoError(t, w.Write(r))
+			}
+			assert.NoError(t, w.Close())
+			assert.Equal(t, c.key, w.Key)
+
+			if !assert.Len(t, ms3.Puts, 1) {
+				return
+			}
+			in := ms3.Puts[0]
+			assert.Equal(t, c.key, *in.Key)
+			assert.Equal(t, c.contentType, *in.ContentType)
+			assert.Equal(t, map[string]*string{"job-id": aws.String("job-1")}, in.Metadata)
+
+			b := ms3.Objects[c.key]
+			if c.gzip {
+				assert.Equal(t, "gzip", aws.StringValue(in.ContentEncoding))
+				b = gunzip(t, b)
+			} else {
+				assert.Nil(t, in.ContentEncoding)
+			}
+			assert.Equal(t, c.body, string(b))
+		})
+	}
+
+	_, err := NewReportWriter(context.Background(), WorkerEvent{Format: "xml"}, "job-1")
+	assert.EqualError(t, err, `unknown report format "xml"`)
+}
+
+func TestReportWriterMultipart(t *testing.T) {
+	Config.Worker.Bucket = "gofaas-bucket"
+
+	reportPartSize = s3manager.MinUploadPartSize
+	defer func() { reportPartSize = s3manager.DefaultUploadPartSize }()
+
+	// a report larger than a part is streamed in parts
+	ms3 := &MockS3{}
+	S3 = ms3
+
+	w, err := NewReportWriter(context.Background(), WorkerEvent{Format: "ndjson", JobID: "job-1"}, "job-1")
+	assert.NoError(t, err)
+
+	line := strings.Repeat("x", 1024)
+	n := int(2*s3manager.MinUploadPartSize)/len(line) + 1
+	for i := 0; i < n; i++ {
+		assert.NoError(t, w.Write(line))
+	}
+	assert.NoError(t, w.Close())
+
+	if assert.Len(t, ms3.Puts, 1) {
+		assert.Equal(t, "application/x-ndjson", *ms3.Puts[0].ContentType)
+		assert.Equal(t, "job-1", *ms3.Puts[0].Metadata["job-id"])
+	}
+	assert.Equal(t, n, bytes.Count(ms3.Objects[w.Key], []byte("\n")))
+	assert.Len(t, ms3.uploads, 0)
+
+	// a failed part aborts the upload so no partial report is saved
+	ms3 = &MockS3{}
+	S3 = FaultS3{ms3, &Faults{Faults: []Fault{{Op: "UploadPart", Call: 2, Err: ErrAccessDenied()}}}}
+
+	w, err = NewReportWriter(context.Background(), WorkerEvent{Format: "ndjson"}, "job-2")
+	assert.NoError(t, err)
+
+	for i := 0; i < n && err == nil; i++ {
+		err = w.Write(line)
+	}
+	if err != nil {
+		err = w.Abort(err)
+	} else {
+		err = w.Close()
+	}
+	assert.Error(t, err)
+	assert.Len(t, ms3.Objects, 0)
+	assert.Len(t, ms3.uploads, 0)
+}
+
+func TestWorkCreateFormat(t *testing.T) {
+	Config.Jobs.TableName = "gofaas-JobsTable"
+	UUIDGen = uuid.NewV4
+
+	ml := &MockLambda{}
+	DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+	Lambda = ml
+
+	for q, status := range map[string]int{
+		"csv":     202,
+		"json":    202,
+		"ndjson":  202,
+		"parquet": 400,
+	} {
+		r, err := WorkCreate(context.Background(), events.APIGatewayProxyRequest{
+			QueryStringParameters: map[string]string{"format": q, "gzip": "true"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, status, r.StatusCode, q)
+	}
+
+	r, err := WorkCreate(context.Background(), events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"gzip": "maybe"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 400, r.StatusCode)
+
+	if assert.Len(t, ml.Inputs, 3) {
+		for _, in := range ml.Inputs {
+			assert.Contains(t, string(in.Payload), `"gzip":true`)
+		}
+	}
+}
+
+func gunzip(t *testing.T, b []byte) []byte {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	b, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	return b
+}
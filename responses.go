@@ -27,3 +27,15 @@ func (e ResponseError) Response() (events.APIGatewayProxyResponse, error) {
 		StatusCode: e.StatusCode,
 	}, nil
 }
+
+// responsePanic returns a 500 API Gateway Response event for a recovered panic
+// The request ID lets a caller report the error, and find it in the logs and notifications.
+func responsePanic(requestID string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		Body: fmt.Sprintf("{%q: %q, %q: %q}\n", "error", "internal server error", "request_id", requestID),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		StatusCode: 500,
+	}
+}
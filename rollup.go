@@ -0,0 +1,295 @@
+package gofaas
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/pkg/errors"
+)
+
+// notifyWindow counts the occurrences of an error in a function since the window started
+type notifyWindow struct {
+	ID          string    `json:"id"`
+	Count       int       `json:"n"`
+	Expires     int64     `json:"expires"`
+	Function    string    `json:"function"`
+	Message     string    `json:"message"`
+	Subject     string    `json:"subject"`
+	WindowStart time.Time `json:"window_start"`
+}
+
+// notifyWindowDuration returns how long repeats of an error are suppressed, 10 minutes by default
+func notifyWindowDuration() time.Duration {
+	if Config.Notify.Window > 0 {
+		return Config.Notify.Window
+	}
+	return 10 * time.Minute
+}
+
+// notifyFingerprint identifies an error by the type of its cause and the frame it was created at
+// The deepest stack in the chain is used, so wrapping an error elsewhere keeps its fingerprint.
+func notifyFingerprint(err error) string {
+	type causer interface {
+		Cause() error
+	}
+	type stackTracer interface {
+		StackTrace() errors.StackTrace
+	}
+
+	frame := ""
+	for e := err; e != nil; {
+		if st, ok := e.(stackTracer); ok && len(st.StackTrace()) > 0 {
+			f := st.StackTrace()[0]
+			frame = fmt.Sprintf("%n %s:%d", f, f, f)
+		}
+
+		c, ok := e.(causer)
+		if !ok {
+			break
+		}
+		e = c.Cause()
+	}
+
+	h := sha1.Sum([]byte(fmt.Sprintf("%T\n%s", errors.Cause(err), frame)))
+	return hex.EncodeToString(h[:8])
+}
+
+// notifyCount atomically counts an occurrence of an error in the window shared by every container
+// It returns if the notification should be sent now, which is only for the first occurrence and never in digest mode.
+func notifyCount(ctx context.Context, err error, n Notification) (bool, error) {
+	id := n.Function + "/" + notifyFingerprint(err)
+	now := time.Now()
+
+	vs, err := dynamodbattribute.MarshalMap(map[string]interface{}{
+		":expires":  now.Add(notifyWindowDuration() + 24*time.Hour).Unix(),
+		":function": n.Function,
+		":message":  n.Message,
+		":now":      now,
+		":one":      1,
+		":subject":  n.Subject,
+	})
+	if err != nil {
+		return true, errors.WithStack(err)
+	}
+
+	out, err := DynamoDB.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		ExpressionAttributeNames: aws.StringMap(map[string]string{
+			"#function": "function",
+			"#message":  "message",
+			"#n":        "n",
+			"#subject":  "subject",
+		}),
+		ExpressionAttributeValues: vs,
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: aws.String(id),
+			},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+		TableName:    aws.String(Config.Notify.TableName),
+		UpdateExpression: aws.String("ADD #n :one SET expires = if_not_exists(expires, :expires), " +
+			"#function = if_not_exists(#function, :function), #message = if_not_exists(#message, :message), " +
+			"#subject = if_not_exists(#subject, :subject), window_start = if_not_exists(window_start, :now)"),
+	})
+	if err != nil {
+		return true, errors.WithStack(err)
+	}
+
+	w := notifyWindow{}
+	if err := dynamodbattribute.UnmarshalMap(out.Attributes, &w); err != nil {
+		return true, errors.WithStack(err)
+	}
+
+	if Config.Notify.Digest {
+		return false, nil
+	}
+	if w.Count > 1 && now.Sub(w.WindowStart) > notifyWindowDuration() {
+		return notifyRestart(ctx, w, out.Attributes["window_start"], vs)
+	}
+	return w.Count == 1, nil
+}
+
+// notifyRestart starts a new window for an error whose window is over but was never rolled up,
+// like when the notify-rollup task lags or fails, so the error is sent instead of suppressed until the TTL.
+// Only one occurrence starts the new window, conditioned on the start of the old one.
+func notifyRestart(ctx context.Context, w notifyWindow, start *dynamodb.AttributeValue, vs map[string]*dynamodb.AttributeValue) (bool, error) {
+	log.Printf("NotifyError window %s from %s is over with %d occurrences not rolled up\n", w.ID, w.WindowStart.UTC().Format(time.RFC3339), w.Count-1)
+
+	vs[":start"] = start
+	_, err := DynamoDB.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		ConditionExpression: aws.String("window_start = :start"),
+		ExpressionAttributeNames: aws.StringMap(map[string]string{
+			"#function": "function",
+			"#message":  "message",
+			"#n":        "n",
+			"#subject":  "subject",
+		}),
+		ExpressionAttributeValues: vs,
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: aws.String(w.ID),
+			},
+		},
+		TableName: aws.String(Config.Notify.TableName),
+		UpdateExpression: aws.String("SET #n = :one, expires = :expires, #function = :function, #message = :message, " +
+			"#subject = :subject, window_start = :now"),
+	})
+	if jobConflict(err) {
+		return false, nil
+	}
+	if err != nil {
+		return true, errors.WithStack(err)
+	}
+	return true, nil
+}
+
+// notifyRollup closes error windows as a scheduled task
+// A window that is over is deleted and a rollup of the suppressed occurrences is sent.
+// In digest mode every window is closed once per window duration and summarized in one digest per run.
+func notifyRollup(ctx context.Context, t time.Time) error {
+	if Config.Notify.TableName == "" {
+		return nil
+	}
+
+	d := notifyWindowDuration()
+	if Config.Notify.Digest && !t.Truncate(d).Equal(t) {
+		return nil
+	}
+
+	windows := []notifyWindow{}
+	var errUnmarshal error
+	err := DynamoDB.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName: aws.String(Config.Notify.TableName),
+	}, func(out *dynamodb.ScanOutput, last bool) bool {
+		for _, item := range out.Items {
+			w := notifyWindow{}
+			if err := dynamodbattribute.UnmarshalMap(item, &w); err != nil {
+				errUnmarshal = err
+				return false
+			}
+			if Config.Notify.Digest || !w.WindowStart.Add(d).After(t) {
+				windows = append(windows, w)
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = errUnmarshal
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	closed := []notifyWindow{}
+	for _, w := range windows {
+		closed, err = notifyClose(ctx, w, closed)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if Config.Notify.Digest {
+		if len(closed) == 0 {
+			return nil
+		}
+		return errors.WithStack(Notify(ctx, notifyDigest(closed, t.Add(-d), t)))
+	}
+
+	for _, w := range closed {
+		if w.Count < 2 {
+			continue
+		}
+
+		err := Notify(ctx, Notification{
+			Function: w.Function,
+			Message: fmt.Sprintf("%d more occurrences in the %s after %s of:\n\n%s",
+				w.Count-1, d, w.WindowStart.UTC().Format(time.RFC3339), w.Message),
+			Severity: SeverityError,
+			Subject:  fmt.Sprintf("(%d more) %s", w.Count-1, w.Subject),
+			Time:     t,
+		})
+		if err != nil {
+			log.Printf("WorkerPeriodic rollup %s error %+v\n", w.ID, err)
+		}
+	}
+	return nil
+}
+
+// notifyClose deletes a window unless it was counted since the scan, and appends it to closed
+// A window counted since is left for the next run, so no occurrence is lost.
+func notifyClose(ctx context.Context, w notifyWindow, closed []notifyWindow) ([]notifyWindow, error) {
+	vs, err := dynamodbattribute.MarshalMap(map[string]interface{}{":n": w.Count})
+	if err != nil {
+		return closed, errors.WithStack(err)
+	}
+
+	_, err = DynamoDB.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		ConditionExpression:       aws.String("#n = :n"),
+		ExpressionAttributeNames:  aws.StringMap(map[string]string{"#n": "n"}),
+		ExpressionAttributeValues: vs,
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: aws.String(w.ID),
+			},
+		},
+		TableName: aws.String(Config.Notify.TableName),
+	})
+	if jobConflict(err) {
+		return closed, nil
+	}
+	if err != nil {
+		return closed, errors.WithStack(err)
+	}
+
+	return append(closed, w), nil
+}
+
+// notifyDigest summarizes error windows per function, most frequent errors first
+func notifyDigest(windows []notifyWindow, start, end time.Time) Notification {
+	byFunction := map[string][]notifyWindow{}
+	functions := []string{}
+	total := 0
+
+	for _, w := range windows {
+		if _, ok := byFunction[w.Function]; !ok {
+			functions = append(functions, w.Function)
+		}
+		byFunction[w.Function] = append(byFunction[w.Function], w)
+		total += w.Count
+	}
+	sort.Strings(functions)
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "Errors from %s to %s:\n", start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339))
+
+	for _, fn := range functions {
+		ws := byFunction[fn]
+		sort.SliceStable(ws, func(i, j int) bool { return ws[i].Count > ws[j].Count })
+
+		n := 0
+		for _, w := range ws {
+			n += w.Count
+		}
+		fmt.Fprintf(b, "\n%s: %d errors\n", fn, n)
+
+		for _, w := range ws {
+			fmt.Fprintf(b, "  %dx %s\n", w.Count, strings.SplitN(strings.TrimSpace(w.Message), "\n", 2)[0])
+		}
+	}
+
+	return Notification{
+		Message:  b.String(),
+		Severity: SeverityError,
+		Subject:  fmt.Sprintf("DIGEST %d errors in %d functions", total, len(functions)),
+		Time:     end,
+	}
+}
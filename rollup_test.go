@@ -0,0 +1,143 @@
+package gofaas
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifyFingerprint(t *testing.T) {
+	a, b := rollupErr(), rollupErr()
+	assert.Equal(t, notifyFingerprint(a), notifyFingerprint(b))
+	assert.Equal(t, notifyFingerprint(a), notifyFingerprint(errors.WithStack(b)))
+	assert.NotEqual(t, notifyFingerprint(a), notifyFingerprint(errors.New("boom")))
+	assert.NotEqual(t, notifyFingerprint(a), notifyFingerprint(ResponseError{"boom", 500}))
+}
+
+func TestNotifyRollup(t *testing.T) {
+	Config.Notify = NotifyConfig{
+		TableName: "gofaas-NotifyTable",
+		Topic:     "arn:aws:sns:us-east-1:123456789012:gofaas-NotificationTopic",
+	}
+	defer func() { Config.Notify = NotifyConfig{} }()
+	os.Setenv("AWS_LAMBDA_FUNCTION_NAME", "gofaas-WorkerFunction")
+	defer os.Unsetenv("AWS_LAMBDA_FUNCTION_NAME")
+
+	msns := &MockSNS{}
+	DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+	SNS = msns
+
+	ctx := context.Background()
+
+	// only the first occurrence of an error in the window is sent
+	for i := 0; i < 3; i++ {
+		notify(ctx, rollupErr())
+	}
+	notify(ctx, errors.New("other"))
+	assert.Len(t, msns.Inputs, 2)
+
+	// the window isn't over yet
+	assert.NoError(t, notifyRollup(ctx, time.Now()))
+	assert.Len(t, msns.Inputs, 2)
+
+	assert.NoError(t, notifyRollup(ctx, time.Now().Add(10*time.Minute)))
+	if assert.Len(t, msns.Inputs, 3) {
+		assert.Equal(t, "(2 more) ERROR gofaas-WorkerFunction: rollup", aws.StringValue(msns.Inputs[2].Subject))
+		assert.Contains(t, snsMessage(msns.Inputs[2], "email"), "2 more occurrences in the 10m0s after ")
+		assert.Contains(t, snsMessage(msns.Inputs[2], "email"), "rollup\n")
+	}
+
+	// a new window starts
+	notify(ctx, rollupErr())
+	assert.Len(t, msns.Inputs, 4)
+}
+
+func TestNotifyRollupLag(t *testing.T) {
+	Config.Notify = NotifyConfig{
+		TableName: "gofaas-NotifyTable",
+		Topic:     "arn:aws:sns:us-east-1:123456789012:gofaas-NotificationTopic",
+	}
+	defer func() { Config.Notify = NotifyConfig{} }()
+	os.Setenv("AWS_LAMBDA_FUNCTION_NAME", "gofaas-WorkerFunction")
+	defer os.Unsetenv("AWS_LAMBDA_FUNCTION_NAME")
+
+	md := &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+	msns := &MockSNS{}
+	DynamoDB = md
+	SNS = msns
+
+	ctx := context.Background()
+
+	notify(ctx, rollupErr())
+	notify(ctx, rollupErr())
+	assert.Len(t, msns.Inputs, 1)
+
+	// the rollup task didn't close the window, so the next occurrence after it starts a new one and is sent
+	id := "gofaas-WorkerFunction/" + notifyFingerprint(rollupErr())
+	if !assert.Contains(t, md.Items, id) {
+		return
+	}
+	start, err := dynamodbattribute.Marshal(time.Now().Add(-11 * time.Minute))
+	assert.NoError(t, err)
+	md.Items[id]["window_start"] = start
+
+	notify(ctx, rollupErr())
+	assert.Len(t, msns.Inputs, 2)
+	assert.Equal(t, "1", aws.StringValue(md.Items[id]["n"].N))
+
+	notify(ctx, rollupErr())
+	assert.Len(t, msns.Inputs, 2)
+}
+
+func TestNotifyDigest(t *testing.T) {
+	Config.Notify = NotifyConfig{
+		Digest:    true,
+		TableName: "gofaas-NotifyTable",
+		Topic:     "arn:aws:sns:us-east-1:123456789012:gofaas-NotificationTopic",
+		Window:    time.Hour,
+	}
+	defer func() { Config.Notify = NotifyConfig{} }()
+	defer os.Unsetenv("AWS_LAMBDA_FUNCTION_NAME")
+
+	msns := &MockSNS{}
+	DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+	SNS = msns
+
+	ctx := context.Background()
+
+	os.Setenv("AWS_LAMBDA_FUNCTION_NAME", "gofaas-WorkerFunction")
+	notify(ctx, rollupErr())
+	notify(ctx, rollupErr())
+	notify(ctx, errors.New("other"))
+
+	os.Setenv("AWS_LAMBDA_FUNCTION_NAME", "gofaas-DashboardFunction")
+	notify(ctx, rollupErr())
+	assert.Len(t, msns.Inputs, 0)
+
+	// the digest is sent once per window
+	t0 := time.Now().Truncate(time.Hour).Add(time.Hour)
+	assert.NoError(t, notifyRollup(ctx, t0.Add(time.Minute)))
+	assert.Len(t, msns.Inputs, 0)
+
+	assert.NoError(t, notifyRollup(ctx, t0))
+	if assert.Len(t, msns.Inputs, 1) {
+		assert.Equal(t, "DIGEST 4 errors in 2 functions", aws.StringValue(msns.Inputs[0].Subject))
+		assert.Contains(t, snsMessage(msns.Inputs[0], "email"), "Errors from "+t0.Add(-time.Hour).UTC().Format(time.RFC3339)+" to "+t0.UTC().Format(time.RFC3339)+":\n"+
+			"\ngofaas-DashboardFunction: 1 errors\n  1x rollup\n"+
+			"\ngofaas-WorkerFunction: 3 errors\n  2x rollup\n  1x other\n", aws.StringValue(msns.Inputs[0].Message))
+	}
+
+	assert.NoError(t, notifyRollup(ctx, t0.Add(time.Hour)))
+	assert.Len(t, msns.Inputs, 1)
+}
+
+func rollupErr() error {
+	return errors.New("rollup")
+}
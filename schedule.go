@@ -0,0 +1,278 @@
+package gofaas
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// ScheduledTask is a named periodic task that runs when its cron expression matches
+// Run gets a context that is cancelled after Timeout, and the time the task was scheduled for
+type ScheduledTask struct {
+	Cron    string
+	Name    string
+	Run     func(ctx context.Context, t time.Time) error
+	Timeout time.Duration
+}
+
+// Schedule is the registry of periodic tasks the WorkerPeriodic dispatcher runs
+var Schedule = []ScheduledTask{
+	{
+		Cron:    "0 3 * * *",
+		Name:    "cleanup",
+		Run:     scheduleCleanup,
+		Timeout: 4 * time.Minute,
+	},
+	{
+		Cron:    "* * * * *",
+		Name:    "notify-rollup",
+		Run:     notifyRollup,
+		Timeout: 30 * time.Second,
+	},
+}
+
+// ScheduleRun is the last run of a scheduled task
+// Time is the minute the run was scheduled for, and claiming it is what prevents a double run
+type ScheduleRun struct {
+	Task      string     `json:"-" dynamodbav:"id"`
+	Error     string     `json:"error,omitempty"`
+	Status    JobStatus  `json:"status"`
+	Time      time.Time  `json:"time"`
+	TimeEnd   *time.Time `json:"time_end,omitempty"`
+	TimeStart *time.Time `json:"time_start,omitempty"`
+}
+
+// ScheduleStatus is a scheduled task with its last and next runs
+type ScheduleStatus struct {
+	Cron    string       `json:"cron"`
+	LastRun *ScheduleRun `json:"last_run,omitempty"`
+	Name    string       `json:"name"`
+	NextRun time.Time    `json:"next_run"`
+	Timeout string       `json:"timeout"`
+}
+
+// JobsSchedule returns every scheduled task with its last and next runs
+func JobsSchedule(ctx context.Context, e events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	r, _, err := JWTClaims(e, &jwt.StandardClaims{})
+	if err != nil {
+		return r, nil
+	}
+
+	now := time.Now()
+	tasks := []ScheduleStatus{}
+
+	for _, t := range Schedule {
+		c, err := ParseCron(t.Cron)
+		if err != nil {
+			return responseEmpty, errors.WithStack(err)
+		}
+
+		run, err := scheduleGet(ctx, t.Name)
+		if err != nil {
+			return responseEmpty, errors.WithStack(err)
+		}
+
+		tasks = append(tasks, ScheduleStatus{
+			Cron:    t.Cron,
+			LastRun: run,
+			Name:    t.Name,
+			NextRun: c.Next(now),
+			Timeout: t.Timeout.String(),
+		})
+	}
+
+	b, err := json.MarshalIndent(map[string]interface{}{"tasks": tasks}, "", "  ")
+	if err != nil {
+		return responseEmpty, errors.WithStack(err)
+	}
+
+	return events.APIGatewayProxyResponse{
+		Body: string(b) + "\n",
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		StatusCode: 200,
+	}, nil
+}
+
+// dispatch runs every task in the schedule that is due at the minute of t, at once
+// It returns an error naming the tasks that failed
+func dispatch(ctx context.Context, t time.Time) error {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	t = t.UTC().Truncate(time.Minute)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := []string{}
+
+	for _, task := range Schedule {
+		c, err := ParseCron(task.Cron)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", task.Name, err))
+			continue
+		}
+		if !c.Match(t) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(task ScheduledTask) {
+			defer wg.Done()
+			if err := dispatchTask(ctx, task, t); err != nil {
+				log.Printf("WorkerPeriodic task %s error %+v\n", task.Name, err)
+				mu.Lock()
+				failed = append(failed, fmt.Sprintf("%s: %s", task.Name, err))
+				mu.Unlock()
+			}
+		}(task)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return errors.Errorf("%d scheduled tasks failed: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// dispatchTask claims the run of a task at t, runs it with its timeout and records the status
+// A run that another invocation already claimed is skipped
+func dispatchTask(ctx context.Context, task ScheduledTask, t time.Time) error {
+	now := time.Now()
+	_, err := scheduleUpdate(ctx, task.Name,
+		"SET #status = :running, #time = :time, time_start = :now REMOVE #error, time_end",
+		"attribute_not_exists(#time) OR #time < :time",
+		map[string]string{"#error": "error", "#status": "status", "#time": "time"},
+		map[string]interface{}{":now": now, ":running": JobRunning, ":time": t},
+	)
+	if jobConflict(err) {
+		log.Printf("WorkerPeriodic task %s already ran at %s\n", task.Name, t.Format(time.RFC3339))
+		return nil
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	log.Printf("WorkerPeriodic task %s running for %s\n", task.Name, t.Format(time.RFC3339))
+	errRun := scheduleRun(ctx, task, t)
+
+	update := "SET #status = :succeeded, time_end = :now"
+	values := map[string]interface{}{":now": time.Now(), ":succeeded": JobSucceeded, ":time": t}
+	if errRun != nil {
+		update = "SET #status = :failed, #error = :error, time_end = :now"
+		values = map[string]interface{}{":error": errRun.Error(), ":failed": JobFailed, ":now": time.Now(), ":time": t}
+	}
+
+	_, err = scheduleUpdate(ctx, task.Name, update, "#time = :time",
+		map[string]string{"#error": "error", "#status": "status", "#time": "time"},
+		values,
+	)
+	if err != nil && !jobConflict(err) {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(errRun)
+}
+
+// scheduleRun runs a task with its timeout
+// A task that doesn't stop when its context is cancelled is left behind and reported as timed out
+func scheduleRun(ctx context.Context, task ScheduledTask, t time.Time) error {
+	if task.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, task.Timeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- task.Run(ctx, t)
+	}()
+
+	select {
+	case err := <-done:
+		return errors.WithStack(err)
+	case <-ctx.Done():
+		return errors.Errorf("task %s timed out after %s", task.Name, task.Timeout)
+	}
+}
+
+// scheduleCleanup runs the bucket cleanup as a scheduled task
+func scheduleCleanup(ctx context.Context, t time.Time) error {
+	cp, err := cleanupCheckpoint(events.CloudWatchEvent{Time: t})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return cleanup(ctx, cp)
+}
+
+// scheduleGet returns the last run of a task, or nil if it never ran
+func scheduleGet(ctx context.Context, name string) (*ScheduleRun, error) {
+	out, err := DynamoDB.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: aws.String(name),
+			},
+		},
+		TableName: aws.String(Config.Schedule.TableName),
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	r := ScheduleRun{}
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &r); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &r, nil
+}
+
+// scheduleUpdate atomically updates the last run of a task if the condition holds, returning the updated run
+// Use jobConflict to check for a failed condition.
+func scheduleUpdate(ctx context.Context, name, update, cond string, names map[string]string, values map[string]interface{}) (*ScheduleRun, error) {
+	vs, err := dynamodbattribute.MarshalMap(values)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	out, err := DynamoDB.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		ConditionExpression:       aws.String(cond),
+		ExpressionAttributeNames:  aws.StringMap(names),
+		ExpressionAttributeValues: vs,
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: aws.String(name),
+			},
+		},
+		ReturnValues:     aws.String(dynamodb.ReturnValueAllNew),
+		TableName:        aws.String(Config.Schedule.TableName),
+		UpdateExpression: aws.String(update),
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	r := ScheduleRun{}
+	if err := dynamodbattribute.UnmarshalMap(out.Attributes, &r); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &r, nil
+}
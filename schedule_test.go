@@ -0,0 +1,169 @@
+package gofaas
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCron(t *testing.T) {
+	// Thursday
+	now := time.Date(2018, 2, 22, 3, 4, 30, 0, time.UTC)
+
+	cases := []struct {
+		expr string
+		next time.Time
+	}{
+		{expr: "* * * * *", next: time.Date(2018, 2, 22, 3, 5, 0, 0, time.UTC)},
+		{expr: "0 3 * * *", next: time.Date(2018, 2, 23, 3, 0, 0, 0, time.UTC)},
+		{expr: "*/15 * * * *", next: time.Date(2018, 2, 22, 3, 15, 0, 0, time.UTC)},
+		{expr: "10-20/5 9-17 * * ?", next: time.Date(2018, 2, 22, 9, 10, 0, 0, time.UTC)},
+		{expr: "0 0 1 * *", next: time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{expr: "30 12 * * 0,6", next: time.Date(2018, 2, 24, 12, 30, 0, 0, time.UTC)},
+		{expr: "0 0 * * 7", next: time.Date(2018, 2, 25, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 29 2 *", next: time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 31 4 *", next: time.Time{}},
+		// either the day of month or the day of week
+		{expr: "0 0 1 * 5", next: time.Date(2018, 2, 23, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		cron, err := ParseCron(c.expr)
+		if assert.NoError(t, err, c.expr) {
+			assert.Equal(t, c.next, cron.Next(now), c.expr)
+			if !c.next.IsZero() {
+				assert.True(t, cron.Match(c.next), c.expr)
+				assert.False(t, cron.Match(c.next.Add(-time.Minute)) && c.expr != "* * * * *", c.expr)
+			}
+		}
+	}
+
+	for expr, msg := range map[string]string{
+		"* * * *":     `cron "* * * *" has 4 fields, not 5`,
+		"60 * * * *":  `cron "60 * * * *" minute: value 60 is not within 0-59`,
+		"* * 0 * *":   `cron "* * 0 * *" day of month: value 0 is not within 1-31`,
+		"* 5-1 * * *": `cron "* 5-1 * * *" hour: range "5-1" is backwards`,
+		"*/0 * * * *": `cron "*/0 * * * *" minute: step "0" is not a positive int`,
+		"* * * JAN *": `cron "* * * JAN *" month: value "JAN" is not an int`,
+	} {
+		_, err := ParseCron(expr)
+		assert.EqualError(t, err, msg)
+	}
+
+	for _, task := range Schedule {
+		_, err := ParseCron(task.Cron)
+		assert.NoError(t, err, task.Name)
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	Config.Schedule.TableName = "gofaas-ScheduleTable"
+
+	schedule := Schedule
+	defer func() { Schedule = schedule }()
+
+	var mu sync.Mutex
+	runs := map[string]int{}
+	run := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		runs[name]++
+	}
+	counts := func() map[string]int {
+		mu.Lock()
+		defer mu.Unlock()
+		m := map[string]int{}
+		for k, v := range runs {
+			m[k] = v
+		}
+		return m
+	}
+
+	Schedule = []ScheduledTask{
+		{
+			Cron: "*/5 * * * *",
+			Name: "often",
+			Run: func(ctx context.Context, t time.Time) error {
+				run("often")
+				return nil
+			},
+			Timeout: time.Second,
+		},
+		{
+			Cron: "0 * * * *",
+			Name: "hourly",
+			Run: func(ctx context.Context, t time.Time) error {
+				run("hourly")
+				return errors.New("hourly failed")
+			},
+			Timeout: time.Second,
+		},
+		{
+			Cron: "0 3 * * *",
+			Name: "stuck",
+			Run: func(ctx context.Context, t time.Time) error {
+				run("stuck")
+				time.Sleep(time.Second)
+				return nil
+			},
+			Timeout: 100 * time.Millisecond,
+		},
+	}
+
+	DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+
+	ctx := context.Background()
+	t0 := time.Date(2018, 2, 22, 3, 0, 12, 0, time.UTC)
+
+	err := dispatch(ctx, t0)
+	assert.EqualError(t, err, "2 scheduled tasks failed: hourly: hourly failed; stuck: task stuck timed out after 100ms")
+
+	// a second event for the same minute doesn't run the tasks again
+	assert.NoError(t, dispatch(ctx, t0.Add(30*time.Second)))
+	assert.Equal(t, map[string]int{"hourly": 1, "often": 1, "stuck": 1}, counts())
+
+	assert.NoError(t, dispatch(ctx, t0.Add(5*time.Minute)))
+	assert.Equal(t, map[string]int{"hourly": 1, "often": 2, "stuck": 1}, counts())
+
+	last, err := scheduleGet(ctx, "often")
+	if assert.NoError(t, err) && assert.NotNil(t, last) {
+		assert.Equal(t, JobSucceeded, last.Status)
+		assert.Equal(t, time.Date(2018, 2, 22, 3, 5, 0, 0, time.UTC), last.Time)
+		assert.NotNil(t, last.TimeEnd)
+	}
+
+	last, err = scheduleGet(ctx, "stuck")
+	if assert.NoError(t, err) && assert.NotNil(t, last) {
+		assert.Equal(t, JobFailed, last.Status)
+		assert.Equal(t, "task stuck timed out after 100ms", last.Error)
+	}
+
+	r, err := JobsSchedule(ctx, events.APIGatewayProxyRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, 200, r.StatusCode)
+
+	body := struct {
+		Tasks []ScheduleStatus `json:"tasks"`
+	}{}
+	assert.NoError(t, json.Unmarshal([]byte(r.Body), &body))
+	if assert.Len(t, body.Tasks, 3) {
+		hourly := body.Tasks[1]
+		assert.Equal(t, "hourly", hourly.Name)
+		assert.Equal(t, "0 * * * *", hourly.Cron)
+		assert.Equal(t, "1s", hourly.Timeout)
+		assert.Equal(t, 0, hourly.NextRun.Minute())
+		assert.True(t, hourly.NextRun.After(time.Now()))
+		if assert.NotNil(t, hourly.LastRun) {
+			assert.Equal(t, JobFailed, hourly.LastRun.Status)
+			assert.Equal(t, "hourly failed", hourly.LastRun.Error)
+			assert.Equal(t, time.Date(2018, 2, 22, 3, 0, 0, 0, time.UTC), hourly.LastRun.Time)
+		}
+	}
+}
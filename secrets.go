@@ -0,0 +1,180 @@
+package gofaas
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/pkg/errors"
+)
+
+// Secrets resolves and caches the references in Secret config values
+var Secrets = &SecretCache{
+	Providers: map[string]SecretProvider{
+		"secretsmanager": SecretsManagerSecrets{},
+		"ssm":            SSMSecrets{},
+	},
+	TTL: 5 * time.Minute,
+}
+
+// Secret is a config value that is either a literal or a reference to a secret
+// like "ssm:/gofaas/AuthHashKey" or "secretsmanager:arn:aws:secretsmanager:us-east-1:123456789012:secret:gofaas"
+type Secret string
+
+// Value resolves the secret with Secrets
+func (s Secret) Value() (string, error) {
+	return Secrets.Get(string(s))
+}
+
+// SecretProvider looks up a secret by name
+type SecretProvider interface {
+	Secret(ctx context.Context, name string) (string, error)
+}
+
+// SecretCache resolves secret references with a Provider for the reference scheme
+// Values are cached, and once older than TTL are refreshed in the background so rotated secrets are picked up
+type SecretCache struct {
+	Providers map[string]SecretProvider
+	TTL       time.Duration
+
+	entries map[string]*secretEntry
+	mu      sync.Mutex
+}
+
+type secretEntry struct {
+	fetched    time.Time
+	refreshing bool
+	value      string
+}
+
+// Get returns the value of a secret reference, or a literal value as is
+// A cached value older than TTL is returned while it is refreshed in the background
+func (c *SecretCache) Get(ref string) (string, error) {
+	p, name := c.provider(ref)
+	if p == nil {
+		return ref, nil
+	}
+
+	c.mu.Lock()
+	e, ok := c.entries[ref]
+	if ok {
+		if time.Since(e.fetched) > c.TTL && !e.refreshing {
+			e.refreshing = true
+			go c.refresh(ref, p, name)
+		}
+		v := e.value
+		c.mu.Unlock()
+		return v, nil
+	}
+	c.mu.Unlock()
+
+	return c.fetch(ref, p, name)
+}
+
+// provider returns the provider and secret name for a reference, or nil if ref is a literal
+func (c *SecretCache) provider(ref string) (SecretProvider, string) {
+	i := strings.Index(ref, ":")
+	if i == -1 {
+		return nil, ""
+	}
+	return c.Providers[ref[:i]], ref[i+1:]
+}
+
+func (c *SecretCache) fetch(ref string, p SecretProvider, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	v, err := p.Secret(ctx, name)
+	if err != nil {
+		return "", errors.Wrapf(err, "secret %s", ref)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[string]*secretEntry{}
+	}
+	c.entries[ref] = &secretEntry{
+		fetched: time.Now(),
+		value:   v,
+	}
+
+	return v, nil
+}
+
+// refresh fetches a cached secret again, keeping the stale value on error so the next Get retries
+func (c *SecretCache) refresh(ref string, p SecretProvider, name string) {
+	if _, err := c.fetch(ref, p, name); err != nil {
+		log.Printf("SecretCache refresh error %+v\n", err)
+
+		c.mu.Lock()
+		c.entries[ref].refreshing = false
+		c.mu.Unlock()
+	}
+}
+
+// MemorySecrets is an in-memory SecretProvider for tests
+type MemorySecrets struct {
+	Values map[string]string
+
+	mu sync.Mutex
+}
+
+// Secret returns a value by name
+func (m *MemorySecrets) Secret(ctx context.Context, name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.Values[name]
+	if !ok {
+		return "", fmt.Errorf("%s not found", name)
+	}
+	return v, nil
+}
+
+// Set sets a value by name, e.g. to rotate a secret
+func (m *MemorySecrets) Set(name, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Values == nil {
+		m.Values = map[string]string{}
+	}
+	m.Values[name] = value
+}
+
+// SecretsManagerSecrets is a SecretProvider for Secrets Manager secret strings by name or ARN
+type SecretsManagerSecrets struct{}
+
+// Secret returns the current secret string
+func (s SecretsManagerSecrets) Secret(ctx context.Context, name string) (string, error) {
+	out, err := SecretsManager.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return aws.StringValue(out.SecretString), nil
+}
+
+// SSMSecrets is a SecretProvider for SSM Parameter Store parameters, decrypting SecureString values
+type SSMSecrets struct{}
+
+// Secret returns the parameter value
+func (s SSMSecrets) Secret(ctx context.Context, name string) (string, error) {
+	out, err := SSM.GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return aws.StringValue(out.Parameter.Value), nil
+}
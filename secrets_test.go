@@ -0,0 +1,63 @@
+package gofaas
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecrets(t *testing.T) {
+	mem := &MemorySecrets{}
+	mem.Set("/gofaas/AuthHashKey", "c2VjcmV0")
+
+	secrets := Secrets
+	defer func() { Secrets = secrets }()
+
+	Secrets = &SecretCache{
+		Providers: map[string]SecretProvider{"ssm": mem},
+		TTL:       time.Hour,
+	}
+
+	env := map[string]string{
+		"AUTH_HASH_KEY": "ssm:/gofaas/AuthHashKey",
+	}
+
+	auth := AuthConfig{}
+	err := loadConfig(func(k string) string { return env[k] }, &auth)
+	assert.NoError(t, err)
+
+	v, err := auth.HashKey.Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "c2VjcmV0", v)
+
+	// literals and unknown schemes are values as is
+	v, err = Secret("arn:aws:sns:us-east-1:123456789012:topic").Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "arn:aws:sns:us-east-1:123456789012:topic", v)
+
+	// missing secrets fail at cold start
+	env["AUTH_HASH_KEY"] = "ssm:/gofaas/Missing"
+	err = loadConfig(func(k string) string { return env[k] }, &auth)
+	assert.EqualError(t, err, "invalid config: AUTH_HASH_KEY secret ssm:/gofaas/Missing: /gofaas/Missing not found")
+
+	// rotated secrets are cached until the TTL then refreshed in the background
+	auth.HashKey = "ssm:/gofaas/AuthHashKey"
+	mem.Set("/gofaas/AuthHashKey", "cm90YXRlZA==")
+
+	v, err = auth.HashKey.Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "c2VjcmV0", v)
+
+	Secrets.TTL = 0
+
+	v, err = auth.HashKey.Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "c2VjcmV0", v)
+
+	for i := 0; i < 100 && v != "cm90YXRlZA=="; i++ {
+		time.Sleep(time.Millisecond)
+		v, _ = auth.HashKey.Value()
+	}
+	assert.Equal(t, "cm90YXRlZA==", v)
+}
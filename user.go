@@ -3,7 +3,6 @@ package gofaas
 import (
 	"context"
 	"encoding/json"
-	"os"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
@@ -124,7 +123,7 @@ func userGet(ctx context.Context, id string, decrypt bool) (*User, error) {
 				S: aws.String(id),
 			},
 		},
-		TableName: aws.String(os.Getenv("TABLE_NAME")),
+		TableName: aws.String(Config.User.TableName),
 	})
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -160,7 +159,7 @@ func userDelete(ctx context.Context, u *User) error {
 				S: aws.String(u.ID),
 			},
 		},
-		TableName: aws.String(os.Getenv("TABLE_NAME")),
+		TableName: aws.String(Config.User.TableName),
 	})
 
 	return errors.WithStack(err)
@@ -171,7 +170,7 @@ func userPut(ctx context.Context, u *User) error {
 	if u.TokenPlain != "" {
 		out, err := KMS.EncryptWithContext(ctx, &kms.EncryptInput{
 			Plaintext: []byte(u.TokenPlain),
-			KeyId:     aws.String(os.Getenv("KEY_ID")),
+			KeyId:     aws.String(Config.User.KeyID),
 		})
 		if err != nil {
 			return errors.WithStack(err)
@@ -193,7 +192,7 @@ func userPut(ctx context.Context, u *User) error {
 				S: aws.String(u.Username),
 			},
 		},
-		TableName: aws.String(os.Getenv("TABLE_NAME")),
+		TableName: aws.String(Config.User.TableName),
 	})
 
 	return errors.WithStack(err)
@@ -4,12 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/satori/go.uuid"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 )
 
@@ -44,3 +46,212 @@ func TestUserCreate(t *testing.T) {
 		r,
 	)
 }
+
+// TestUserReplay replays testdata/TestUserReplay.json, which is hand-written and not a recording
+// Recording with GOFAAS_RECORD=true is unverified, so the responses are no more real than a mock's.
+func TestUserReplay(t *testing.T) {
+	ctx, done := Replay(t)
+	defer done()
+
+	Config.User = UserConfig{
+		KeyID:     "alias/gofaas",
+		TableName: "gofaas-UsersTable",
+	}
+
+	UUIDGen = func() uuid.UUID {
+		return uuid.Must(uuid.FromString("26f0dc9f-4483-4b65-8724-3d1598ff6d14"))
+	}
+
+	r, err := UserCreate(ctx, events.APIGatewayProxyRequest{
+		Body: `{"username": "test"}`,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 200, r.StatusCode)
+
+	r, err = UserRead(ctx, events.APIGatewayProxyRequest{
+		PathParameters:        map[string]string{"id": "26f0dc9f-4483-4b65-8724-3d1598ff6d14"},
+		QueryStringParameters: map[string]string{"token": "true"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "{\n  \"id\": \"26f0dc9f-4483-4b65-8724-3d1598ff6d14\",\n  \"token\": \"26f0dc9f-4483-4b65-8724-3d1598ff6d14\",\n  \"username\": \"test\"\n}\n", r.Body)
+
+	r, err = UserUpdate(ctx, events.APIGatewayProxyRequest{
+		Body:           `{"username": "test2"}`,
+		PathParameters: map[string]string{"id": "26f0dc9f-4483-4b65-8724-3d1598ff6d14"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "{\n  \"id\": \"26f0dc9f-4483-4b65-8724-3d1598ff6d14\",\n  \"username\": \"test2\"\n}\n", r.Body)
+
+	r, err = UserDelete(ctx, events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"id": "26f0dc9f-4483-4b65-8724-3d1598ff6d14"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 200, r.StatusCode)
+
+	r, err = UserRead(ctx, events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"id": "26f0dc9f-4483-4b65-8724-3d1598ff6d14"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 404, r.StatusCode)
+}
+
+func TestUserFaults(t *testing.T) {
+	Config.Notify.Topic = "arn:aws:sns:us-east-1:123456789012:gofaas-NotificationTopic"
+	defer func() { Config.Notify.Topic = "" }()
+
+	item := &dynamodb.GetItemOutput{
+		Item: map[string]*dynamodb.AttributeValue{
+			"id":       {S: aws.String("26f0dc9f-4483-4b65-8724-3d1598ff6d14")},
+			"token":    {B: []byte("dG9rZW4=")},
+			"username": {S: aws.String("test")},
+		},
+	}
+
+	read := events.APIGatewayProxyRequest{
+		PathParameters:        map[string]string{"id": "26f0dc9f-4483-4b65-8724-3d1598ff6d14"},
+		QueryStringParameters: map[string]string{"token": "true"},
+	}
+
+	update := events.APIGatewayProxyRequest{
+		Body:           `{"username": "test2"}`,
+		PathParameters: map[string]string{"id": "26f0dc9f-4483-4b65-8724-3d1598ff6d14"},
+	}
+
+	cases := []struct {
+		name    string
+		handler HandlerAPIGateway
+		req     events.APIGatewayProxyRequest
+		get     *dynamodb.GetItemOutput
+		ddb     []Fault
+		kms     []Fault
+		sns     []Fault
+		timeout time.Duration
+
+		status    int
+		body      string
+		err       string
+		published int
+	}{
+		{
+			name:      "CreatePutItemThrottled",
+			handler:   UserCreate,
+			req:       events.APIGatewayProxyRequest{Body: `{"username": "test"}`},
+			ddb:       []Fault{{Op: "PutItem", Err: ErrThrottling(dynamodb.ErrCodeProvisionedThroughputExceededException)}},
+			err:       "ProvisionedThroughputExceededException",
+			published: 1,
+		},
+		{
+			name:      "CreateEncryptAccessDenied",
+			handler:   UserCreate,
+			req:       events.APIGatewayProxyRequest{Body: `{"username": "test"}`},
+			kms:       []Fault{{Op: "Encrypt", Err: ErrAccessDenied()}},
+			err:       "AccessDeniedException",
+			published: 1,
+		},
+		{
+			name:      "ReadDecryptAccessDenied",
+			handler:   UserRead,
+			req:       read,
+			kms:       []Fault{{Op: "Decrypt", Err: ErrAccessDenied()}},
+			err:       "AccessDeniedException",
+			published: 1,
+		},
+		{
+			name:      "ReadGetItemTimeout",
+			handler:   UserRead,
+			req:       read,
+			ddb:       []Fault{{Op: "GetItem", Latency: time.Second}},
+			timeout:   10 * time.Millisecond,
+			err:       "RequestCanceled",
+			published: 1,
+		},
+		{
+			name:    "ReadMissingUsername",
+			handler: UserRead,
+			req: events.APIGatewayProxyRequest{
+				PathParameters: read.PathParameters,
+				RequestContext: events.APIGatewayProxyRequestContext{RequestID: "c6af9ac6-7b61-11e6-9a41-93e8deadbeef"},
+			},
+			get: &dynamodb.GetItemOutput{
+				Item: map[string]*dynamodb.AttributeValue{
+					"id": {S: aws.String("26f0dc9f-4483-4b65-8724-3d1598ff6d14")},
+				},
+			},
+			status:    500,
+			body:      `{"error": "internal server error", "request_id": "c6af9ac6-7b61-11e6-9a41-93e8deadbeef"}` + "\n",
+			published: 1,
+		},
+		{
+			name:    "ReadNotFound",
+			handler: UserRead,
+			req:     read,
+			get:     &dynamodb.GetItemOutput{},
+			status:  404,
+		},
+		{
+			name:      "UpdatePutItemThrottled",
+			handler:   UserUpdate,
+			req:       update,
+			ddb:       []Fault{{Op: "PutItem", Call: 1, Err: ErrThrottling(dynamodb.ErrCodeProvisionedThroughputExceededException)}},
+			err:       "ProvisionedThroughputExceededException",
+			published: 1,
+		},
+		{
+			name:      "DeleteItemThrottled",
+			handler:   UserDelete,
+			req:       read,
+			ddb:       []Fault{{Op: "DeleteItem", Err: ErrThrottling(dynamodb.ErrCodeProvisionedThroughputExceededException)}},
+			err:       "ProvisionedThroughputExceededException",
+			published: 1,
+		},
+		{
+			name:    "DeletePublishFailed",
+			handler: UserDelete,
+			req:     read,
+			ddb:     []Fault{{Op: "DeleteItem", Err: ErrThrottling(dynamodb.ErrCodeProvisionedThroughputExceededException)}},
+			sns:     []Fault{{Op: "Publish", Err: ErrThrottling("Throttling")}},
+			err:     "ProvisionedThroughputExceededException",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			get := item
+			if c.get != nil {
+				get = c.get
+			}
+
+			DynamoDB = FaultDynamoDB{&MockDynamoDB{GetItemOutput: get}, &Faults{Faults: c.ddb}}
+			KMS = FaultKMS{&MockKMS{}, &Faults{Faults: c.kms}}
+
+			ms := &MockSNS{}
+			fs := &Faults{Faults: c.sns}
+			SNS = FaultSNS{ms, fs}
+
+			ctx := context.Background()
+			if c.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, c.timeout)
+				defer cancel()
+			}
+
+			r, err := NotifyAPIGateway(c.handler)(ctx, c.req)
+			if c.err != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), c.err)
+				assert.Equal(t, 1, fs.Calls("Publish"))
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, c.published, fs.Calls("Publish"))
+			}
+			assert.Equal(t, c.status, r.StatusCode)
+			if c.body != "" {
+				assert.Equal(t, c.body, r.Body)
+			}
+
+			if assert.Len(t, ms.Inputs, c.published) && c.published > 0 {
+				assert.Contains(t, *ms.Inputs[0].Message, c.err)
+			}
+		})
+	}
+}
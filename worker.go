@@ -1,99 +1,562 @@
 package gofaas
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
-	"os"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/lambda"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	xrayheader "github.com/aws/aws-xray-sdk-go/header"
+	"github.com/aws/aws-xray-sdk-go/xray"
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 )
 
-// WorkerEvent is foo
+// WorkerEvent is the payload WorkCreate invokes the worker with
+// It carries the context of the caller so the work can be traced and attributed to them
+// Format and Gzip choose how the report is written, see ReportFormats
+// Shard numbers the chunk of a fan-out job the event is for, starting from 1
+// Continuation is set when the work continues from a checkpoint in a new invocation
 type WorkerEvent struct {
-	SourceIP  string    `json:"source_ip"`
-	TimeEnd   time.Time `json:"time_end"`
-	TimeStart time.Time `json:"time_start"`
+	Continuation *Continuation   `json:"continuation,omitempty"`
+	Format       string          `json:"format,omitempty"`
+	Gzip         bool            `json:"gzip,omitempty"`
+	Input        json.RawMessage `json:"input,omitempty"`
+	JobID        string          `json:"job_id,omitempty"`
+	RequestID    string          `json:"request_id,omitempty"`
+	Shard        int             `json:"shard,omitempty"`
+	SourceIP     string          `json:"source_ip"`
+	Subject      string          `json:"subject,omitempty"`
+	TimeEnd      time.Time       `json:"time_end"`
+	TimeStart    time.Time       `json:"time_start"`
+	TraceHeader  string          `json:"trace_header,omitempty"`
 }
 
-// WorkCreate invokes the worker func
+// WorkCreate queues a job with the request body as input and sends it to the worker
 func WorkCreate(ctx context.Context, e events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	r, _, err := JWTClaims(e, &jwt.StandardClaims{})
+	claims := &jwt.StandardClaims{}
+	r, _, err := JWTClaims(e, claims)
 	if err != nil {
 		return r, nil
 	}
 
-	out, err := Lambda.InvokeWithContext(ctx, &lambda.InvokeInput{
-		FunctionName:   aws.String(os.Getenv("WORKER_FUNCTION_NAME")),
-		InvocationType: aws.String("Event"), // async
-	})
+	format := e.QueryStringParameters["format"]
+	if _, ok := ReportFormats[format]; format != "" && !ok {
+		return ResponseError{fmt.Sprintf("unknown report format %q", format), 400}.Response()
+	}
+
+	gz := false
+	if v := e.QueryStringParameters["gzip"]; v != "" {
+		if gz, err = strconv.ParseBool(v); err != nil {
+			return ResponseError{fmt.Sprintf("gzip %q is not a bool", v), 400}.Response()
+		}
+	}
+
+	j := &Job{
+		ID:          UUIDGen().String(),
+		Format:      format,
+		Gzip:        gz,
+		Status:      JobQueued,
+		Subject:     claims.Subject,
+		TimeCreated: time.Now(),
+	}
+
+	if e.Body != "" {
+		if !json.Valid([]byte(e.Body)) {
+			return ResponseError{"input is not valid JSON", 400}.Response()
+		}
+		j.Input = json.RawMessage(e.Body)
+	}
+
+	if v := e.QueryStringParameters["chunk_size"]; v != "" {
+		if err, ok := workFanOut(j, v).(ResponseError); ok {
+			return err.Response()
+		}
+	}
+
+	if err := quotaAcquire(ctx, j, true); err != nil {
+		if err, ok := err.(QuotaError); ok {
+			return err.Response()
+		}
+		return responseEmpty, errors.WithStack(err)
+	}
+
+	if err := jobPut(ctx, j); err != nil {
+		if j.QuotaHeld {
+			quotaFree(ctx, j.Subject, j.ID)
+		}
+		return responseEmpty, errors.WithStack(err)
+	}
+
+	payload, err := workEvent(ctx, e, j)
+	if err == nil {
+		err = workSend(ctx, payload)
+	}
+	if err != nil {
+		j.finish(err)
+		if err := jobPut(ctx, j); err != nil {
+			log.Printf("WorkCreate job %s put error %+v\n", j.ID, err)
+		}
+		quotaRelease(ctx, j.ID)
+		return responseEmpty, errors.WithStack(err)
+	}
+
+	return jobResponse(j, 202)
+}
+
+// WorkRead returns a job status of the caller by id, with a presigned report URL once it has succeeded
+func WorkRead(ctx context.Context, e events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	claims := &jwt.StandardClaims{}
+	r, _, err := JWTClaims(e, claims)
+	if err != nil {
+		return r, nil
+	}
+
+	j, err := jobGetFor(ctx, e.PathParameters["id"], claims.Subject)
+	if err != nil {
+		if err, ok := err.(ResponseError); ok {
+			return err.Response()
+		}
+		return responseEmpty, errors.WithStack(err)
+	}
+
+	if err := jobReportURL(ctx, j); err != nil {
+		return responseEmpty, errors.WithStack(err)
+	}
+
+	return jobResponse(j, 200)
+}
+
+// WorkRetry queues a failed job again and sends it to the worker
+// A fan-out job only runs the shards that didn't succeed
+func WorkRetry(ctx context.Context, e events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	claims := &jwt.StandardClaims{}
+	r, _, err := JWTClaims(e, claims)
+	if err != nil {
+		return r, nil
+	}
+
+	id := e.PathParameters["id"]
+	j, err := jobGetFor(ctx, id, claims.Subject)
 	if err != nil {
+		if err, ok := err.(ResponseError); ok {
+			return err.Response()
+		}
 		return responseEmpty, errors.WithStack(err)
 	}
 
-	b, err := json.Marshal(out)
+	// a retried job runs again, but it was already counted against the jobs per day quota
+	acquired := false
+	if j.Status == JobFailed && !j.QuotaHeld {
+		if err := quotaAcquire(ctx, j, false); err != nil {
+			if err, ok := err.(QuotaError); ok {
+				return err.Response()
+			}
+			return responseEmpty, errors.WithStack(err)
+		}
+		acquired = j.QuotaHeld
+	}
+
+	held, subject := j.QuotaHeld, j.Subject
+	j, err = jobUpdate(ctx, id,
+		"SET #status = :queued, quota_held = :held REMOVE time_end, time_start",
+		"#status = :failed",
+		map[string]string{"#status": "status"},
+		map[string]interface{}{":failed": JobFailed, ":held": held, ":queued": JobQueued},
+	)
 	if err != nil {
+		if acquired {
+			quotaFree(ctx, subject, id)
+		}
+		if jobConflict(err) {
+			return ResponseError{fmt.Sprintf("job %s is not failed", id), 409}.Response()
+		}
 		return responseEmpty, errors.WithStack(err)
 	}
 
-	r.Body = string(b)
-	return r, nil
+	payload, err := workEvent(ctx, e, j)
+	if err != nil {
+		return responseEmpty, errors.WithStack(err)
+	}
+
+	if err := workSend(ctx, payload); err != nil {
+		return responseEmpty, errors.WithStack(err)
+	}
+
+	return jobResponse(j, 202)
+}
+
+// workFanOut makes a job a fan-out job that splits its input array into chunks of size
+// It returns a 400 ResponseError if the size or input are invalid
+func workFanOut(j *Job, size string) error {
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 1 {
+		return ResponseError{fmt.Sprintf("chunk_size %q is not a positive int", size), 400}
+	}
+
+	j.ChunkSize = n
+	j.Type = JobFanOut
+
+	chunks, err := fanOutChunks(j)
+	if err != nil || len(chunks) == 0 {
+		return ResponseError{"fan-out input is not a non-empty JSON array", 400}
+	}
+	if len(chunks) > fanOutMaxShards {
+		return ResponseError{fmt.Sprintf("fan-out input splits into %d shards, more than %d", len(chunks), fanOutMaxShards), 400}
+	}
+
+	return nil
+}
+
+// workEvent returns the worker event payload for a job, with the context of the caller
+func workEvent(ctx context.Context, e events.APIGatewayProxyRequest, j *Job) ([]byte, error) {
+	b, err := json.Marshal(WorkerEvent{
+		Format:      j.Format,
+		Gzip:        j.Gzip,
+		Input:       j.Input,
+		JobID:       j.ID,
+		RequestID:   e.RequestContext.RequestID,
+		SourceIP:    e.RequestContext.Identity.SourceIP,
+		Subject:     j.Subject,
+		TimeStart:   j.TimeCreated,
+		TraceHeader: traceHeader(ctx),
+	})
+	return b, errors.WithStack(err)
+}
+
+// workSend sends a worker event to the work queue, or invokes the worker func if there is no queue
+func workSend(ctx context.Context, payload []byte) error {
+	if Config.Work.QueueURL != "" {
+		_, err := SQS.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+			MessageBody: aws.String(string(payload)),
+			QueueUrl:    aws.String(Config.Work.QueueURL),
+		})
+		return errors.WithStack(err)
+	}
+
+	_, err := Lambda.InvokeWithContext(ctx, &lambda.InvokeInput{
+		FunctionName:   aws.String(Config.Work.WorkerFunctionName),
+		InvocationType: aws.String("Event"), // async
+		Payload:        payload,
+	})
+	return errors.WithStack(err)
 }
 
 // Worker is invoked directly to perform work then upload a report to S3
+// Events with a job ID track the job status from running to succeeded or failed
 func Worker(ctx context.Context, e WorkerEvent) error {
+	return runWorker(ctx, e, false)
+}
+
+// runWorker performs the work for an event
+// If retry is set a job that fails is queued again for the next attempt rather than failed
+func runWorker(ctx context.Context, e WorkerEvent, retry bool) (err error) {
 	log.Printf("Worker Event: %+v\n", e)
+	log.Printf("Worker job %s for subject %q from request %s\n", e.JobID, e.Subject, e.RequestID)
 
-	e.TimeEnd = time.Now()
+	ctx, seg := workerSegment(ctx, e)
+	if seg != nil {
+		defer func() { seg.Close(err) }()
+	}
 
-	b, err := json.Marshal(e)
+	if e.JobID == "" {
+		_, err := work(ctx, e, uuid.NewV4().String())
+		return errors.WithStack(err)
+	}
+
+	if e.Shard > 0 {
+		return runShard(ctx, e, retry)
+	}
+
+	j, err := jobGet(ctx, e.JobID)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
-	_, err = S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
-		Body:   bytes.NewReader(b),
-		Bucket: aws.String(os.Getenv("BUCKET")),
-		Key:    aws.String(uuid.NewV4().String()),
-	})
+	// queued work may be delivered more than once
+	if j.Status == JobSucceeded || j.Status == JobCancelled {
+		log.Printf("Worker job %s already %s\n", j.ID, j.Status)
+		return nil
+	}
+
+	if j.CancelRequested {
+		return jobCancel(ctx, j)
+	}
+
+	if j.Type == JobFanOut {
+		return fanOut(ctx, e, j)
+	}
+
+	if e.Continuation == nil {
+		if err := jobStart(ctx, j); err != nil {
+			if jobConflict(err) {
+				return jobChanged(ctx, j.ID)
+			}
+			return errors.WithStack(err)
+		}
+	}
+	quotaRenew(ctx, j)
+
+	wctx, cancel := WithJobCancel(ctx, j.ID)
+	j.ReportKey, err = work(wctx, e, j.ID)
+	cancel()
+
+	switch {
+	case JobCancelRequested(wctx):
+		return jobCancel(ctx, j)
+	case err == nil && j.ReportKey == "":
+		log.Printf("Worker job %s continuing in a new invocation\n", j.ID)
+		return nil
+	case errors.Cause(err) == ErrContinuationCap:
+		// the cap is already notified and retrying won't help
+		j.finish(err)
+		err = nil
+	case err != nil && retry:
+		j.retry(err)
+	default:
+		j.finish(err)
+	}
+
+	if errEnd := jobEnd(ctx, j); errEnd != nil {
+		if jobConflict(errEnd) {
+			return jobChanged(ctx, j.ID)
+		}
+		if err == nil {
+			err = errEnd
+		}
+		log.Printf("Worker job %s put error %+v\n", j.ID, errEnd)
+	} else if j.Status != JobQueued {
+		quotaRelease(ctx, j.ID)
+	}
 	return errors.WithStack(err)
 }
 
-// WorkerPeriodic runs on a schedule to clean S3
-func WorkerPeriodic(ctx context.Context, e events.CloudWatchEvent) error {
-	log.Printf("WorkerPeriodic Event: %+v\n", e)
+// traceHeader returns the X-Ray trace header for calls downstream of ctx, or "" if ctx is not traced
+func traceHeader(ctx context.Context) string {
+	if seg := xray.GetSegment(ctx); seg != nil {
+		return seg.DownstreamHeader().String()
+	}
+	if h, ok := ctx.Value(xray.LambdaTraceHeaderKey).(string); ok {
+		return h
+	}
+	return ""
+}
 
-	iter := s3manager.NewDeleteListIterator(
-		S3,
-		&s3.ListObjectsInput{
-			Bucket: aws.String(os.Getenv("BUCKET")),
-		},
-		iterWithContext(ctx),
-	)
+// workerSegment begins a segment for the work, annotated with the job and caller
+// Lambda continues the trace of a direct invoke itself, so the worker only begins a subsegment.
+// Work from the queue, or outside of Lambda, continues the caller's trace from the event header instead,
+// annotated with the trace of the invocation that delivered it.
+func workerSegment(ctx context.Context, e WorkerEvent) (context.Context, *xray.Segment) {
+	caller := xrayheader.FromString(e.TraceHeader)
+	invocation := ""
+	if h := traceHeader(ctx); h != "" {
+		invocation = xrayheader.FromString(h).TraceID
+	}
+
+	var seg *xray.Segment
+	if caller.TraceID != "" && caller.TraceID != invocation {
+		ctx, seg = xray.NewSegmentFromHeader(ctx, "Worker", caller)
+		if invocation != "" {
+			seg.AddAnnotation("invocation_trace_id", invocation)
+		}
+	} else {
+		ctx, seg = xray.BeginSubsegment(ctx, "Worker")
+	}
+	if seg == nil {
+		return ctx, nil
+	}
+
+	for k, v := range map[string]string{
+		"job_id":     e.JobID,
+		"request_id": e.RequestID,
+		"subject":    e.Subject,
+	} {
+		if v != "" {
+			seg.AddAnnotation(k, v)
+		}
+	}
+
+	return ctx, seg
+}
 
-	err := s3manager.NewBatchDeleteWithClient(S3).Delete(ctx, iter)
+// workState is the checkpoint of work that continues in a new invocation
+// Parts are the keys of the NDJSON report parts written by each invocation so far
+type workState struct {
+	Next  int      `json:"next"`
+	Parts []string `json:"parts"`
+}
+
+// work performs the work for each item of an event and streams the report to S3, returning its key
+// Work that gets near the deadline writes its records to a report part, saves a checkpoint and
+// continues from the next item in a new invocation, returning "". The last invocation merges the parts.
+func work(ctx context.Context, e WorkerEvent, id string) (string, error) {
+	ctx = withDeadlineBudget(ctx)
+
+	state := workState{}
+	if e.Continuation != nil {
+		if err := checkpoints().Load(ctx, e.Continuation.Token, &state); err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+
+	items := workItems(e)
+	records := []interface{}{}
+
+	for i := state.Next; state.Next < len(items); state.Next++ {
+		if err := ctx.Err(); err != nil {
+			return "", errors.WithStack(err)
+		}
+		if state.Next > i && DeadlineNear(ctx) {
+			break
+		}
+
+		// perform work on item here
+		r := e
+		r.Continuation = nil
+		r.Input = items[state.Next]
+		r.TimeEnd = time.Now()
+		records = append(records, r)
+	}
+
+	if state.Next < len(items) {
+		return "", workContinue(ctx, e, id, state, records)
+	}
+
+	w, err := NewReportWriter(ctx, e, id)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	for _, key := range state.Parts {
+		if err := reportCopy(ctx, w, key); err != nil {
+			return "", w.Abort(err)
+		}
+	}
+
+	for _, r := range records {
+		if err := w.Write(r); err != nil {
+			return "", w.Abort(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if e.Continuation != nil {
+		if err := reportDelete(ctx, state.Parts); err != nil {
+			log.Printf("Worker %s report part cleanup error %+v\n", id, err)
+		}
+		if err := checkpoints().Delete(ctx, e.Continuation.Token); err != nil {
+			log.Printf("Worker %s checkpoint cleanup error %+v\n", id, err)
+		}
+	}
+
+	return w.Key, nil
+}
+
+// workItems returns the elements of an input array to work on one by one, or the input as a single item
+func workItems(e WorkerEvent) []json.RawMessage {
+	items := []json.RawMessage{}
+	if err := json.Unmarshal(e.Input, &items); err != nil {
+		return []json.RawMessage{e.Input}
+	}
+	return items
+}
+
+// workContinue writes the records of an invocation to a report part, saves the checkpoint of work
+// and sends the event to continue from it
+func workContinue(ctx context.Context, e WorkerEvent, id string, state workState, records []interface{}) error {
+	c := Continuation{Token: workCheckpoint(id)}
+	if e.Continuation != nil {
+		c = *e.Continuation
+	}
+
+	// parts are always NDJSON so they can be streamed back
+	p := e
+	p.Format = "ndjson"
+	p.Gzip = false
+
+	w, err := NewReportWriter(ctx, p, fmt.Sprintf("%s/parts/%04d", id, len(state.Parts)+1))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, r := range records {
+		if err := w.Write(r); err != nil {
+			return w.Abort(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	state.Parts = append(state.Parts, w.Key)
+
+	if err := checkpoints().Save(ctx, c.Token, state); err != nil {
+		return errors.WithStack(err)
+	}
+
+	log.Printf("Worker %s continuing from item %d of %s\n", id, state.Next, c.Token)
+
+	return Continue(ctx, c, func(c Continuation) error {
+		e.Continuation = &c
+		return workerSend(ctx, e)
+	})
+}
+
+// workCheckpoint returns the checkpoint token of the work on a job
+func workCheckpoint(id string) string {
+	return "work-" + id
+}
+
+// workerSend sends an event from the worker back to itself, through the work queue if there is one
+func workerSend(ctx context.Context, e WorkerEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if Config.Continue.QueueURL != "" {
+		_, err := SQS.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+			MessageBody: aws.String(string(b)),
+			QueueUrl:    aws.String(Config.Continue.QueueURL),
+		})
+		return errors.WithStack(err)
+	}
+
+	if Config.Continue.FunctionName == "" {
+		return errors.New("worker has no queue or function name to send work to")
+	}
+
+	_, err = Lambda.InvokeWithContext(ctx, &lambda.InvokeInput{
+		FunctionName:   aws.String(Config.Continue.FunctionName),
+		InvocationType: aws.String("Event"), // async
+		Payload:        b,
+	})
 	return errors.WithStack(err)
 }
 
-// iteratorSetContext sets context on the list request
-// see https://github.com/aws/aws-sdk-go/issues/1790
-func iterWithContext(ctx context.Context) func(*s3manager.DeleteListIterator) {
-	return func(i *s3manager.DeleteListIterator) {
-		nr := i.Paginator.NewRequest
-		i.Paginator.NewRequest = func() (*request.Request, error) {
-			req, err := nr()
-			req.SetContext(ctx)
-			return req, err
+// WorkerPeriodic runs every minute to dispatch the tasks in the Schedule that are due
+// A cleanup that runs low on time continues in a new invocation from a checkpoint
+func WorkerPeriodic(ctx context.Context, e events.CloudWatchEvent) error {
+	log.Printf("WorkerPeriodic Event: %+v\n", e)
+
+	// a cleanup that continues from a checkpoint runs outside of the schedule
+	if e.DetailType == CleanupDetailType {
+		cp, err := cleanupCheckpoint(e)
+		if err != nil {
+			return errors.WithStack(err)
 		}
+		return cleanup(ctx, cp)
 	}
+
+	return dispatch(ctx, e.Time)
 }
@@ -0,0 +1,321 @@
+package gofaas
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	jwt "github.com/dgrijalva/jwt-go"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWork(t *testing.T) {
+	Config.Jobs.TableName = "gofaas-JobsTable"
+	Config.Worker.Bucket = "gofaas-bucket"
+
+	UUIDGen = func() uuid.UUID {
+		return uuid.Must(uuid.FromString("26f0dc9f-4483-4b65-8724-3d1598ff6d14"))
+	}
+
+	cases := []struct {
+		name string
+		body string
+		s3   []Fault
+
+		createStatus int
+		status       JobStatus
+		err          string
+	}{
+		{
+			name:         "Succeeded",
+			body:         `{"n": 1}`,
+			createStatus: 202,
+			status:       JobSucceeded,
+		},
+		{
+			name:         "Failed",
+			s3:           []Fault{{Op: "PutObject", Err: ErrAccessDenied()}},
+			createStatus: 202,
+			status:       JobFailed,
+			err:          "AccessDeniedException",
+		},
+		{
+			name:         "InvalidInput",
+			body:         `{"n":`,
+			createStatus: 400,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			ml := &MockLambda{}
+			ms3 := &MockS3{}
+
+			DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+			Lambda = ml
+			S3 = FaultS3{ms3, &Faults{Faults: c.s3}}
+
+			r, err := WorkCreate(ctx, events.APIGatewayProxyRequest{Body: c.body})
+			assert.NoError(t, err)
+			assert.Equal(t, c.createStatus, r.StatusCode)
+
+			if c.createStatus != 202 {
+				assert.Len(t, ml.Inputs, 0)
+				return
+			}
+
+			j := Job{}
+			assert.NoError(t, json.Unmarshal([]byte(r.Body), &j))
+			assert.Equal(t, "26f0dc9f-4483-4b65-8724-3d1598ff6d14", j.ID)
+			assert.Equal(t, JobQueued, j.Status)
+
+			// run the async invoke
+			if !assert.Len(t, ml.Inputs, 1) {
+				return
+			}
+			e := WorkerEvent{}
+			assert.NoError(t, json.Unmarshal(ml.Inputs[0].Payload, &e))
+			assert.Equal(t, j.ID, e.JobID)
+
+			err = Worker(ctx, e)
+			if c.err != "" {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			r, err = WorkRead(ctx, events.APIGatewayProxyRequest{
+				PathParameters: map[string]string{"id": j.ID},
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, 200, r.StatusCode)
+
+			j = Job{}
+			assert.NoError(t, json.Unmarshal([]byte(r.Body), &j))
+			assert.Equal(t, c.status, j.Status)
+			assert.NotNil(t, j.TimeStart)
+			assert.NotNil(t, j.TimeEnd)
+			assert.Contains(t, j.Error, c.err)
+
+			if c.status == JobSucceeded {
+				assert.JSONEq(t, c.body, string(j.Input))
+				key := fmt.Sprintf("reports/%s/26f0dc9f-4483-4b65-8724-3d1598ff6d14.json", j.TimeCreated.UTC().Format("2006/01/02"))
+				assert.Contains(t, j.ReportURL, "/"+key+"?")
+				assert.Contains(t, j.ReportURL, "X-Amz-Signature=")
+
+				report := []WorkerEvent{}
+				assert.NoError(t, json.Unmarshal(ms3.Objects[key], &report))
+				if assert.Len(t, report, 1) {
+					assert.JSONEq(t, c.body, string(report[0].Input))
+				}
+			} else {
+				assert.Empty(t, j.ReportURL)
+			}
+		})
+	}
+
+	r, err := WorkRead(context.Background(), events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"id": "missing"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 404, r.StatusCode)
+}
+
+func TestWorkCallerContext(t *testing.T) {
+	Config.Auth.HashKey = Secret(base64.StdEncoding.EncodeToString([]byte("secret")))
+	defer func() { Config.Auth.HashKey = "" }()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{Subject: "user-1"}).SignedString([]byte("secret"))
+	assert.NoError(t, err)
+
+	ml := &MockLambda{}
+	ms3 := &MockS3{}
+
+	DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+	Lambda = ml
+	S3 = ms3
+
+	ctx, seg := xray.BeginSegment(context.Background(), "WorkCreate")
+	defer seg.Close(nil)
+
+	r, err := WorkCreate(ctx, events.APIGatewayProxyRequest{
+		Headers: map[string]string{"Authorization": "Bearer " + token},
+		RequestContext: events.APIGatewayProxyRequestContext{
+			Identity:  events.APIGatewayRequestIdentity{SourceIP: "203.0.113.1"},
+			RequestID: "c6af9ac6-7b61-11e6-9a41-93e8deadbeef",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 202, r.StatusCode)
+	assert.Contains(t, r.Body, `"subject": "user-1"`)
+
+	if !assert.Len(t, ml.Inputs, 1) {
+		return
+	}
+	e := WorkerEvent{}
+	assert.NoError(t, json.Unmarshal(ml.Inputs[0].Payload, &e))
+	assert.Equal(t, "203.0.113.1", e.SourceIP)
+	assert.Equal(t, "c6af9ac6-7b61-11e6-9a41-93e8deadbeef", e.RequestID)
+	assert.Equal(t, "user-1", e.Subject)
+	assert.False(t, e.TimeStart.IsZero())
+	assert.Contains(t, e.TraceHeader, "Root="+seg.TraceID)
+
+	// outside of Lambda the worker continues the trace from the event
+	wctx, wseg := workerSegment(context.Background(), e)
+	if assert.NotNil(t, wseg) {
+		assert.Equal(t, seg.TraceID, xray.TraceID(wctx))
+		assert.Equal(t, "user-1", wseg.Annotations["subject"])
+		wseg.Close(nil)
+	}
+
+	assert.NoError(t, Worker(context.Background(), e))
+
+	// the report links back to the job and caller
+	if !assert.Len(t, ms3.Puts, 1) {
+		return
+	}
+	assert.Equal(t, map[string]*string{
+		"job-id":     aws.String(e.JobID),
+		"request-id": aws.String("c6af9ac6-7b61-11e6-9a41-93e8deadbeef"),
+		"subject":    aws.String("user-1"),
+	}, ms3.Puts[0].Metadata)
+
+	report := []WorkerEvent{}
+	assert.NoError(t, json.Unmarshal(ms3.Objects[*ms3.Puts[0].Key], &report))
+	if assert.Len(t, report, 1) {
+		assert.Equal(t, "user-1", report[0].Subject)
+		assert.Equal(t, "c6af9ac6-7b61-11e6-9a41-93e8deadbeef", report[0].RequestID)
+	}
+}
+
+func TestWorkerFaults(t *testing.T) {
+	Config.Notify.Topic = "arn:aws:sns:us-east-1:123456789012:gofaas-NotificationTopic"
+	defer func() { Config.Notify.Topic = "" }()
+
+	cases := []struct {
+		name    string
+		handler func(context.Context) (int, error)
+		lambda  []Fault
+		s3      []Fault
+		sns     []Fault
+		objects int
+		timeout time.Duration
+
+		status    int
+		err       string
+		published int
+		remaining int
+	}{
+		{
+			name:      "WorkCreateInvokeThrottled",
+			handler:   workCreate,
+			lambda:    []Fault{{Op: "Invoke", Err: ErrThrottling(lambda.ErrCodeTooManyRequestsException)}},
+			err:       "TooManyRequestsException",
+			published: 1,
+		},
+		{
+			name:      "WorkCreateInvokeAccessDenied",
+			handler:   workCreate,
+			lambda:    []Fault{{Op: "Invoke", Err: ErrAccessDenied()}},
+			err:       "AccessDeniedException",
+			published: 1,
+		},
+		{
+			name:      "WorkerPutObjectSlowDown",
+			handler:   worker,
+			s3:        []Fault{{Op: "PutObject", Err: ErrThrottling("SlowDown")}},
+			err:       "SlowDown",
+			published: 1,
+		},
+		{
+			name:      "WorkerPutObjectTimeout",
+			handler:   worker,
+			s3:        []Fault{{Op: "PutObject", Latency: time.Second}},
+			timeout:   10 * time.Millisecond,
+			err:       "RequestCanceled",
+			published: 1,
+		},
+		{
+			name:      "WorkerPeriodicSecondDeleteFailed",
+			handler:   workerPeriodic,
+			s3:        []Fault{{Op: "DeleteObjects", Call: 2, Err: ErrThrottling("SlowDown")}},
+			objects:   3,
+			err:       "SlowDown",
+			published: 1,
+			remaining: 1,
+		},
+		{
+			name:      "WorkerPeriodicPublishFailed",
+			handler:   workerPeriodic,
+			s3:        []Fault{{Op: "ListObjects", Err: ErrAccessDenied()}},
+			sns:       []Fault{{Op: "Publish", Err: ErrThrottling("Throttling")}},
+			objects:   1,
+			err:       "AccessDeniedException",
+			remaining: 1,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ms3 := &MockS3{Objects: map[string][]byte{}, PageSize: 2}
+			for i := 0; i < c.objects; i++ {
+				ms3.Objects[fmt.Sprintf("report-%d", i)] = []byte("{}")
+			}
+
+			DynamoDB = &MockDynamoDB{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+			Lambda = FaultLambda{&MockLambda{}, &Faults{Faults: c.lambda}}
+			S3 = FaultS3{ms3, &Faults{Faults: c.s3}}
+
+			ms := &MockSNS{}
+			fs := &Faults{Faults: c.sns}
+			SNS = FaultSNS{ms, fs}
+
+			ctx := context.Background()
+			if c.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, c.timeout)
+				defer cancel()
+			}
+
+			status, err := c.handler(ctx)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), c.err)
+			}
+			assert.Equal(t, c.status, status)
+			assert.Equal(t, 1, fs.Calls("Publish"))
+			assert.Len(t, ms3.Objects, c.remaining)
+
+			if assert.Len(t, ms.Inputs, c.published) && c.published > 0 {
+				assert.Contains(t, *ms.Inputs[0].Message, c.err)
+			}
+		})
+	}
+}
+
+func workCreate(ctx context.Context) (int, error) {
+	r, err := NotifyAPIGateway(WorkCreate)(ctx, events.APIGatewayProxyRequest{})
+	return r.StatusCode, err
+}
+
+func worker(ctx context.Context) (int, error) {
+	return 0, NotifyWorker(Worker)(ctx, WorkerEvent{})
+}
+
+// workerPeriodic dispatches the daily cleanup
+func workerPeriodic(ctx context.Context) (int, error) {
+	Config.Schedule.TableName = "gofaas-ScheduleTable"
+	return 0, NotifyCloudWatch(WorkerPeriodic)(ctx, events.CloudWatchEvent{
+		Time: time.Date(2018, 2, 22, 3, 0, 0, 0, time.UTC),
+	})
+}